@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/ghaskins/go-cluster/kv"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminStatus is reported by the admin endpoint's /v1/status
+type AdminStatus struct {
+	Id         string                    `json:"id"`
+	Leader     string                    `json:"leader"`
+	View       int64                     `json:"view"`
+	Quorum     bool                      `json:"quorum"`
+	Peers      []string                  `json:"peers"`
+	ExpiryDays map[string]int            `json:"expiryDays"` // until each member's certificate expires
+	TLS        map[string]*TLSParameters `json:"tls"`        // as negotiated with each connected peer
+
+	HandshakeFailures map[string]int `json:"handshakeFailures"` // by source address
+}
+
+// AdminServer exposes the node's status and key-value store over HTTP for use by the
+// command line tools.  It performs no authentication of its own and should only be bound
+// to a trusted interface.
+type AdminServer struct {
+	node *Node
+	kv   *KV
+	mux  *http.ServeMux
+}
+
+func NewAdminServer(node *Node, kv *KV) *AdminServer {
+	self := &AdminServer{
+		node: node,
+		kv:   kv,
+		mux:  http.NewServeMux(),
+	}
+
+	self.mux.HandleFunc("/v1/status", self.serveStatus)
+	self.mux.HandleFunc("/v1/kv/", self.serveKv)
+	self.mux.HandleFunc("/v1/watch/", self.serveWatch)
+	self.mux.Handle("/debug/vars", expvar.Handler())
+
+	return self
+}
+
+func (self *AdminServer) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, self.mux)
+}
+
+func (self *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.mux.ServeHTTP(w, r)
+}
+
+func (self *AdminServer) status() *AdminStatus {
+	leadership := self.node.Leader()
+
+	status := &AdminStatus{
+		Id:         self.node.Id(),
+		Leader:     leadership.Leader,
+		View:       leadership.View,
+		Quorum:     leadership.Quorum,
+		Peers:      []string{},
+		ExpiryDays: self.node.CertificateExpiry(),
+		TLS:        make(map[string]*TLSParameters),
+
+		HandshakeFailures: self.node.connMgr.HandshakeFailures(),
+	}
+
+	for _, peer := range self.node.controller.getPeers() {
+		status.Peers = append(status.Peers, peer.Id())
+		status.TLS[peer.Id()] = peer.conn.TLS
+	}
+	sort.Strings(status.Peers)
+
+	return status
+}
+
+func (self *AdminServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, self.status())
+}
+
+func (self *AdminServer) serveKv(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	if key == "" {
+		http.Error(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+
+	switch r.Method {
+	case http.MethodGet:
+		result, err := self.kv.Get(ctx, key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJson(w, http.StatusOK, result)
+
+	case http.MethodPut:
+		value, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var ttl time.Duration
+		if s := r.URL.Query().Get("ttl"); s != "" {
+			if ttl, err = time.ParseDuration(s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		s := r.URL.Query().Get("revision")
+		if s == "" {
+			revision, err := self.kv.Put(ctx, key, value, ttl)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJson(w, http.StatusOK, &kv.Result{Succeeded: true, Revision: revision})
+			return
+		}
+
+		expected, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ok, revision, err := self.kv.CompareAndSwap(ctx, key, expected, value, ttl)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		code := http.StatusOK
+		if !ok {
+			code = http.StatusConflict
+		}
+		writeJson(w, code, &kv.Result{Succeeded: ok, Revision: revision})
+
+	case http.MethodDelete:
+		ok, err := self.kv.Delete(ctx, key)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJson(w, http.StatusOK, &kv.Result{Succeeded: ok})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveWatch streams events as newline delimited JSON until the client goes away
+func (self *AdminServer) serveWatch(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimPrefix(r.URL.Path, "/v1/watch/")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	watcher := self.kv.Watch(prefix)
+	defer watcher.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+
+	for {
+		select {
+		case event, ok := <-watcher.Events():
+			if !ok {
+				if err := watcher.Err(); err != nil {
+					fmt.Fprintf(w, "{\"error\":%q}\n", err.Error())
+				}
+				return
+			}
+			if err := encoder.Encode(&event); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+
+	switch err {
+	case kv.ErrKeyNotFound:
+		code = http.StatusNotFound
+	case ErrNotLeader, ErrNoQuorum:
+		code = http.StatusServiceUnavailable
+	case context.DeadlineExceeded:
+		code = http.StatusGatewayTimeout
+	}
+
+	http.Error(w, err.Error(), code)
+}
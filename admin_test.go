@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/ghaskins/go-cluster/kv"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAdmin serves the admin endpoint of a follower in a running cluster
+func newTestAdmin(t *testing.T) (*httptest.Server, []*testMember) {
+	cluster := newTestKVCluster(t, 2)
+
+	follower := cluster[0]
+	if follower.node.Leader().Leader == follower.node.Id() {
+		follower = cluster[1]
+	}
+
+	server := httptest.NewServer(NewAdminServer(follower.node, follower.kv))
+	t.Cleanup(server.Close)
+
+	return server, cluster
+}
+
+func request(t *testing.T, method, url, payload string) (int, []byte) {
+	req, err := http.NewRequest(method, url, strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, body
+}
+
+func TestAdminStatus(t *testing.T) {
+	server, cluster := newTestAdmin(t)
+
+	code, body := request(t, http.MethodGet, server.URL+"/v1/status", "")
+	assert.Equal(t, http.StatusOK, code)
+
+	var status AdminStatus
+	assert.Nil(t, json.Unmarshal(body, &status))
+	assert.True(t, status.Quorum)
+	assert.Equal(t, cluster[0].node.Leader().Leader, status.Leader)
+	assert.Equal(t, 1, len(status.Peers))
+	assert.Equal(t, 2, len(status.ExpiryDays))
+
+	if assert.NotNil(t, status.TLS[status.Peers[0]]) {
+		assert.Equal(t, "TLS 1.3", status.TLS[status.Peers[0]].Version)
+	}
+}
+
+func TestAdminKv(t *testing.T) {
+	server, _ := newTestAdmin(t)
+	url := server.URL + "/v1/kv/"
+
+	var result kv.Result
+
+	code, body := request(t, http.MethodPut, url+"a", "1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, json.Unmarshal(body, &result))
+	assert.True(t, result.Succeeded)
+	revision := result.Revision
+
+	var value kv.KeyValue
+	code, body = request(t, http.MethodGet, url+"a", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, json.Unmarshal(body, &value))
+	assert.Equal(t, "1", string(value.Value))
+	assert.Equal(t, revision, value.Revision)
+
+	// Swaps only succeed at the revision given
+	code, _ = request(t, http.MethodPut, url+"a?revision=0", "2")
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, body = request(t, http.MethodPut, url+"a?revision="+strconv.FormatUint(revision, 10)+"&ttl=1h", "2")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, json.Unmarshal(body, &result))
+	assert.True(t, result.Succeeded)
+
+	code, body = request(t, http.MethodDelete, url+"a", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Nil(t, json.Unmarshal(body, &result))
+	assert.True(t, result.Succeeded)
+
+	code, _ = request(t, http.MethodGet, url+"a", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// Malformed requests
+	code, _ = request(t, http.MethodGet, url, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = request(t, http.MethodPut, url+"a?ttl=soon", "1")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = request(t, http.MethodPut, url+"a?revision=latest", "1")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = request(t, http.MethodPost, url+"a", "1")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+}
+
+func TestAdminWatch(t *testing.T) {
+	server, _ := newTestAdmin(t)
+
+	resp, err := http.Get(server.URL + "/v1/watch/app/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	// Only changes under the prefix are streamed
+	for _, key := range []string{"other", "app/a"} {
+		code, _ := request(t, http.MethodPut, server.URL+"/v1/kv/"+key, "1")
+		assert.Equal(t, http.StatusOK, code)
+	}
+
+	events := make(chan kv.Event, 10)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var event kv.Event
+			if json.Unmarshal(scanner.Bytes(), &event) == nil {
+				events <- event
+			}
+		}
+		close(events)
+	}()
+
+	select {
+	case event := <-events:
+		assert.Equal(t, kv.EventPut, event.Type)
+		assert.Equal(t, "app/a", event.Kv.Key)
+		assert.Equal(t, "1", string(event.Kv.Value))
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the event")
+	}
+}
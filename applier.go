@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/ghaskins/go-cluster/pb"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// StateMachine is the application state that the replicated log drives.  Apply is invoked
+// for every committed command, in log order, on every member.  Snapshot and Restore are
+// used to compact the log and to bring lagging members up to date; Snapshot is never
+// called concurrently with Apply.
+type StateMachine interface {
+	Apply(command []byte) []byte
+	Snapshot() (io.ReadCloser, error)
+	Restore(snapshot io.Reader) error
+}
+
+// SnapshotPolicy determines when the log is compacted.  A snapshot is taken once either
+// limit is reached, whichever comes first.  A zero value disables that limit.
+type SnapshotPolicy struct {
+	Entries uint64
+	Bytes   uint64
+}
+
+var DefaultSnapshotPolicy = SnapshotPolicy{
+	Entries: 10000,
+	Bytes:   64 * 1024 * 1024,
+}
+
+type applyResult struct {
+	result []byte
+	err    error
+}
+
+type applyWaiter struct {
+	view   int64
+	result chan applyResult
+}
+
+// An applyOp either applies a batch of committed entries or restores a snapshot
+type applyOp struct {
+	entries  []*pb.Entry
+	restore  bool
+	snapshot []byte
+	index    uint64
+	view     int64
+}
+
+type snapshotTaken struct {
+	index uint64
+	view  int64
+	data  []byte
+}
+
+// applier executes committed entries against the state machine on its own goroutine so
+// that a slow application cannot stall the controller.  Its queue is unbounded, so that
+// handing it work never blocks the controller either.
+type applier struct {
+	sm           StateMachine
+	policy       SnapshotPolicy
+	snapshots    chan *snapshotTaken
+	failures     chan uint64 // the index of each snapshot that could not be restored
+	mutex        sync.Mutex
+	queue        []*applyOp
+	queued       chan struct{} // signalled whenever the queue changes
+	closed       bool
+	waiters      map[uint64]*applyWaiter
+	published    uint64        // appliedIndex as seen by other goroutines
+	progressed   chan struct{} // closed whenever published advances
+	appliedIndex uint64
+	appliedView  int64
+	sinceEntries uint64
+	sinceBytes   uint64
+	broken       bool // the state machine is in an unknown state until a restore succeeds
+}
+
+func newApplier() *applier {
+	return &applier{
+		policy:     DefaultSnapshotPolicy,
+		snapshots:  make(chan *snapshotTaken, 1),
+		failures:   make(chan uint64, 1),
+		queued:     make(chan struct{}, 1),
+		waiters:    make(map[uint64]*applyWaiter),
+		progressed: make(chan struct{}),
+	}
+}
+
+// enqueue hands an operation to the applier without waiting for it
+func (self *applier) enqueue(op *applyOp) {
+	self.mutex.Lock()
+	self.queue = append(self.queue, op)
+	self.mutex.Unlock()
+
+	self.signal()
+}
+
+// close stops the applier once it has executed everything already queued
+func (self *applier) close() {
+	self.mutex.Lock()
+	self.closed = true
+	self.mutex.Unlock()
+
+	self.signal()
+}
+
+func (self *applier) signal() {
+	select {
+	case self.queued <- struct{}{}:
+	default:
+	}
+}
+
+// wait registers interest in the outcome of the entry at index, which was appended
+// during view
+func (self *applier) wait(index uint64, view int64) chan applyResult {
+	waiter := &applyWaiter{view: view, result: make(chan applyResult, 1)}
+
+	self.mutex.Lock()
+	self.waiters[index] = waiter
+	self.mutex.Unlock()
+
+	return waiter.result
+}
+
+func (self *applier) cancelWait(index uint64) {
+	self.mutex.Lock()
+	delete(self.waiters, index)
+	self.mutex.Unlock()
+}
+
+func (self *applier) complete(index uint64, view int64, result []byte) {
+	self.mutex.Lock()
+	waiter, ok := self.waiters[index]
+	delete(self.waiters, index)
+	self.mutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if waiter.view != view {
+		// Our entry was replaced by a different leader's before it could commit
+		waiter.result <- applyResult{err: ErrNotLeader}
+		return
+	}
+
+	waiter.result <- applyResult{result: result}
+}
+
+// failWaiters abandons every outstanding waiter up to and including index
+func (self *applier) failWaiters(index uint64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i, waiter := range self.waiters {
+		if i <= index {
+			waiter.result <- applyResult{err: ErrNotLeader}
+			delete(self.waiters, i)
+		}
+	}
+}
+
+// waitApplied returns once every entry up to and including index has been applied
+func (self *applier) waitApplied(ctx context.Context, index uint64) error {
+	for {
+		self.mutex.Lock()
+		applied, progressed := self.published, self.progressed
+		self.mutex.Unlock()
+
+		if applied >= index {
+			return nil
+		}
+
+		select {
+		case <-progressed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (self *applier) publish() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.published = self.appliedIndex
+	close(self.progressed)
+	self.progressed = make(chan struct{})
+}
+
+func (self *applier) run() {
+	for {
+		self.mutex.Lock()
+		ops, closed := self.queue, self.closed
+		self.queue = nil
+		self.mutex.Unlock()
+
+		for _, op := range ops {
+			self.execute(op)
+		}
+
+		if closed {
+			return
+		}
+
+		<-self.queued
+	}
+}
+
+func (self *applier) execute(op *applyOp) {
+	switch {
+	case op.restore:
+		if err := self.restore(op); err != nil {
+			fmt.Printf("failed to restore snapshot at index %d: %s\n", op.index, err.Error())
+			self.broken = true
+
+			select {
+			case self.failures <- op.index:
+			default:
+				// The controller has yet to hear of an earlier failure, which will do
+			}
+			return
+		}
+		self.broken = false
+	case self.broken:
+		// Applying entries on top of a failed restore would diverge from the cluster, so
+		// they are discarded until a fresh snapshot arrives and is dispatched again
+		return
+	default:
+		for _, entry := range op.entries {
+			self.apply(entry)
+		}
+
+		self.maybeSnapshot()
+	}
+
+	self.publish()
+}
+
+func (self *applier) apply(entry *pb.Entry) {
+	var result []byte
+
+	if !entry.GetNoop() && self.sm != nil {
+		result = self.sm.Apply(entry.GetData())
+	}
+
+	self.appliedIndex = entry.GetIndex()
+	self.appliedView = entry.GetViewId()
+	self.sinceEntries++
+	self.sinceBytes += uint64(len(entry.GetData()))
+
+	self.complete(entry.GetIndex(), entry.GetViewId(), result)
+}
+
+func (self *applier) restore(op *applyOp) error {
+	if self.sm != nil {
+		if err := self.sm.Restore(bytes.NewReader(op.snapshot)); err != nil {
+			return err
+		}
+	}
+
+	self.failWaiters(op.index)
+	self.appliedIndex = op.index
+	self.appliedView = op.view
+	self.sinceEntries = 0
+	self.sinceBytes = 0
+
+	return nil
+}
+
+func (self *applier) maybeSnapshot() {
+	if self.sm == nil {
+		return
+	}
+
+	if (self.policy.Entries == 0 || self.sinceEntries < self.policy.Entries) &&
+		(self.policy.Bytes == 0 || self.sinceBytes < self.policy.Bytes) {
+		return
+	}
+
+	reader, err := self.sm.Snapshot()
+	if err != nil {
+		fmt.Printf("snapshot failed: %s\n", err.Error())
+		return
+	}
+	defer reader.Close()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		fmt.Printf("snapshot failed: %s\n", err.Error())
+		return
+	}
+
+	select {
+	case self.snapshots <- &snapshotTaken{index: self.appliedIndex, view: self.appliedView, data: data}:
+		self.sinceEntries = 0
+		self.sinceBytes = 0
+	default:
+		// The controller hasn't picked up the previous snapshot yet; try again later
+	}
+}
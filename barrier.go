@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"github.com/ghaskins/go-cluster/pb"
+	"github.com/golang/protobuf/proto"
+)
+
+// A barrier is satisfied once a quorum of followers have acknowledged a heartbeat that
+// was sent after the barrier was requested, proving that nobody has displaced us as
+// leader in the meantime.  This is the ReadIndex technique from the Raft literature.
+type barrier struct {
+	ctx       context.Context
+	seq       uint64
+	view      int64
+	readIndex uint64 // the commit index when the barrier was requested
+	readable  bool   // whether readIndex reflects every write committed by prior leaders
+	acks      map[string]bool
+	result    chan error
+}
+
+// LinearizableBarrier returns once this node has confirmed that it was still the leader
+// at some point after the call was made.  State observed on the leader after the barrier
+// returns is therefore at least as new as any write completed before the call.  Followers
+// receive ErrNotLeader and should route linearizable reads to the leader.
+func (self *Node) LinearizableBarrier(ctx context.Context) error {
+	_, err := self.barrier(ctx)
+	return err
+}
+
+// LinearizableRead returns once the local state machine reflects every command that was
+// committed before the call.  Like LinearizableBarrier, it may only be used on the leader.
+func (self *Node) LinearizableRead(ctx context.Context) error {
+	b, err := self.barrier(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !b.readable {
+		// We haven't committed an entry in our own view yet, so we can't be sure that we
+		// know about everything our predecessors committed
+		return ErrNotLeader
+	}
+
+	return self.controller.replicator.applier.waitApplied(ctx, b.readIndex)
+}
+
+func (self *Node) barrier(ctx context.Context) (*barrier, error) {
+	b := &barrier{
+		ctx:    ctx,
+		acks:   make(map[string]bool),
+		result: make(chan error, 1),
+	}
+
+	select {
+	case self.controller.barriers <- b:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case err := <-b.result:
+		return b, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (self *Controller) onBarrier(b *barrier) {
+	switch self.state.Current() {
+	case "leading":
+	case "convening":
+		b.result <- ErrNoQuorum
+		return
+	default:
+		b.result <- ErrNotLeader
+		return
+	}
+
+	b.readIndex, b.readable = self.replicator.readIndex()
+
+	if self.quorumThreshold == 0 {
+		// We are a quorum of one
+		b.result <- nil
+		return
+	}
+
+	if !self.canConfirmBarriers() {
+		b.result <- ErrNoBarrierQuorum
+		return
+	}
+
+	// Don't wait for the next pulse.  Only acknowledgements of this heartbeat or a later
+	// one count toward the barrier.
+	self.sendHeartbeat()
+	b.seq = self.heartbeatSeq
+	b.view = self.electionManager.View()
+	self.pendingBarriers = append(self.pendingBarriers, b)
+}
+
+func (self *Controller) sendHeartbeat() {
+	// The first heartbeat of the view carries the proof of our election
+	var certificate *pb.QuorumCertificate
+	if !self.announced {
+		certificate = self.certificate
+		self.announced = true
+	}
+
+	self.broadcast(self.newHeartbeat(certificate))
+}
+
+// newHeartbeat numbers every heartbeat anew, so that a signed heartbeat is only good once
+func (self *Controller) newHeartbeat(certificate *pb.QuorumCertificate) *pb.Heartbeat {
+	self.heartbeatSeq++
+
+	msg := &pb.Heartbeat{
+		ViewId:      proto.Int64(self.electionManager.View()),
+		Seq:         proto.Uint64(self.heartbeatSeq),
+		Certificate: certificate,
+	}
+
+	if self.signer != nil {
+		if err := self.signer.signHeartbeat(msg); err != nil {
+			panic(err)
+		}
+	}
+
+	return msg
+}
+
+func (self *Controller) onHeartbeatAck(from string, viewId int64, seq uint64) {
+	if self.state.Current() != "leading" || viewId != self.electionManager.View() || !self.isVoter(from) {
+		return
+	}
+
+	remaining := self.pendingBarriers[:0]
+
+	for _, b := range self.pendingBarriers {
+		if b.view == viewId && b.seq <= seq {
+			b.acks[from] = true
+		}
+
+		if len(b.acks) >= self.quorumThreshold {
+			b.result <- nil
+		} else {
+			remaining = append(remaining, b)
+		}
+	}
+
+	self.pendingBarriers = remaining
+}
+
+// canConfirmBarriers reports whether enough voters could acknowledge our heartbeats to
+// make a quorum.  Those connected with version 1 of the wire protocol never will, while
+// those we aren't connected to may yet connect with a later version.
+func (self *Controller) canConfirmBarriers() bool {
+	count := 0
+	for id := range self.peers {
+		if id == self.myId || !self.isVoter(id) {
+			continue
+		}
+		if peer := self.activePeers[id]; peer != nil && !peer.conn.Supports(FeatureHeartbeatAck) {
+			continue
+		}
+		count++
+	}
+
+	return count >= self.quorumThreshold
+}
+
+// pruneBarriers discards barriers whose callers have given up waiting
+func (self *Controller) pruneBarriers() {
+	remaining := self.pendingBarriers[:0]
+
+	for _, b := range self.pendingBarriers {
+		if b.ctx.Err() == nil {
+			remaining = append(remaining, b)
+		}
+	}
+
+	self.pendingBarriers = remaining
+}
+
+func (self *Controller) failBarriers(err error) {
+	for _, b := range self.pendingBarriers {
+		b.result <- err
+	}
+
+	self.pendingBarriers = nil
+}
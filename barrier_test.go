@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newTestController(self string, members ...string) *Controller {
+	peers := IdentityMap{}
+	for _, id := range append(members, self) {
+		peers[id] = &Identity{Id: id}
+	}
+
+	return NewController(self, peers, nil, NewRouter())
+}
+
+func newTestBarrier() *barrier {
+	return &barrier{
+		ctx:    context.Background(),
+		acks:   make(map[string]bool),
+		result: make(chan error, 1),
+	}
+}
+
+func pending(b *barrier) bool {
+	select {
+	case err := <-b.result:
+		b.result <- err
+		return false
+	default:
+		return true
+	}
+}
+
+func TestBarrierRequiresLeadership(t *testing.T) {
+	c := newTestController("A", "B", "C")
+
+	b := newTestBarrier()
+	c.onBarrier(b)
+	assert.Equal(t, ErrNoQuorum, <-b.result)
+
+	c.state.SetState("following")
+
+	b = newTestBarrier()
+	c.onBarrier(b)
+	assert.Equal(t, ErrNotLeader, <-b.result)
+}
+
+func TestBarrierQuorum(t *testing.T) {
+	c := newTestController("A", "B", "C", "D", "E")
+	c.state.SetState("leading")
+
+	view := c.electionManager.View()
+
+	// A stale acknowledgement from before the barrier was requested doesn't count
+	c.heartbeatSeq = 5
+	b := newTestBarrier()
+	c.onBarrier(b)
+	c.onHeartbeatAck("B", view, 5)
+	assert.True(t, pending(b))
+
+	// Nor does one from a different view
+	c.onHeartbeatAck("B", view+1, 6)
+	assert.True(t, pending(b))
+
+	// Two acknowledgements plus ourselves make a quorum of five
+	c.onHeartbeatAck("B", view, 6)
+	assert.True(t, pending(b))
+	c.onHeartbeatAck("B", view, 7)
+	assert.True(t, pending(b))
+	c.onHeartbeatAck("C", view, 6)
+	assert.Nil(t, <-b.result)
+	assert.Empty(t, c.pendingBarriers)
+}
+
+func TestBarrierFailsOnDeposition(t *testing.T) {
+	c := newTestController("A", "B", "C")
+	c.state.SetState("leading")
+
+	b := newTestBarrier()
+	c.onBarrier(b)
+	assert.True(t, pending(b))
+
+	c.failBarriers(ErrNotLeader)
+	assert.Equal(t, ErrNotLeader, <-b.result)
+}
+
+// Members running version 1 never acknowledge heartbeats, so they don't count toward a
+// barrier's quorum
+func TestBarrierMixedVersions(t *testing.T) {
+	c := newTestController("A", "B", "C", "D", "E")
+	c.state.SetState("leading")
+
+	legacy := func(id string) {
+		conn := &Connection{Id: &Identity{Id: id}, protocol: &agreement{version: legacyProtocolVersion, features: map[string]bool{}}}
+		c.activePeers[id], _, _ = newTestPeer(conn)
+	}
+
+	view := c.electionManager.View()
+
+	// D and E can still make a quorum with us
+	legacy("B")
+	legacy("C")
+	b := newTestBarrier()
+	c.onBarrier(b)
+	c.onHeartbeatAck("D", view, b.seq)
+	assert.True(t, pending(b))
+	c.onHeartbeatAck("E", view, b.seq)
+	assert.Nil(t, <-b.result)
+
+	// Once a third runs version 1, barriers fail rather than wait in vain, including any
+	// already pending
+	b = newTestBarrier()
+	c.onBarrier(b)
+	legacy("D")
+	assert.False(t, c.canConfirmBarriers())
+	c.failBarriers(ErrNoBarrierQuorum)
+	assert.Equal(t, ErrNoBarrierQuorum, <-b.result)
+
+	b = newTestBarrier()
+	c.onBarrier(b)
+	assert.Equal(t, ErrNoBarrierQuorum, <-b.result)
+	assert.Empty(t, c.pendingBarriers)
+}
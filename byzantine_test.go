@@ -0,0 +1,189 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEnableByzantine(t *testing.T) {
+	// Signatures are required to attribute votes
+	c := newTestController("A", "B", "C", "D")
+	assert.NotNil(t, c.enableByzantine())
+
+	// As are at least 3f+1 voters
+	controllers := newTestSignedControllers(t, "A", "B", "C")
+	assert.NotNil(t, controllers["A"].enableByzantine())
+
+	controllers = newTestSignedControllers(t, "A", "B", "C", "D")
+	c = controllers["A"]
+	assert.Equal(t, 2, c.quorumThreshold)
+	assert.Nil(t, c.enableByzantine())
+	assert.Equal(t, 2, c.quorumThreshold)
+	assert.Equal(t, 3, c.electionManager.Threshold())
+
+	controllers = newTestSignedControllers(t, "A", "B", "C", "D", "E", "F", "G")
+	c = controllers["A"]
+	assert.Equal(t, 3, c.quorumThreshold)
+	assert.Nil(t, c.enableByzantine())
+	assert.Equal(t, 4, c.quorumThreshold)
+	assert.Equal(t, 5, c.electionManager.Threshold())
+	assert.Equal(t, 4, c.replicator.quorumThreshold)
+}
+
+func TestEquivocatingVotesDropped(t *testing.T) {
+	controllers := newTestSignedControllers(t, "A", "B", "C", "D")
+	c := controllers["A"]
+	assert.Nil(t, c.enableByzantine())
+
+	c.onVote("B", "C", 0)
+	c.onVote("B", "D", 0)
+
+	contender, _, err := c.electionManager.GetContender()
+	assert.Nil(t, err)
+	assert.Equal(t, "C", contender)
+
+	// Nor do we change our own mind within a view
+	c.castBallot("C", 0)
+	c.castBallot("D", 0)
+	assert.Equal(t, "C", c.signedVotes["A"].GetPeerId())
+}
+
+// exchangeBallots delivers the latest vote each controller cast to every other controller,
+// none of which may be an equivocation
+func exchangeBallots(t *testing.T, controllers map[string]*Controller) {
+	for voter, c := range controllers {
+		vote, ok := c.signedVotes[voter]
+		if !ok {
+			continue
+		}
+
+		for id, other := range controllers {
+			if id == voter {
+				continue
+			}
+
+			if evidence := other.checkEquivocation(voter, vote); evidence != nil {
+				t.Errorf("%s equivocated in view %d", voter, evidence.View)
+			}
+			other.onVote(voter, vote.GetPeerId(), vote.GetViewId())
+		}
+	}
+}
+
+// splitVote leaves A, B, C and D electing with A and C voting for A, and B and D for B
+func splitVote(t *testing.T, controllers map[string]*Controller) {
+	for _, c := range controllers {
+		c.state.SetState("electing")
+	}
+
+	for voter, candidate := range map[string]string{"A": "A", "B": "B", "C": "A", "D": "B"} {
+		controllers[voter].castBallot(candidate, 0)
+	}
+	exchangeBallots(t, controllers)
+
+	for _, c := range controllers {
+		_, err := c.electionManager.Current()
+		assert.NotNil(t, err)
+	}
+}
+
+// resolveElection times out each member's election in turn until they all agree on a leader
+func resolveElection(t *testing.T, controllers map[string]*Controller) string {
+	agreed := func() (string, bool) {
+		var leader string
+		for _, c := range controllers {
+			current, err := c.electionManager.Current()
+			if err != nil || (leader != "" && current != leader) {
+				return "", false
+			}
+			leader = current
+		}
+		return leader, true
+	}
+
+	for round := 0; round < 3; round++ {
+		for _, id := range []string{"C", "D", "B", "A"} {
+			if _, err := controllers[id].electionManager.Current(); err != nil {
+				controllers[id].onTimeout()
+				exchangeBallots(t, controllers)
+			}
+
+			if leader, ok := agreed(); ok {
+				return leader
+			}
+		}
+	}
+
+	t.Fatal("no leader was elected")
+	return ""
+}
+
+func TestByzantineSplitVoteResolved(t *testing.T) {
+	controllers := newTestSignedControllers(t, "A", "B", "C", "D")
+	for _, c := range controllers {
+		assert.Nil(t, c.enableByzantine())
+	}
+
+	splitVote(t, controllers)
+	assert.Equal(t, "A", resolveElection(t, controllers))
+
+	// Nobody changed their vote within a view to get there
+	for _, c := range controllers {
+		assert.True(t, c.electionManager.View() > 0)
+	}
+}
+
+func TestSplitVoteSingleLeaderPerView(t *testing.T) {
+	controllers := map[string]*Controller{
+		"A": newTestController("A", "B", "C"),
+		"B": newTestController("B", "A", "C"),
+		"C": newTestController("C", "A", "B"),
+	}
+	for _, c := range controllers {
+		c.state.SetState("electing")
+	}
+
+	// deliver sends a controller's ballot to the others given
+	deliver := func(voter string, to ...string) {
+		candidate, view, ok := controllers[voter].electionManager.Ballot(voter)
+		assert.True(t, ok)
+		for _, id := range to {
+			controllers[id].onVote(voter, candidate, view)
+		}
+	}
+
+	// record notes the leader each controller has elected, which must be the only one in its view
+	leaders := make(map[int64]string)
+	record := func() {
+		for id, c := range controllers {
+			leader, err := c.electionManager.Current()
+			if err != nil {
+				continue
+			}
+
+			view := c.electionManager.View()
+			if elected, ok := leaders[view]; ok {
+				assert.Equal(t, elected, leader, "%s disagrees on view %d", id, view)
+			}
+			leaders[view] = leader
+		}
+	}
+
+	controllers["A"].castBallot("A", 0)
+	controllers["B"].castBallot("B", 0)
+	controllers["C"].castBallot("B", 0)
+
+	// C's vote never reaches A, and B's reaches C late, so only B elects B
+	deliver("A", "B", "C")
+	deliver("B", "A")
+	deliver("C", "B")
+	record()
+
+	// C gives up on B in favour of A, and A follows it
+	controllers["C"].onTimeout()
+	deliver("C", "A", "B")
+	controllers["A"].onTimeout()
+	record()
+
+	assert.Equal(t, map[int64]string{0: "B", 1: "A"}, leaders)
+}
@@ -1,40 +1,133 @@
 package main
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"strings"
 )
 
-func parseKey(path string) (crypto.PublicKey, error) {
+// Passphrase supplies the passphrase protecting an encrypted private key
+type Passphrase func() ([]byte, error)
 
-	buf, err := ioutil.ReadFile(path)
+// PassphraseFromFile reads the passphrase from the first line of a file
+func PassphraseFromFile(path string) Passphrase {
+	return func() ([]byte, error) {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open passphrase file \"%s\": %s", path, err.Error())
+		}
+
+		return bytes.TrimRight(buf, "\r\n"), nil
+	}
+}
+
+// PassphraseFromEnv reads the passphrase from an environment variable
+func PassphraseFromEnv(name string) Passphrase {
+	return func() ([]byte, error) {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("passphrase variable %s is not set", name)
+		}
+
+		return []byte(value), nil
+	}
+}
+
+// KeyProvider loads a private key held somewhere other than a key file, such as in an
+// agent, given its location
+type KeyProvider func(location string) (crypto.Signer, error)
+
+var keyProviders = map[string]KeyProvider{
+	"agent": DialKeyAgent,
+}
+
+// RegisterKeyProvider makes keys held by a provider available as "<name>:<location>".  It
+// must be called before any keys are loaded.
+func RegisterKeyProvider(name string, provider KeyProvider) {
+	keyProviders[name] = provider
+}
+
+// LoadPrivateKey loads a private key either from a PEM file, which may be encrypted, or
+// from a registered KeyProvider when given as "<provider>:<location>"
+func LoadPrivateKey(location string, passphrase Passphrase) (crypto.Signer, error) {
+	if i := strings.Index(location, ":"); i > 0 {
+		if provider, ok := keyProviders[location[:i]]; ok {
+			return provider(location[i+1:])
+		}
+	}
+
+	buf, err := ioutil.ReadFile(location)
+	if err != nil {
+		return nil, errors.New("failed to open key file \"" + location + "\"")
+	}
+
+	key, err := parseKey(buf, passphrase)
 	if err != nil {
-		return nil, errors.New("failed to open key file \"" + path + "\"")
+		return nil, fmt.Errorf("key file \"%s\": %s", location, err.Error())
 	}
 
+	return key, nil
+}
+
+// parseKey parses an RSA, ECDSA or Ed25519 private key in PKCS#1, SEC 1 or PKCS#8 form.
+// Keys encrypted as PKCS#8 or with legacy PEM encryption are decrypted with the passphrase.
+func parseKey(buf []byte, passphrase Passphrase) (crypto.Signer, error) {
+
 	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("private key is not PEM encoded")
+	}
 	if block.Type != "PRIVATE KEY" && strings.HasSuffix(block.Type, " PRIVATE KEY") == false {
 		return nil, errors.New("private key PEM does not appear to contain a private key blob")
 	}
 
 	der := block.Bytes
+
+	if encrypted := x509.IsEncryptedPEMBlock(block); encrypted || block.Type == "ENCRYPTED PRIVATE KEY" {
+		if passphrase == nil {
+			return nil, errors.New("private key is encrypted but no passphrase was given")
+		}
+
+		password, err := passphrase()
+		if err != nil {
+			return nil, err
+		}
+
+		if encrypted {
+			log.Printf("Legacy PEM encryption is insecure; convert the key with \"openssl pkcs8 -topk8\"")
+			der, err = x509.DecryptPEMBlock(block, password)
+		} else {
+			der, err = decryptPKCS8(der, password)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt private key: %s", err.Error())
+		}
+	}
+
 	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
 		return key, nil
 	}
 	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
 		switch key := key.(type) {
-		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		case *rsa.PrivateKey:
+			return key, nil
+		case *ecdsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
 			return key, nil
 		default:
-			return nil, errors.New("crypto/tls: found unknown private key type in PKCS#8 wrapping")
+			return nil, fmt.Errorf("found unsupported private key type %T in PKCS#8 wrapping", key)
 		}
 	}
 	if key, err := x509.ParseECPrivateKey(der); err == nil {
@@ -44,18 +137,27 @@ func parseKey(path string) (crypto.PublicKey, error) {
 	return nil, errors.New("failed to parse private key")
 }
 
-func CreateTlsIdentity(cert *x509.Certificate, privateKeyPath string) (conn *tls.Certificate, err error) {
-
-	var privateKey crypto.PublicKey
+// CreateTlsIdentity loads the private key for a certificate, as by LoadPrivateKey
+func CreateTlsIdentity(cert *x509.Certificate, privateKeyPath string, passphrase Passphrase) (*tls.Certificate, error) {
 
-	privateKey, err = parseKey(privateKeyPath)
+	privateKey, err := LoadPrivateKey(privateKeyPath, passphrase)
 	if err != nil {
 		return nil, err
 	}
 
+	return NewTlsIdentity(cert, privateKey)
+}
+
+// NewTlsIdentity pairs a certificate with the key that signs for it, which need not be
+// held in memory: any crypto.Signer for the certificate's key will do
+func NewTlsIdentity(cert *x509.Certificate, key crypto.Signer) (*tls.Certificate, error) {
+	if err := checkKeyPair(cert, key); err != nil {
+		return nil, err
+	}
+
 	tlsCert := &tls.Certificate{
 		Certificate: make([][]byte, 1),
-		PrivateKey:  privateKey,
+		PrivateKey:  key,
 	}
 
 	tlsCert.Certificate[0] = cert.Raw
@@ -63,7 +165,15 @@ func CreateTlsIdentity(cert *x509.Certificate, privateKeyPath string) (conn *tls
 	return tlsCert, nil
 }
 
+// ParseCertificates parses the certificates in a PEM file, dropping any that are not
+// validly self-signed
 func ParseCertificates(path string) ([]*x509.Certificate, error) {
+	return ParseCertificatesIssuedBy(path, nil)
+}
+
+// ParseCertificatesIssuedBy parses the certificates in a PEM file, dropping any that are
+// neither validly self-signed nor issued by one of the CAs given
+func ParseCertificatesIssuedBy(path string, issuers []*x509.Certificate) ([]*x509.Certificate, error) {
 	buf, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, errors.New("failed to open certificates file \"" + path + "\"")
@@ -85,7 +195,7 @@ func ParseCertificates(path string) ([]*x509.Certificate, error) {
 			continue
 		}
 
-		if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		if err := checkSignature(cert, issuers); err != nil {
 			log.Printf("Dropping certificate %s due to bad signature (%s)", cert.Subject.CommonName, err.Error())
 			continue
 		}
@@ -95,3 +205,20 @@ func ParseCertificates(path string) ([]*x509.Certificate, error) {
 
 	return certs, nil
 }
+
+// checkSignature verifies that a certificate is signed either by its own key or by one of
+// the CAs given.  A self-signed certificate is trusted for its place in the membership
+// file, whereas one issued by a CA is only trusted if the CA is.
+func checkSignature(cert *x509.Certificate, issuers []*x509.Certificate) error {
+	if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+	}
+
+	for _, issuer := range issuers {
+		if bytes.Equal(cert.RawIssuer, issuer.RawSubject) {
+			return cert.CheckSignatureFrom(issuer)
+		}
+	}
+
+	return fmt.Errorf("certificate for %s is not self-signed, and its issuer is not trusted", cert.Subject.CommonName)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ghaskins/go-cluster/kv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const defaultAdminAddr = "localhost:8080"
+
+func kvUsage(flags *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "usage: go-cluster kv [options] <command> [args]\n\n")
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	fmt.Fprintf(os.Stderr, "\tget <key>\n")
+	fmt.Fprintf(os.Stderr, "\tput <key> <value>\n")
+	fmt.Fprintf(os.Stderr, "\tcas <key> <revision> <value>\t(revision 0 creates the key only if absent)\n")
+	fmt.Fprintf(os.Stderr, "\tdelete <key>\n")
+	fmt.Fprintf(os.Stderr, "\twatch <prefix>\n\n")
+	fmt.Fprintf(os.Stderr, "options:\n")
+	flags.PrintDefaults()
+}
+
+// runKvCommand implements "go-cluster kv", which operates on the key-value store of a
+// running node via its admin endpoint, printing its results to stdout
+func runKvCommand(args []string, stdout io.Writer) int {
+	flags := flag.NewFlagSet("kv", flag.ExitOnError)
+	admin := flags.String("admin", defaultAdminAddr, "the admin address of the node to contact")
+	ttl := flags.Duration("ttl", 0, "for put and cas, the time after which the key expires")
+	flags.Usage = func() { kvUsage(flags) }
+	flags.Parse(args)
+
+	args = flags.Args()
+	if len(args) < 2 {
+		flags.Usage()
+		return 2
+	}
+
+	command, key := args[0], args[1]
+	target := fmt.Sprintf("http://%s/v1/kv/%s", *admin, url.PathEscape(key))
+
+	var resp *http.Response
+	var err error
+
+	switch {
+	case command == "get" && len(args) == 2:
+		resp, err = http.Get(target)
+	case command == "put" && len(args) == 3:
+		resp, err = kvPut(target, args[2], *ttl, nil)
+	case command == "cas" && len(args) == 4:
+		resp, err = kvPut(target, args[3], *ttl, &args[2])
+	case command == "delete" && len(args) == 2:
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodDelete, target, nil)
+		if err == nil {
+			resp, err = http.DefaultClient.Do(req)
+		}
+	case command == "watch" && len(args) == 2:
+		return kvWatch(fmt.Sprintf("http://%s/v1/watch/%s", *admin, url.PathEscape(key)), stdout)
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		fmt.Fprintf(os.Stderr, "revision mismatch\n")
+		return 1
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %s", resp.Status, body)
+		return 1
+	}
+
+	if command == "get" {
+		var result kv.KeyValue
+		if err := json.Unmarshal(body, &result); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		}
+		fmt.Fprintf(stdout, "%s\n", result.Value)
+		return 0
+	}
+
+	var result kv.Result
+	if err := json.Unmarshal(body, &result); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	if command == "delete" {
+		if !result.Succeeded {
+			fmt.Fprintf(os.Stderr, "key not found\n")
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(stdout, "revision %d\n", result.Revision)
+	return 0
+}
+
+func kvPut(target, value string, ttl time.Duration, revision *string) (*http.Response, error) {
+	query := url.Values{}
+	if ttl > 0 {
+		query.Set("ttl", ttl.String())
+	}
+	if revision != nil {
+		query.Set("revision", *revision)
+	}
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(http.MethodPut, target, bytes.NewBufferString(value))
+	if err != nil {
+		return nil, err
+	}
+
+	return http.DefaultClient.Do(req)
+}
+
+func kvWatch(target string, stdout io.Writer) int {
+	resp, err := http.Get(target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "%s\n", resp.Status)
+		return 1
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var event kv.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || event.Type == 0 {
+			fmt.Fprintf(os.Stderr, "watch ended: %s\n", scanner.Text())
+			return 1
+		}
+
+		fmt.Fprintf(stdout, "%d %s %s %s\n", event.Revision, event.Type, event.Kv.Key, event.Kv.Value)
+	}
+
+	fmt.Fprintf(os.Stderr, "watch ended\n")
+	return 1
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+)
+
+// kvCommand runs "go-cluster kv" against an admin endpoint, returning its exit code and
+// what it printed
+func kvCommand(admin string, args ...string) (int, string) {
+	var stdout bytes.Buffer
+	code := runKvCommand(append([]string{"-admin", admin}, args...), &stdout)
+
+	return code, stdout.String()
+}
+
+func TestKvCommand(t *testing.T) {
+	server, _ := newTestAdmin(t)
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := u.Host
+
+	code, out := kvCommand(admin, "put", "greeting", "hello")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "revision 1\n", out)
+
+	code, out = kvCommand(admin, "get", "greeting")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "hello\n", out)
+
+	code, _ = kvCommand(admin, "cas", "greeting", "0", "bonjour")
+	assert.Equal(t, 1, code)
+
+	code, out = kvCommand(admin, "cas", "greeting", "1", "bonjour")
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "revision 2\n", out)
+
+	code, _ = kvCommand(admin, "delete", "greeting")
+	assert.Equal(t, 0, code)
+
+	code, _ = kvCommand(admin, "delete", "greeting")
+	assert.Equal(t, 1, code)
+
+	code, _ = kvCommand(admin, "get", "greeting")
+	assert.Equal(t, 1, code)
+
+	code, _ = kvCommand(admin, "put", "greeting")
+	assert.Equal(t, 2, code)
+}
@@ -1,52 +1,149 @@
 package main
 
 import (
-	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"time"
 )
 
 type IdentityMap map[string]*Identity
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "kv" {
+		os.Exit(runKvCommand(os.Args[2:], os.Stdout))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		os.Exit(runInitCommand(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		os.Exit(runAgentCommand(os.Args[2:]))
+	}
+
 	id := flag.Int("id", 0, "the index into the certificates that corresponds to our identity")
-	privateKey := flag.String("key", "key0.pem", "the path to our private key")
+	privateKey := flag.String("key", "key0.pem", "the path to our private key, or agent:<socket> for a key held by an agent")
+	passphraseFile := flag.String("key-passphrase-file", "", "the file holding the passphrase for an encrypted key, if any")
+	passphraseEnv := flag.String("key-passphrase-env", "", "the environment variable holding the passphrase for an encrypted key, if any")
 	certsPath := flag.String("certs", "certs.conf", "the path to our membership definition")
+	ca := flag.String("ca", "", "the path to the certificates of the CAs that issue member certificates, if they are not self-signed")
+	configPath := flag.String("config", "", "the path to optional per-member settings")
+	stateDir := flag.String("state", "", "the directory in which to persist state across restarts, if any")
+	adminAddr := flag.String("admin", "", "the address on which to serve the admin endpoint, if any")
+	signed := flag.Bool("signed", false, "sign votes and heartbeats, and require all members to do the same")
+	byzantine := flag.Bool("bft", false, "tolerate byzantine members, which implies -signed")
+	quarantine := flag.Duration("quarantine", 0, "how long to refuse a member caught equivocating, if at all")
+	identity := flag.String("identity", "certificate", "how members are identified: by \"certificate\", public \"key\" or common \"name\"")
+	denylist := flag.String("denylist", "", "the path to a list of revoked member identities and certificate serials, if any")
+	crl := flag.String("crl", "", "the path to a CRL to check member certificates against, if any")
+	crlIssuer := flag.String("crl-issuer", "", "the path to the certificate of the CA that signs the CRL")
+	expiry := flag.String("expiry", "warn", "what to do with members presenting expired certificates: \"warn\", \"reject\" or \"ignore\"")
+	expiryWarn := flag.String("expiry-warn", "30,7,1", "the days before a member's certificate expires at which to warn")
+	handshakeTimeout := flag.Duration("handshake-timeout", DefaultHandshakeLimits().Timeout, "how long a peer may take to connect, handshake and negotiate")
+	maxPending := flag.Int("max-pending-handshakes", DefaultHandshakeLimits().MaxPending, "the most inbound handshakes in progress at once")
+	watch := flag.Duration("watch", 0, "how often to check the key, certificates and config for changes, if at all (SIGHUP always reloads)")
 
 	flag.Parse()
 	fmt.Printf("id: %d, privatekey: %s, config: %s\n", *id, *privateKey, *certsPath)
 
-	certs, err := ParseCertificates(*certsPath)
+	scheme, err := ParseIdentityScheme(*identity)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 
-	if *id >= len(certs) {
-		log.Fatalf("Invalid index")
+	expiryPolicy, err := ParseExpiryPolicy(*expiry)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	self := NewIdentity(certs[*id])
+	expiryThresholds, err := ParseExpiryThresholds(*expiryWarn)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	files := &memberFiles{
+		index:          *id,
+		keyPath:        *privateKey,
+		passphrase:     newPassphrase(*passphraseFile, *passphraseEnv),
+		passphraseFile: *passphraseFile,
+		certsPath:      *certsPath,
+		ca:             *ca,
+		configPath:     *configPath,
+		denylist:       *denylist,
+		crl:            *crl,
+		crlIssuer:      *crlIssuer,
+		scheme:         scheme,
+	}
+
+	self, tlsCert, members, err := files.load()
+	if err != nil {
+		panic(err)
+	}
 
-	members := IdentityMap{}
-	peers := IdentityMap{}
+	// Our peers would refuse us anyway
+	if err := checkValidity(self.Cert, time.Now()); err != nil && expiryPolicy == ExpiryReject {
+		log.Fatal(err)
+	}
 
-	for _, cert := range certs {
-		member := NewIdentity(cert)
-		members[member.Id] = member
-		peers[member.Id] = member
+	revocations, err := files.loadRevocations()
+	if err != nil {
+		panic(err)
 	}
 
-	delete(peers, self.Id) // peers are all members _except_ ourselves
+	tlsPolicy, err := files.loadTLSPolicy()
+	if err != nil {
+		panic(err)
+	}
 
-	var tlsCert *tls.Certificate
-	tlsCert, err = CreateTlsIdentity(self.Cert, *privateKey)
+	issuers, err := files.loadIssuers()
 	if err != nil {
 		panic(err)
 	}
 
-	connMgr := NewConnectionManager(self, tlsCert, peers)
-	controller := NewController(self.Id, members, connMgr)
+	node := NewNode(self, tlsCert, members)
+	node.SetTLSPolicy(tlsPolicy)
+	node.SetIssuers(issuers)
+
+	limits := DefaultHandshakeLimits()
+	limits.Timeout = *handshakeTimeout
+	limits.MaxPending = *maxPending
+	node.SetHandshakeLimits(limits)
+	if revocations != nil {
+		node.SetRevocations(revocations)
+	}
+	node.SetExpiryPolicy(expiryPolicy)
+	node.SetExpiryWarnings(expiryThresholds)
+	store := NewKV(node)
+
+	if *stateDir != "" {
+		if err := node.SetStateDir(*stateDir); err != nil {
+			panic(err)
+		}
+	}
+
+	if *signed {
+		if err := node.EnableSignatures(); err != nil {
+			panic(err)
+		}
+	}
+
+	if *byzantine {
+		if err := node.EnableByzantine(); err != nil {
+			panic(err)
+		}
+	}
+
+	node.SetQuarantine(*quarantine)
+
+	if *adminAddr != "" {
+		go func() {
+			log.Fatal(NewAdminServer(node, store).ListenAndServe(*adminAddr))
+		}()
+	}
+
+	go files.watch(node, *watch)
 
-	controller.Run()
+	node.Run()
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// MemberConfig holds the settings for a single member of the cluster
+type MemberConfig struct {
+	Observer    bool `json:"observer,omitempty"`
+	Priority    int  `json:"priority,omitempty"`
+	NeverLeader bool `json:"neverLeader,omitempty"`
+}
+
+// ClusterConfig holds optional settings that supplement the membership file.  Members are
+// keyed either by their identity hash or by the common name of their certificate.
+type ClusterConfig struct {
+	Members map[string]*MemberConfig `json:"members"`
+	TLS     *TLSConfig               `json:"tls,omitempty"`
+}
+
+func LoadConfig(path string) (*ClusterConfig, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file \"%s\": %s", path, err.Error())
+	}
+
+	config := &ClusterConfig{}
+	if err := json.Unmarshal(buf, config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file \"%s\": %s", path, err.Error())
+	}
+
+	return config, nil
+}
+
+// Member returns the settings for an identity, or the defaults if it has none
+func (self *ClusterConfig) Member(id *Identity) *MemberConfig {
+	if self != nil {
+		if member, ok := self.Members[id.Id]; ok {
+			return member
+		}
+		if member, ok := self.Members[id.Cert.Subject.CommonName]; ok {
+			return member
+		}
+	}
+
+	return &MemberConfig{}
+}
+
+// Apply updates the members of the cluster with their configured settings, and checks
+// that every configured member exists
+func (self *ClusterConfig) Apply(members IdentityMap) error {
+	if self == nil {
+		return nil
+	}
+
+	known := make(map[string]bool)
+	candidates := 0
+
+	for _, member := range members {
+		known[member.Id] = true
+		known[member.Cert.Subject.CommonName] = true
+
+		config := self.Member(member)
+		member.Observer = config.Observer
+		member.Priority = config.Priority
+		member.NeverLeader = config.NeverLeader
+
+		if !member.Observer && !member.NeverLeader {
+			candidates++
+		}
+	}
+
+	for key := range self.Members {
+		if !known[key] {
+			return fmt.Errorf("config refers to unknown member %s", key)
+		}
+	}
+
+	if candidates == 0 {
+		return fmt.Errorf("config leaves the cluster without any members that may lead")
+	}
+
+	return nil
+}
@@ -2,28 +2,50 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"sync"
 	"time"
 )
 
 type ConnectionManager struct {
-	id      *Identity
-	cert    *tls.Certificate
-	peers   IdentityMap
-	servers IdentityMap
-	clients IdentityMap
-	C       chan *Connection
+	id          *Identity
+	cert        *tls.Certificate
+	peers       IdentityMap
+	servers     IdentityMap
+	clients     IdentityMap
+	lock        sync.Mutex           // guards cert, the identities, the policies, quarantined and listener
+	quarantined map[string]time.Time // peers refused until the time given
+	revocations *Revocations
+	expiry      ExpiryPolicy
+	tls         *TLSPolicy
+	issuers     []*x509.Certificate
+	admission   *admission
+	failures    map[string]int // failed inbound handshakes by source address
+	listener    net.Listener
+	done        chan struct{} // closed once we stop connecting to peers
+	closeOnce   sync.Once
+	C           chan *Connection
+	R           chan *Revocations // the latest revocations, for closing open connections
 }
 
 func NewConnectionManager(_id *Identity, _cert *tls.Certificate, _peers IdentityMap) *ConnectionManager {
 	self := &ConnectionManager{
-		id:      _id,
-		cert:    _cert,
-		peers:   _peers,
-		servers: IdentityMap{},
-		clients: IdentityMap{},
-		C:       make(chan *Connection, 100),
+		id:          _id,
+		cert:        _cert,
+		peers:       _peers,
+		servers:     IdentityMap{},
+		clients:     IdentityMap{},
+		quarantined: make(map[string]time.Time),
+		tls:         DefaultTLSPolicy(),
+		admission:   newAdmission(DefaultHandshakeLimits()),
+		failures:    make(map[string]int),
+		done:        make(chan struct{}),
+		C:           make(chan *Connection, 100),
+		R:           make(chan *Revocations, 1),
 	}
 
 	fmt.Printf("Using %s - %s with peers:\n", self.id.Cert.Subject.CommonName, self.id.Id)
@@ -42,31 +64,23 @@ func NewConnectionManager(_id *Identity, _cert *tls.Certificate, _peers Identity
 
 	// First start our primary listener if we have at least one client of our server
 	if len(self.servers) > 0 {
+		laddr := self.id.Cert.Subject.CommonName
+
 		go func() {
-			listener, err := Listen(self.cert, self.id.Cert.Subject.CommonName)
+			listener, err := Listen(self.serverConfig, laddr)
 			if err != nil {
 				panic(err)
 			}
 
-			for {
-				var conn *Connection
-				var err error
-
-				conn, err = Accept(listener)
-				if err != nil {
-					log.Printf("Dropping connection: %s", err.Error())
-					continue
-				}
-
-				// Check to see if the connection is related to a peer we expect to be connecting
-				// to us as a client
-				if _, ok := self.servers[conn.Id.Id]; ok {
-					self.C <- conn
-				} else {
-					log.Printf("Dropping unknown peer %v", conn.Id)
-				}
+			self.lock.Lock()
+			self.listener = listener
+			self.lock.Unlock()
+
+			if self.closed() {
+				listener.Close()
 			}
 
+			self.serve(listener)
 		}()
 	}
 
@@ -79,8 +93,152 @@ func NewConnectionManager(_id *Identity, _cert *tls.Certificate, _peers Identity
 	return self
 }
 
+// serve accepts connections from the peers that are our clients.  Each handshake proceeds
+// on its own goroutine, so that a peer that stalls cannot hold up the others.
+func (self *ConnectionManager) serve(listener net.Listener) {
+	for {
+		raw, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Dropping connection: %s", err.Error())
+			time.Sleep(10 * time.Millisecond) // in case we have run out of descriptors
+			continue
+		}
+
+		if ok, reason := self.admission.admit(raw.RemoteAddr(), time.Now()); !ok {
+			log.Printf("Dropping connection from %s: %s", raw.RemoteAddr(), reason)
+			raw.Close()
+			continue
+		}
+
+		go self.accept(raw.(*tls.Conn))
+	}
+}
+
+// accept completes an admitted connection, releasing its place once the handshake is done
+// rather than once the connection is delivered, which may wait on the controller
+func (self *ConnectionManager) accept(tlsConn *tls.Conn) {
+	conn, err := Accept(tlsConn, self.policy())
+	self.admission.release()
+	if err != nil {
+		log.Printf("Dropping connection from %s: %s", tlsConn.RemoteAddr(), err.Error())
+		self.countFailure(tlsConn.RemoteAddr())
+		return
+	}
+
+	if self.quarantineRemaining(conn.Id.Id) > 0 {
+		log.Printf("Dropping quarantined peer %v", conn.Id.Id)
+		conn.Close()
+		return
+	}
+
+	// The handshake refused peers we don't expect, but the membership may have been reloaded
+	// since
+	if self.expectsClient(conn.Id) {
+		self.deliver(conn)
+	} else {
+		log.Printf("Dropping unknown peer %v", conn.Id)
+		self.countFailure(tlsConn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// expectsClient reports whether a peer is one we expect to connect to us as a client
+func (self *ConnectionManager) expectsClient(id *Identity) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	peer, ok := self.servers[id.Id]
+	return ok && peer.Authenticates(id.Cert)
+}
+
+// serverConfig is the TLS configuration for an inbound connection, which refuses any peer
+// that is not one of our clients during the handshake
+func (self *ConnectionManager) serverConfig() *tls.Config {
+	policy := self.policy()
+
+	config := newConfig(self.currentCert(), policy.tls)
+	config.VerifyConnection = verifyPeer(policy, self.expectsClient, config.VerifyConnection)
+
+	return config
+}
+
+func (self *ConnectionManager) countFailure(addr net.Addr) {
+	handshakeFailures.Add(1)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	source := sourceOf(addr)
+	if _, ok := self.failures[source]; ok || len(self.failures) < maxTrackedSources {
+		self.failures[source]++
+	}
+}
+
+// HandshakeFailures returns the number of failed inbound handshakes from each source
+// address, other than those refused by the handshake limits
+func (self *ConnectionManager) HandshakeFailures() map[string]int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	failures := make(map[string]int)
+	for source, count := range self.failures {
+		failures[source] = count
+	}
+
+	return failures
+}
+
+// deliver hands a new connection to the controller, unless we have been closed
+func (self *ConnectionManager) deliver(conn *Connection) {
+	select {
+	case self.C <- conn:
+	case <-self.done:
+		conn.Close()
+	}
+}
+
+func (self *ConnectionManager) closed() bool {
+	select {
+	case <-self.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops accepting and dialing connections.  Those already handed over are left
+// to their owners.
+func (self *ConnectionManager) Close() {
+	self.closeOnce.Do(func() {
+		close(self.done)
+
+		self.lock.Lock()
+		defer self.lock.Unlock()
+
+		if self.listener != nil {
+			self.listener.Close()
+		}
+	})
+}
+
+// sleep pauses a dialer, returning false if we are closed in the meantime
+func (self *ConnectionManager) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-self.done:
+		return false
+	}
+}
+
 func (self *ConnectionManager) Dial(peerId string) {
-	peer, ok := self.clients[peerId]
+	self.lock.Lock()
+	_, ok := self.clients[peerId]
+	self.lock.Unlock()
+
 	if ok == false {
 		// We only redial peers in the "client" category
 		return
@@ -91,14 +249,162 @@ func (self *ConnectionManager) Dial(peerId string) {
 		var conn *Connection
 
 		for {
+			if self.closed() {
+				return
+			}
+
+			if remaining := self.quarantineRemaining(peerId); remaining > 0 {
+				self.sleep(remaining)
+				continue
+			}
+
+			// Pick up any certificates reloaded since our last attempt
+			self.lock.Lock()
+			cert, peer := self.cert, self.clients[peerId]
+			self.lock.Unlock()
+
 			var err error
-			conn, err = Dial(self.cert, peer)
+			conn, err = Dial(cert, peer, self.policy())
 			if err == nil {
 				break
 			}
-			time.Sleep(time.Duration(1) * time.Second)
+			self.sleep(time.Duration(1) * time.Second)
 		}
 
-		self.C <- conn
+		self.deliver(conn)
 	}()
 }
+
+func (self *ConnectionManager) currentCert() *tls.Certificate {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.cert
+}
+
+// reload replaces our certificate and those of our peers for any connections made from now
+// on.  Established connections are unaffected.
+func (self *ConnectionManager) reload(cert *tls.Certificate, members IdentityMap) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.cert = cert
+
+	if member, ok := members[self.id.Id]; ok {
+		self.id = member
+	}
+
+	for _, peers := range []IdentityMap{self.peers, self.servers, self.clients} {
+		for id := range peers {
+			if member, ok := members[id]; ok {
+				peers[id] = member
+			}
+		}
+	}
+}
+
+func (self *ConnectionManager) policy() *connectionPolicy {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return &connectionPolicy{
+		scheme:           self.id.Scheme,
+		revocations:      self.revocations,
+		expiry:           self.expiry,
+		tls:              self.tls,
+		issuers:          self.issuers,
+		quarantined:      func(id string) bool { return self.quarantineRemaining(id) > 0 },
+		handshakeTimeout: self.admission.timeout(),
+	}
+}
+
+// SetHandshakeLimits applies to the connections accepted from now on
+func (self *ConnectionManager) SetHandshakeLimits(limits HandshakeLimits) {
+	self.admission.setLimits(limits)
+}
+
+// SetTLSPolicy restricts the TLS connections made from now on
+func (self *ConnectionManager) SetTLSPolicy(policy *TLSPolicy) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.tls = policy
+}
+
+// SetExpiryPolicy determines how connections with peers presenting certificates outside
+// their validity period are treated from now on
+func (self *ConnectionManager) SetExpiryPolicy(expiry ExpiryPolicy) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.expiry = expiry
+}
+
+// SetIssuers determines the CAs trusted to issue the certificates of the peers that
+// connect from now on
+func (self *ConnectionManager) SetIssuers(issuers []*x509.Certificate) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.issuers = issuers
+}
+
+// members returns the current identities of every member, including ourselves
+func (self *ConnectionManager) members() IdentityMap {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	members := IdentityMap{self.id.Id: self.id}
+	for id, peer := range self.peers {
+		members[id] = peer
+	}
+
+	return members
+}
+
+// SetRevocations refuses connections with revoked peers from now on, and passes the
+// revocations on through R so that any open connections with them can be closed
+func (self *ConnectionManager) SetRevocations(revocations *Revocations) {
+	self.lock.Lock()
+	self.revocations = revocations
+	self.lock.Unlock()
+
+	// Only the latest revocations matter
+	for {
+		select {
+		case self.R <- revocations:
+			return
+		default:
+		}
+		select {
+		case <-self.R:
+		default:
+		}
+	}
+}
+
+// Quarantine refuses connections with a peer until the cooldown expires
+func (self *ConnectionManager) Quarantine(peerId string, cooldown time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.quarantined[peerId] = time.Now().Add(cooldown)
+}
+
+func (self *ConnectionManager) quarantineRemaining(peerId string) time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	until, ok := self.quarantined[peerId]
+	if !ok {
+		return 0
+	}
+
+	remaining := time.Until(until)
+	if remaining <= 0 {
+		delete(self.quarantined, peerId)
+		return 0
+	}
+
+	return remaining
+}
@@ -2,53 +2,62 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/ghaskins/go-cluster/pb"
 	"github.com/golang/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"log"
 	"net"
-	"strings"
+	"time"
 )
 
 type Connection struct {
-	Conn *tls.Conn
-	Id   *Identity
+	Conn     *tls.Conn
+	Id       *Identity
+	TLS      *TLSParameters // as negotiated
+	protocol *agreement     // nil until the wire protocol is negotiated
 }
 
-func (c *Connection) Send(m proto.Message) error {
-	msg, err := proto.Marshal(m)
-	if err != nil {
-		return err
+// Send transmits one or more messages as a single write so that a sequence of
+// messages (such as a header and its payload) is never interleaved on the wire
+func (c *Connection) Send(msgs ...proto.Message) error {
+	var buf []byte
+
+	for _, m := range msgs {
+		msg, err := proto.Marshal(m)
+		if err != nil {
+			return err
+		}
+
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(msg)))
+		buf = append(buf, header...)
+		buf = append(buf, msg...)
 	}
 
-	header := make([]byte, 4)
-	binary.BigEndian.PutUint32(header, uint32(len(msg)))
-	c.Conn.Write(header)
-	c.Conn.Write(msg)
+	_, err := c.Conn.Write(buf)
 
-	return nil
+	return err
 }
 
 func (c *Connection) Recv(m proto.Message) error {
 	header := make([]byte, 4)
-	hLen, err := c.Conn.Read(header)
-	if err != nil || hLen != 4 {
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
 		return err
 	}
 
 	len := binary.BigEndian.Uint32(header)
 	// FIXME: guard against an upper MTU violation
 	payload := make([]byte, len)
-	pLen, err := c.Conn.Read(payload)
-	if err != nil {
+	if _, err := io.ReadFull(c.Conn, payload); err != nil {
 		return err
 	}
-	if pLen != int(len) {
-		return errors.New(fmt.Sprintf("Read error: expected %d bytes, got %d", len, pLen))
-	}
 
-	err = proto.Unmarshal(payload, m)
+	err := proto.Unmarshal(payload, m)
 	if err != nil {
 		return err
 	}
@@ -56,7 +65,85 @@ func (c *Connection) Recv(m proto.Message) error {
 	return nil
 }
 
-func verifyCrypto(conn *tls.Conn) (*Connection, error) {
+// skip discards the next message
+func (c *Connection) skip() error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return err
+	}
+
+	_, err := io.CopyN(ioutil.Discard, c.Conn, int64(binary.BigEndian.Uint32(header)))
+	return err
+}
+
+func (c *Connection) Close() error {
+	return c.Conn.Close()
+}
+
+// Supports reports whether the peer supports a feature of the wire protocol.  Before
+// negotiation, every feature is assumed.
+func (c *Connection) Supports(feature string) bool {
+	return feature == "" || c.protocol == nil || c.protocol.features[feature]
+}
+
+// Version returns the wire protocol version negotiated with the peer
+func (c *Connection) Version() int32 {
+	if c.protocol == nil {
+		return 0
+	}
+
+	return c.protocol.version
+}
+
+// connectionPolicy holds the rules that a peer's certificate must satisfy to connect
+type connectionPolicy struct {
+	scheme      IdentityScheme
+	revocations *Revocations
+	expiry      ExpiryPolicy
+	tls         *TLSPolicy          // the default policy if nil
+	issuers     []*x509.Certificate // the CAs trusted to issue members' certificates
+	quarantined func(string) bool   // whether a member is quarantined, if any may be
+
+	handshakeTimeout time.Duration // to connect, handshake and negotiate, if limited
+}
+
+// verifyPeer returns a VerifyConnection callback that refuses any peer that is not a member
+// we expect, or that is revoked or quarantined, and then applies next.  Unlike
+// VerifyPeerCertificate it runs on every handshake, including those resuming a session, so
+// nothing is exchanged with a peer that fails it.
+func verifyPeer(policy *connectionPolicy, expected func(*Identity) bool, next func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) != 1 {
+			return fmt.Errorf("Illegal number of certificates presented by peer (%d)", len(state.PeerCertificates))
+		}
+
+		cert := state.PeerCertificates[0]
+		if err := checkSignature(cert, policy.issuers); err != nil {
+			return err
+		}
+
+		id := NewIdentityWithScheme(cert, policy.scheme)
+		if !expected(id) {
+			return fmt.Errorf("%s (%s) is not an expected member", cert.Subject.CommonName, id.Id)
+		}
+
+		if policy.revocations.Revoked(id) {
+			return fmt.Errorf("%s has been revoked", id.Id)
+		}
+
+		if policy.quarantined != nil && policy.quarantined(id.Id) {
+			return fmt.Errorf("%s is quarantined", id.Id)
+		}
+
+		if next != nil {
+			return next(state)
+		}
+
+		return nil
+	}
+}
+
+func verifyCrypto(conn *tls.Conn, policy *connectionPolicy) (*Connection, error) {
 
 	if err := conn.Handshake(); err != nil {
 		return nil, err
@@ -69,18 +156,52 @@ func verifyCrypto(conn *tls.Conn) (*Connection, error) {
 
 	cert := certs[0]
 
-	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+	if err := checkSignature(cert, policy.issuers); err != nil {
 		return nil, err
 	}
 
-	return &Connection{Conn: conn, Id: NewIdentity(cert)}, nil
+	id := NewIdentityWithScheme(cert, policy.scheme)
+	if policy.revocations.Revoked(id) {
+		conn.Close()
+		return nil, fmt.Errorf("%s has been revoked", id.Id)
+	}
+
+	if policy.expiry != ExpiryIgnore {
+		if err := checkValidity(cert, time.Now()); err != nil {
+			if policy.expiry == ExpiryReject {
+				conn.Close()
+				return nil, err
+			}
+			log.Printf("Accepting %s: %s", id.Id, err.Error())
+		}
+	}
+
+	params := newTLSParameters(conn.ConnectionState())
+	log.Printf("Connected to %s using %s", id.Id, params)
+
+	return &Connection{Conn: conn, Id: id, TLS: params}, nil
 }
 
-func newConfig(self *tls.Certificate) *tls.Config {
+// newConfig returns the TLS configuration for our end of a connection.  Peers are
+// authenticated against the membership rather than by any CA, so the usual chain
+// verification is skipped.
+func newConfig(self *tls.Certificate, policy *TLSPolicy) *tls.Config {
+	if policy == nil {
+		policy = DefaultTLSPolicy()
+	}
+
 	config := &tls.Config{
-		Certificates:       make([]tls.Certificate, 1),
-		InsecureSkipVerify: true,
-		ClientAuth:         tls.RequireAnyClientCert,
+		Certificates:           make([]tls.Certificate, 1),
+		InsecureSkipVerify:     true,
+		ClientAuth:             tls.RequireAnyClientCert,
+		MinVersion:             policy.MinVersion,
+		CurvePreferences:       policy.Curves,
+		SessionTicketsDisabled: !policy.SessionTickets,
+		VerifyConnection:       policy.verifyConnection,
+	}
+
+	for suite := range policy.CipherSuites {
+		config.CipherSuites = append(config.CipherSuites, suite)
 	}
 
 	config.Certificates[0] = *self
@@ -88,85 +209,107 @@ func newConfig(self *tls.Certificate) *tls.Config {
 	return config
 }
 
-func newNegotiate() *pb.Negotiate {
-	return &pb.Negotiate{
-		Magic:   proto.String("cluster"),
-		Version: proto.Int(1),
+// offerProtocol negotiates the wire protocol from the dialing end: we offer the versions
+// and features we support, and the server replies with those we are to use
+func (c *Connection) offerProtocol(ours *protocol) error {
+	theirs := &pb.Negotiate{}
+
+	if err := c.Send(ours.offer()); err != nil {
+		return err
+	}
+	if err := c.Recv(theirs); err != nil {
+		return err
 	}
+
+	var err error
+	c.protocol, err = ours.negotiate(theirs)
+	return err
 }
 
-func verifyProtocol(ours, theirs *pb.Negotiate) error {
-	if strings.Compare(*ours.Magic, *theirs.Magic) != 0 || *ours.Version != *theirs.Version {
-		return errors.New(fmt.Sprintf("incompatible wire protocol (ours: %v, theirs: %v)", ours, theirs))
+// acceptProtocol negotiates the wire protocol from the accepting end: we wait for the
+// client's offer, and reply with what we agree to
+func (c *Connection) acceptProtocol(ours *protocol) error {
+	theirs := &pb.Negotiate{}
+
+	if err := c.Recv(theirs); err != nil {
+		return err
+	}
+
+	var err error
+	if c.protocol, err = ours.negotiate(theirs); err != nil {
+		return err
 	}
 
-	return nil
+	return c.Send(c.protocol.reply())
 }
 
-func Dial(self *tls.Certificate, peer *Identity) (conn *Connection, err error) {
+func Dial(self *tls.Certificate, peer *Identity, policy *connectionPolicy) (conn *Connection, err error) {
 
-	tlsConn, err := tls.Dial("tcp", peer.Cert.Subject.CommonName, newConfig(self))
+	config := newConfig(self, policy.tls)
+	config.VerifyConnection = verifyPeer(policy, func(id *Identity) bool {
+		return id.Id == peer.Id && peer.Authenticates(id.Cert)
+	}, config.VerifyConnection)
+
+	dialer := &net.Dialer{Timeout: policy.handshakeTimeout}
+	tlsConn, err := tls.DialWithDialer(dialer, "tcp", peer.Cert.Subject.CommonName, config)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err = verifyCrypto(tlsConn)
+	if policy.handshakeTimeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(policy.handshakeTimeout))
+	}
+
+	conn, err = verifyCrypto(tlsConn, policy)
 	if err != nil {
+		tlsConn.Close()
 		return nil, err
 	}
 
-	if conn.Id.Id != peer.Id {
+	if conn.Id.Id != peer.Id || !peer.Authenticates(conn.Id.Cert) {
+		conn.Close()
 		return nil, errors.New("Unexpected peer identity")
 	}
 
-	// Negotiation protocol: send a Negotiate packet to the server, and wait for
-	// a response.  Then ensure baseline compatibility
-	ours := newNegotiate()
-	theirs := &pb.Negotiate{}
-
-	conn.Send(ours)
-	err = conn.Recv(theirs)
-	if err != nil {
+	if err = conn.offerProtocol(localProtocol); err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	if err = verifyProtocol(ours, theirs); err != nil {
-		return nil, err
-	}
+	tlsConn.SetDeadline(time.Time{})
 
 	return conn, nil
 }
 
-func Listen(self *tls.Certificate, laddr string) (net.Listener, error) {
-	return tls.Listen("tcp", laddr, newConfig(self))
+// Listen accepts connections, handshaking each with whichever configuration is current at
+// the time, so that the certificates and policies may change
+func Listen(config func() *tls.Config, laddr string) (net.Listener, error) {
+	return tls.Listen("tcp", laddr, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return config(), nil
+		},
+	})
 }
 
-func Accept(listener net.Listener) (*Connection, error) {
+// Accept completes an inbound connection: the TLS handshake, and then negotiation
+func Accept(tlsConn *tls.Conn, policy *connectionPolicy) (*Connection, error) {
 
-	tlsConn, err := listener.Accept()
-	if err != nil {
-		return nil, err
-	}
-
-	conn, err := verifyCrypto(tlsConn.(*tls.Conn))
-	if err != nil {
-		return nil, err
+	if policy.handshakeTimeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(policy.handshakeTimeout))
 	}
 
-	// Negotiation protocol: wait for a negotiate message, compare, and reply
-	ours := newNegotiate()
-	theirs := &pb.Negotiate{}
-
-	err = conn.Recv(theirs)
+	conn, err := verifyCrypto(tlsConn, policy)
 	if err != nil {
+		tlsConn.Close()
 		return nil, err
 	}
 
-	if err = verifyProtocol(ours, theirs); err != nil {
+	if err = conn.acceptProtocol(localProtocol); err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	conn.Send(ours)
+	tlsConn.SetDeadline(time.Time{})
 
 	return conn, nil
 }
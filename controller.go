@@ -8,48 +8,133 @@ import (
 	"github.com/ghaskins/go-cluster/util"
 	"github.com/golang/protobuf/proto"
 	"github.com/looplab/fsm"
+	"math"
 	"math/big"
+	"sort"
+	"sync"
 	"time"
 )
 
+// How long a member with a higher priority must be connected before the leader hands
+// off to it
+const handoffDelay = 3 * time.Second
+
 type Controller struct {
 	state           *fsm.FSM
 	peers           IdentityMap
 	connMgr         *ConnectionManager
+	router          *Router
 	myId            string
+	observer        bool
+	peerLock        sync.RWMutex // guards activePeers for readers outside of Run()
 	activePeers     map[string]*Peer
+	connectedAt     map[string]time.Time
+	abdicated       bool
 	quorumThreshold int
 	timer           *time.Timer
 	pulse           *time.Ticker
 	electionManager *election.Manager
 	minTmo          int64
 	maxTmo          int64
+	leaderLock      sync.Mutex // guards leadership for readers outside of Run()
+	leadership      Leadership
+	leaderChanged   chan struct{}
+	heartbeatSeq    uint64
+	heartbeatsSeen  map[string]heartbeatMark // the latest signed heartbeat from each leader
+	barriers        chan *barrier
+	pendingBarriers []*barrier
+	replicator      *Replicator
+	appends         chan *appendRequest
+	views           *viewStore
+	savedView       int64
+	signer          *signer // signs and verifies votes and heartbeats, if enabled
+	signedVotes     map[string]*pb.Vote
+	certificate     *pb.QuorumCertificate // proves our election while leading
+	announced       bool                  // whether the certificate has been broadcast
+	pendingCert     *pb.QuorumCertificate // received before we had a quorum
+	firstVotes      map[voteKey]*pb.Vote  // the first signed vote by each member in each view
+	equivocators    map[voteKey]bool
+	onEquivocate    EquivocationHandler
+	quarantine      time.Duration // how long to refuse an equivocating member, if at all
+	reloads         chan *reloadRequest
+	done            <-chan struct{} // closed to stop Run
+}
+
+// Leadership is a point-in-time view of who this node believes is leading the cluster
+type Leadership struct {
+	Leader  string          // empty while no leader is established
+	View    int64           // the election view the leader was elected in
+	Quorum  bool            // whether enough members are connected to hold an election
+	Changed <-chan struct{} // closed as soon as this snapshot is out of date
 }
 
-func NewController(_id string, _peers IdentityMap, _connMgr *ConnectionManager) *Controller {
+func NewController(_id string, _peers IdentityMap, _connMgr *ConnectionManager, _router *Router) *Controller {
 
 	var members []string
+	var voters []string
 
 	for _, peer := range _peers {
 		members = append(members, peer.Id)
+		if !peer.Observer {
+			voters = append(voters, peer.Id)
+		}
+	}
+
+	observer := _peers[_id] != nil && _peers[_id].Observer
+
+	// Quorum is counted among voters only, and we don't include ourselves
+	quorumThreshold := util.ComputeQuorumThreshold(len(voters))
+	if !observer {
+		quorumThreshold--
 	}
 
 	self := &Controller{
 		peers:           _peers,
 		connMgr:         _connMgr,
+		router:          _router,
 		myId:            _id,
+		observer:        observer,
 		activePeers:     make(map[string]*Peer),
-		quorumThreshold: util.ComputeQuorumThreshold(len(_peers)) - 1, // We don't include ourselves
-		timer:           time.NewTimer(0),
-		pulse:           time.NewTicker(1),
-		electionManager: election.NewManager(_id, members),
+		connectedAt:     make(map[string]time.Time),
+		quorumThreshold: quorumThreshold,
+		timer:           time.NewTimer(time.Hour),
+		pulse:           time.NewTicker(time.Hour),
+		electionManager: election.NewManager(_id, voters),
 		minTmo:          500,
 		maxTmo:          1000,
+		leaderChanged:   make(chan struct{}),
+		barriers:        make(chan *barrier, 100),
+		appends:         make(chan *appendRequest, 100),
+		signedVotes:     make(map[string]*pb.Vote),
+		heartbeatsSeen:  make(map[string]heartbeatMark),
+		firstVotes:      make(map[voteKey]*pb.Vote),
+		equivocators:    make(map[voteKey]bool),
+		reloads:         make(chan *reloadRequest),
 	}
 
-	<-self.timer.C // drain the initial event
+	for _, peer := range _peers {
+		self.electionManager.SetPriority(peer.Id, peer.Priority)
+		self.electionManager.SetEligible(peer.Id, !peer.NeverLeader && !peer.Observer)
+	}
+
+	var others []string
+	observers := make(map[string]bool)
+	for _, member := range members {
+		if member != _id {
+			others = append(others, member)
+		}
+		if !self.isVoter(member) {
+			observers[member] = true
+		}
+	}
+	self.replicator = NewReplicator(_id, others, observers, self.quorumThreshold, self.sendTo)
+
+	self.leadership.Changed = self.leaderChanged
+
+	// Both start out disarmed.  Stopping them before they can fire guarantees that no
+	// stale event is left pending on their channels
+	self.timer.Stop()
 	self.pulse.Stop()
-	<-self.pulse.C // drain the initial event
 
 	self.state = fsm.NewFSM(
 		"convening",
@@ -63,6 +148,7 @@ func NewController(_id string, _peers IdentityMap, _connMgr *ConnectionManager)
 			{Name: "heartbeat", Src: []string{"following"}, Dst: "following"},
 		},
 		fsm.Callbacks{
+			"enter_state":        func(e *fsm.Event) { self.publishLeadership() },
 			"convening":          func(e *fsm.Event) { self.onConvening() },
 			"enter_initializing": func(e *fsm.Event) { self.onInitializing() },
 			"leave_initializing": func(e *fsm.Event) { self.timer.Stop() },
@@ -72,7 +158,7 @@ func NewController(_id string, _peers IdentityMap, _connMgr *ConnectionManager)
 			"leave_electing":     func(e *fsm.Event) { self.timer.Stop() },
 			"enter_leading":      func(e *fsm.Event) { self.onEnterLeading() },
 			"leave_leading":      func(e *fsm.Event) { self.onLeaveLeading() },
-			"heartbeat":          func(e *fsm.Event) { self.onHeartBeat(e.Args[0].(string), e.Args[1].(int64)) },
+			"heartbeat":          func(e *fsm.Event) { self.onHeartBeat(e.Args[0].(string), e.Args[1].(int64), e.Args[2].(uint64)) },
 			"before_timeout":     func(e *fsm.Event) { self.onTimeout() },
 		},
 	)
@@ -95,43 +181,49 @@ func (self *Controller) Run() {
 		case conn := <-self.connMgr.C:
 			fmt.Printf("new connection from %s\n", conn.Id.Id)
 
-			if _, ok := self.activePeers[conn.Id.Id]; ok {
-				fmt.Printf("client is already connected")
-				continue
+			if existing, ok := self.activePeers[conn.Id.Id]; ok {
+				if !existing.closed() {
+					fmt.Printf("client is already connected\n")
+					conn.Close()
+					continue
+				}
+
+				// The previous connection has died but we haven't processed its disconnect
+				// yet.  Retire it now so the new connection can take its place
+				self.removePeer(existing)
 			}
 
-			peer := &Peer{conn: conn, rxChannel: &messageEvents, disconnectChannel: &disconnectionEvents}
+			peer := NewPeer(conn, self.router, &messageEvents, &disconnectionEvents)
+			self.peerLock.Lock()
 			self.activePeers[conn.Id.Id] = peer
+			self.peerLock.Unlock()
+			self.connectedAt[conn.Id.Id] = time.Now()
 			peer.Run()
 
 			self.state.Event("connection", conn.Id.Id)
 
-			if len(self.activePeers) >= self.quorumThreshold {
+			if !self.canConfirmBarriers() {
+				self.failBarriers(ErrNoBarrierQuorum)
+			}
+
+			if self.connectedVoters() >= self.quorumThreshold {
 				self.state.Event("quorum")
 			}
 
 			// Update the peer with an unsolicited vote if we already have an opinion on who is leader
-			switch self.state.Current() {
-			case "leading":
-				fallthrough
-			case "following":
+			switch {
+			case self.signer != nil:
+				self.announceSigned(peer)
+			case self.state.Current() == "leading" || self.state.Current() == "following":
 				leader, err := self.electionManager.Current()
 				viewId := self.electionManager.View()
 				if err == nil {
-					msg := &pb.Vote{
-						ViewId: &viewId,
-						PeerId: &leader,
-					}
-					peer.Send(msg)
+					peer.Send(self.newVote(leader, viewId))
 				}
 			default:
 				contender, viewId, err := self.electionManager.GetContender()
 				if err == nil {
-					msg := &pb.Vote{
-						ViewId: &viewId,
-						PeerId: &contender,
-					}
-					peer.Send(msg)
+					peer.Send(self.newVote(contender, viewId))
 				}
 			}
 
@@ -142,10 +234,29 @@ func (self *Controller) Run() {
 			switch _msg.Payload.(type) {
 			case *pb.Heartbeat:
 				msg := _msg.Payload.(*pb.Heartbeat)
-				self.state.Event("heartbeat", _msg.From.Id(), msg.GetViewId())
+				if from, ok := self.heartbeatOrigin(_msg.From.Id(), msg); ok {
+					if qc := msg.GetCertificate(); qc != nil {
+						self.onCertificate(from, qc)
+					}
+					self.state.Event("heartbeat", from, msg.GetViewId(), msg.GetSeq())
+				}
+			case *pb.HeartbeatAck:
+				msg := _msg.Payload.(*pb.HeartbeatAck)
+				self.onHeartbeatAck(_msg.From.Id(), msg.GetViewId(), msg.GetSeq())
 			case *pb.Vote:
 				msg := _msg.Payload.(*pb.Vote)
-				self.onVote(_msg.From.Id(), msg.GetPeerId(), msg.GetViewId())
+				if from, ok := self.voteOrigin(_msg.From.Id(), msg); ok {
+					if self.signer != nil {
+						if evidence := self.checkEquivocation(from, msg); evidence != nil {
+							self.onEquivocation(evidence)
+							continue
+						}
+						self.recordVote(from, msg)
+					}
+					self.onVote(from, msg.GetPeerId(), msg.GetViewId())
+				}
+			default:
+				self.replicator.handle(_msg.From.Id(), _msg.Payload)
 			}
 
 		//---------------------------------------------------------
@@ -160,6 +271,9 @@ func (self *Controller) Run() {
 					panic(err)
 				}
 
+				self.saveView(self.electionManager.View())
+				self.pruneVotes(self.electionManager.View())
+
 				if leader == self.myId {
 					self.state.Event("elected-self")
 				} else {
@@ -181,25 +295,192 @@ func (self *Controller) Run() {
 		//---------------------------------------------------------
 		case _ = <-self.pulse.C:
 			if self.state.Current() == "leading" {
-				viewId := self.electionManager.View()
-				self.broadcast(&pb.Heartbeat{ViewId: &viewId})
+				self.sendHeartbeat()
+				self.pruneBarriers()
+				self.replicator.tick()
+				self.checkHandoff()
 			}
 
+		//---------------------------------------------------------
+		// linearizable barriers
+		//---------------------------------------------------------
+		case b := <-self.barriers:
+			self.onBarrier(b)
+
+		//---------------------------------------------------------
+		// replicated log
+		//---------------------------------------------------------
+		case req := <-self.appends:
+			req.result <- self.replicator.propose(req.command)
+
+		case snapshot := <-self.replicator.applier.snapshots:
+			self.replicator.onSnapshotTaken(snapshot)
+
+		case index := <-self.replicator.applier.failures:
+			self.replicator.onRestoreFailed(index)
+
+		//---------------------------------------------------------
+		// certificate rotation
+		//---------------------------------------------------------
+		case req := <-self.reloads:
+			req.result <- self.reload(req.key, req.members)
+
+		case revocations := <-self.connMgr.R:
+			self.onRevocations(revocations)
+
 		//---------------------------------------------------------
 		// disconnects
 		//---------------------------------------------------------
-		case peerId := <-disconnectionEvents:
-			fmt.Printf("lost connection from %s\n", peerId)
-			if len(self.activePeers) <= self.quorumThreshold {
-				self.state.Event("quorum-lost")
+		case <-self.done:
+			self.shutdown()
+			return
+
+		case peer := <-disconnectionEvents:
+			if self.activePeers[peer.Id()] != peer {
+				// This peer was already replaced by a newer connection
+				continue
 			}
-			delete(self.activePeers, peerId)
-			self.electionManager.Invalidate(peerId)
-			self.connMgr.Dial(peerId)
+
+			fmt.Printf("lost connection from %s\n", peer.Id())
+			self.removePeer(peer)
+			self.replicator.peerLost(peer.Id())
+			self.connMgr.Dial(peer.Id())
 		}
 	}
 }
 
+// enableByzantine tolerates as many byzantine voters as the membership allows, which must be
+// at least one.  Quorums grow from a majority to 2f+1 of 3f+1 voters, and every voter may
+// vote only once per view.  Votes must be signed for equivocation to be attributable.
+func (self *Controller) enableByzantine() error {
+	if self.signer == nil {
+		return fmt.Errorf("byzantine fault tolerance requires signatures")
+	}
+
+	var voters int
+	for _, peer := range self.peers {
+		if !peer.Observer {
+			voters++
+		}
+	}
+
+	faults := util.MaxByzantineFaults(voters)
+	if faults < 1 {
+		return fmt.Errorf("byzantine fault tolerance requires at least 4 voters, not %d", voters)
+	}
+
+	if voters != 3*faults+1 {
+		fmt.Printf("%d voters tolerate no more byzantine faults than %d\n", voters, 3*faults+1)
+	}
+
+	// As before, we don't include ourselves
+	quorumThreshold := util.ComputeFaultTolerantQuorum(voters, faults)
+	if !self.observer {
+		quorumThreshold--
+	}
+
+	self.quorumThreshold = quorumThreshold
+	self.replicator.quorumThreshold = quorumThreshold
+	self.electionManager.SetByzantine(faults)
+
+	return nil
+}
+
+func (self *Controller) isVoter(peerId string) bool {
+	peer, ok := self.peers[peerId]
+	return ok && !peer.Observer
+}
+
+func (self *Controller) connectedVoters() int {
+	count := 0
+	for peerId := range self.activePeers {
+		if self.isVoter(peerId) {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (self *Controller) removePeer(peer *Peer) {
+	peerId := peer.Id()
+
+	self.peerLock.Lock()
+	delete(self.activePeers, peerId)
+	self.peerLock.Unlock()
+	delete(self.connectedAt, peerId)
+
+	if self.connectedVoters() < self.quorumThreshold {
+		self.state.Event("quorum-lost")
+	}
+	self.electionManager.Invalidate(peerId)
+}
+
+func (self *Controller) publishLeadership() {
+	var leader string
+
+	switch self.state.Current() {
+	case "leading":
+		leader = self.myId
+	case "following":
+		leader, _ = self.electionManager.Current()
+	}
+
+	view := self.electionManager.View()
+	quorum := self.state.Current() != "convening"
+
+	self.leaderLock.Lock()
+	defer self.leaderLock.Unlock()
+
+	if leader == self.leadership.Leader && view == self.leadership.View && quorum == self.leadership.Quorum {
+		return
+	}
+
+	close(self.leaderChanged)
+	self.leaderChanged = make(chan struct{})
+	self.leadership = Leadership{Leader: leader, View: view, Quorum: quorum, Changed: self.leaderChanged}
+}
+
+// Leader may be called from any goroutine
+func (self *Controller) Leader() Leadership {
+	self.leaderLock.Lock()
+	defer self.leaderLock.Unlock()
+
+	return self.leadership
+}
+
+// getPeer may be called from any goroutine
+func (self *Controller) getPeer(peerId string) (*Peer, bool) {
+	self.peerLock.RLock()
+	defer self.peerLock.RUnlock()
+
+	peer, ok := self.activePeers[peerId]
+	return peer, ok
+}
+
+// getPeers may be called from any goroutine
+func (self *Controller) getPeers() []*Peer {
+	self.peerLock.RLock()
+	defer self.peerLock.RUnlock()
+
+	peers := make([]*Peer, 0, len(self.activePeers))
+	for _, peer := range self.activePeers {
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
+
+// sendTo delivers a message without blocking, returning false if it could not be queued
+func (self *Controller) sendTo(peerId string, msg proto.Message) bool {
+	peer, ok := self.activePeers[peerId]
+	if !ok {
+		return false
+	}
+
+	return peer.trySend(msg)
+}
+
 func (self *Controller) rearmTimeout() {
 	offset, err := rand.Int(rand.Reader, big.NewInt(self.maxTmo-self.minTmo))
 	if err != nil {
@@ -219,27 +500,228 @@ func printSeparator() {
 }
 
 func (self *Controller) castBallot(peerId string, viewId int64) {
+	if self.observer {
+		// Observers learn the outcome of elections but never take part
+		return
+	}
+
 	fmt.Printf("broadcasting vote for %s in view %d\n", peerId, viewId)
+	self.saveView(viewId)
 	err := self.electionManager.ProcessVote(self.myId, peerId, viewId)
+	if _, ok := err.(*election.EquivocationError); ok {
+		// We have already voted in this view, and may not change our mind
+		fmt.Printf("not voting for %s: %s\n", peerId, err.Error())
+		return
+	}
 	if err != nil {
 		panic(err)
 	}
 
+	msg := self.newVote(peerId, viewId)
+	if self.signer != nil {
+		self.recordVote(self.myId, msg)
+	}
+	self.broadcast(msg)
+}
+
+// newVote returns our vote for a candidate, signed if signatures are enabled
+func (self *Controller) newVote(peerId string, viewId int64) *pb.Vote {
 	msg := &pb.Vote{
 		ViewId: &viewId,
 		PeerId: &peerId,
 	}
-	self.broadcast(msg)
+
+	if self.signer != nil {
+		if err := self.signer.signVote(msg); err != nil {
+			panic(err)
+		}
+	}
+
+	return msg
+}
+
+// enableSignatures signs our votes and heartbeats and requires others to sign theirs.  A
+// member's signed votes are binding, so it may then vote only once in each view, and a
+// stalled election moves on to the next view rather than changing our vote.
+func (self *Controller) enableSignatures(signer *signer) {
+	self.signer = signer
+	self.electionManager.SetStrict(true)
+}
+
+// voteOrigin returns the member that cast a vote.  Without signatures that can only be the
+// member that sent it to us.  With them, any member may relay a vote on behalf of another,
+// and unsigned votes are refused.
+func (self *Controller) voteOrigin(from string, msg *pb.Vote) (string, bool) {
+	if self.signer == nil {
+		return from, true
+	}
+
+	voter, err := self.signer.verifyVote(msg)
+	if err != nil {
+		fmt.Printf("Dropping vote from %s: %s\n", from, err.Error())
+		return "", false
+	}
+
+	return voter, true
+}
+
+// heartbeatOrigin returns the member that sent a heartbeat, following the same rules as
+// voteOrigin
+func (self *Controller) heartbeatOrigin(from string, msg *pb.Heartbeat) (string, bool) {
+	if self.signer == nil {
+		return from, true
+	}
+
+	leader, err := self.signer.verifyHeartbeat(msg)
+	if err != nil {
+		fmt.Printf("Dropping heartbeat from %s: %s\n", from, err.Error())
+		return "", false
+	}
+
+	// A leader numbers its heartbeats, so one that doesn't advance on the last we saw from
+	// it in the view has been replayed.  Those from earlier views are ignored regardless.
+	viewId, seq := msg.GetViewId(), msg.GetSeq()
+	seen, ok := self.heartbeatsSeen[leader]
+	switch {
+	case ok && viewId == seen.view && seq <= seen.seq:
+		fmt.Printf("Dropping replayed heartbeat from %s\n", from)
+		return "", false
+	case !ok || viewId >= seen.view:
+		self.heartbeatsSeen[leader] = heartbeatMark{view: viewId, seq: seq}
+	}
+
+	return leader, true
+}
+
+// restoreView resumes from the views recorded by a previous run, and records any views we
+// take part in from now on
+func (self *Controller) restoreView(views *viewStore) error {
+	view, ok, err := views.load()
+	if err != nil {
+		return err
+	}
+
+	self.views = views
+	self.savedView = -1
+
+	if ok {
+		self.savedView = view
+		self.electionManager.Restore(view + 1)
+		fmt.Printf("resuming after view %d\n", view)
+	}
+
+	return nil
+}
+
+func (self *Controller) saveView(view int64) {
+	if self.views == nil || view <= self.savedView {
+		return
+	}
+
+	// Carrying on without a record of the view could allow it to be reused
+	if err := self.views.save(view); err != nil {
+		panic(err)
+	}
+
+	self.savedView = view
+}
+
+// preferredCandidate returns the member we would most like to lead: whoever has the
+// highest priority among ourselves and the voters we are connected to
+func (self *Controller) preferredCandidate() (string, bool) {
+	var best string
+	found := false
+
+	// We come first so that we win any tie
+	for _, id := range append([]string{self.myId}, self.sortedPeerIds()...) {
+		if !self.isVoter(id) || !self.electionManager.Eligible(id) {
+			continue
+		}
+
+		if !found || self.electionManager.Priority(id) > self.electionManager.Priority(best) {
+			best = id
+			found = true
+		}
+	}
+
+	return best, found
+}
+
+func (self *Controller) castPreferredBallot() {
+	// Vote for ourselves, or a connected member with a higher priority, if there isn't
+	// a current contender
+	candidate, ok := self.preferredCandidate()
+	if !ok {
+		fmt.Printf("no eligible candidates are connected\n")
+		return
+	}
+
+	self.castBallot(candidate, self.electionManager.View())
+}
+
+// handoffCandidate returns a member with a higher priority than ours that has been
+// connected long enough to be considered healthy
+func (self *Controller) handoffCandidate() (string, bool) {
+	mine := self.electionManager.Priority(self.myId)
+	if !self.electionManager.Eligible(self.myId) {
+		mine = math.MinInt32
+	}
+
+	var best string
+	found := false
+
+	for _, id := range self.sortedPeerIds() {
+		priority := self.electionManager.Priority(id)
+
+		if !self.isVoter(id) || !self.electionManager.Eligible(id) || priority <= mine ||
+			time.Since(self.connectedAt[id]) < handoffDelay {
+			continue
+		}
+
+		if !found || priority > self.electionManager.Priority(best) {
+			best = id
+			found = true
+		}
+	}
+
+	return best, found
+}
+
+func (self *Controller) sortedPeerIds() []string {
+	ids := make([]string, 0, len(self.activePeers))
+	for id := range self.activePeers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
 }
 
-func (self *Controller) castSelfBallot() {
-	// Vote for ourselves if there isn't a current contender
-	viewId := self.electionManager.View()
+// checkHandoff steps down in favour of a higher priority member, once we have caught up
+// with the log.  We do so by voting for that member in the next view, which our followers
+// echo.
+func (self *Controller) checkHandoff() {
+	if self.abdicated || !self.replicator.ready {
+		return
+	}
+
+	candidate, ok := self.handoffCandidate()
+	if !ok {
+		return
+	}
+
+	fmt.Printf("handing leadership to %s, which has a higher priority\n", candidate)
 
-	self.castBallot(self.myId, viewId)
+	self.abdicated = true
+	self.castBallot(candidate, self.electionManager.View()+1)
 }
 
 func (self *Controller) onVote(from, peerId string, viewId int64) {
+	if !self.isVoter(from) || !self.isVoter(peerId) {
+		fmt.Printf("Dropping vote from %s for %s: observers do not take part in elections\n", from, peerId)
+		return
+	}
+
 	allow := false
 
 	switch self.state.Current() {
@@ -248,9 +730,12 @@ func (self *Controller) onVote(from, peerId string, viewId int64) {
 	case "initializing":
 		allow = true // Allow any vote through in convening/initializing state
 	case "electing":
-		// Only allow votes for the current view through
+		// Allow votes for the current view through, and votes that move on to a later view
+		// once the ballot they replace can no longer win
 		if viewId == self.electionManager.View() {
 			allow = true
+		} else if viewId > self.electionManager.View() {
+			allow = self.abandoned(from, viewId)
 		}
 	case "following":
 		fallthrough
@@ -266,9 +751,23 @@ func (self *Controller) onVote(from, peerId string, viewId int64) {
 		return
 	}
 
+	// A vote for the next view from our leader means it is handing off leadership
+	leader, _ := self.electionManager.Current()
+	handoff := self.state.Current() == "following" && from == leader && viewId == self.electionManager.View()+1
+
 	err := self.electionManager.ProcessVote(from, peerId, viewId)
+	if _, ok := err.(*election.EquivocationError); ok {
+		fmt.Printf("EQUIVOCATION: %s\n", err.Error())
+		return
+	}
 	if err != nil {
 		fmt.Printf("Dropping vote from %s: %s\n", from, err.Error())
+		return
+	}
+
+	if handoff {
+		fmt.Printf("%s is handing leadership to %s\n", from, peerId)
+		self.castBallot(peerId, viewId)
 	}
 }
 
@@ -279,17 +778,30 @@ func (self *Controller) onConvening() {
 func (self *Controller) onInitializing() {
 	fmt.Printf("onInitializing\n")
 	self.rearmTimeout()
+
+	if qc := self.pendingCert; qc != nil {
+		self.pendingCert = nil
+		if qc.GetViewId() >= self.electionManager.View() {
+			self.adoptCertificate(qc)
+		}
+	}
 }
 
-func (self *Controller) onHeartBeat(from string, viewId int64) {
+func (self *Controller) onHeartBeat(from string, viewId int64, seq uint64) {
 	leader, err := self.electionManager.Current()
 	if err != nil {
 		panic(err)
 	}
 
-	// Only pet the watchdog if the HB originated from the node we believe to be the leader
+	// Only pet the watchdog (and vouch for the leader) if the HB originated from the node
+	// we believe to be the leader
 	if from == leader && viewId == self.electionManager.View() {
 		self.rearmTimeout()
+
+		// Acknowledgements vouch for the leader, which is not an observer's place
+		if peer, ok := self.activePeers[from]; ok && !self.observer {
+			peer.Send(&pb.HeartbeatAck{ViewId: &viewId, Seq: &seq})
+		}
 	}
 }
 
@@ -297,6 +809,11 @@ func (self *Controller) onTimeout() {
 
 	fmt.Printf("onTimeout\n")
 
+	if self.state.Current() == "electing" {
+		// The election has stalled, such as on a split vote, so we vote again
+		self.revote()
+	}
+
 	self.rearmTimeout()
 }
 
@@ -305,15 +822,57 @@ func (self *Controller) onElecting() {
 
 	contender, view, err := self.electionManager.GetContender()
 	if err != nil {
-		// Vote for ourselves if there isn't a current contender
-		self.castSelfBallot()
+		self.castPreferredBallot()
 	} else {
-		self.castBallot(contender, view)
+		self.castBallot(self.supportedCandidate(contender), view)
 	}
 
 	self.rearmTimeout()
 }
 
+// supportedCandidate returns the candidate we support given the current contender
+func (self *Controller) supportedCandidate(contender string) string {
+	if preferred, ok := self.preferredCandidate(); ok &&
+		self.electionManager.Priority(preferred) > self.electionManager.Priority(contender) {
+		// Lend our support to a better candidate that nobody has voted for yet
+		return preferred
+	}
+
+	return contender
+}
+
+// revote casts our ballot again in a stalled election.  Every member holding the same
+// ballots settles on the same contender, so a split vote resolves once each has voted
+// again.  We never change our vote within a view, as members that counted our first vote
+// could then elect a different leader in it to those that count the second, so we move
+// to the next view instead, where the others will follow us as the later view is preferred.
+func (self *Controller) revote() {
+	contender, view, err := self.electionManager.GetContender()
+	if err != nil {
+		self.castPreferredBallot()
+		return
+	}
+
+	candidate := self.supportedCandidate(contender)
+
+	if current, mine, ok := self.electionManager.Ballot(self.myId); ok && mine >= view && current != candidate {
+		view = mine + 1
+	}
+
+	self.castBallot(candidate, view)
+}
+
+// abandoned reports whether a voter may move its ballot to a later view: it may only leave
+// behind a ballot that can no longer win, lest the view it leaves be decided with it
+func (self *Controller) abandoned(voter string, viewId int64) bool {
+	candidate, view, ok := self.electionManager.Ballot(voter)
+	if !ok || view >= viewId {
+		return true
+	}
+
+	return !self.electionManager.Reachable(candidate, view)
+}
+
 func (self *Controller) onEnterFollowing() {
 	self.rearmTimeout()
 	leader, err := self.electionManager.Current()
@@ -324,9 +883,12 @@ func (self *Controller) onEnterFollowing() {
 	printSeparator()
 	fmt.Printf("VIEW %d: FOLLOWING %s\n", self.electionManager.View(), leader)
 	printSeparator()
+
+	self.replicator.follow(leader, self.electionManager.View())
 }
 
 func (self *Controller) onLeaveFollowing() {
+	self.replicator.stepDown()
 	self.electionManager.NextView()
 	self.timer.Stop()
 }
@@ -336,16 +898,39 @@ func (self *Controller) onEnterLeading() {
 	fmt.Printf("VIEW %d: LEADING\n", self.electionManager.View())
 	printSeparator()
 
+	self.abdicated = false
+	self.certificate = self.buildCertificate()
+	self.announced = false
 	self.pulse = time.NewTicker(time.Millisecond * time.Duration(self.minTmo/2))
+	self.replicator.lead(self.electionManager.View())
 }
 
 func (self *Controller) onLeaveLeading() {
+	self.replicator.stepDown()
+	self.failBarriers(ErrNotLeader)
+	self.certificate = nil
 	self.electionManager.NextView()
 	self.pulse.Stop()
 }
 
+// shutdown disconnects every peer as Run returns
+func (self *Controller) shutdown() {
+	self.timer.Stop()
+	self.pulse.Stop()
+	self.failBarriers(ErrNotLeader)
+
+	for _, peer := range self.getPeers() {
+		self.peerLock.Lock()
+		delete(self.activePeers, peer.Id())
+		self.peerLock.Unlock()
+
+		peer.Close()
+	}
+}
+
 func (self *Controller) broadcast(msg proto.Message) {
 	for _, peer := range self.activePeers {
+		// Errors are ignored here: a closed peer will be reaped when its disconnect is processed
 		peer.Send(msg)
 	}
 }
@@ -8,27 +8,36 @@ import (
 )
 
 
-type Votes map[string]Vote
-
 type Manager struct {
-	state     *fsm.FSM
-	myId      string
-	members   []string
-	votes     Votes
-	first     *Vote
-	leader    string
-	view      int64
-	threshold int
-	C         chan bool
+	state      *fsm.FSM
+	myId       string
+	members    []string
+	boxes      map[int64]*ballotBox
+	ballots    map[string]int64 // the view holding each voter's ballot
+	leader     string
+	view       int64
+	threshold  int
+	faults     int                  // the number of byzantine members tolerated
+	strict     bool                 // whether members may only vote once per view
+	cast       map[ballotKey]string // every vote in undecided views, to detect equivocation
+	priorities map[string]int
+	ineligible map[string]bool
+	excluded   map[string]bool
+	C          chan bool
 }
 
 func NewManager(_myId string, _members []string) *Manager {
 	self := &Manager{
-		myId:      _myId,
-		members:   _members,
-		votes:     make(Votes),
-		threshold: util.ComputeQuorumThreshold(len(_members)),
-		C:         make(chan bool, 100),
+		myId:       _myId,
+		members:    _members,
+		boxes:      make(map[int64]*ballotBox),
+		ballots:    make(map[string]int64),
+		cast:       make(map[ballotKey]string),
+		threshold:  util.ComputeQuorumThreshold(len(_members)),
+		priorities: make(map[string]int),
+		ineligible: make(map[string]bool),
+		excluded:   make(map[string]bool),
+		C:          make(chan bool, 100),
 	}
 
 	self.state = fsm.NewFSM(
@@ -36,6 +45,7 @@ func NewManager(_myId string, _members []string) *Manager {
 		fsm.Events{
 			{Name: "quorum", Src: []string{"idle", "elected"}, Dst: "electing"},
 			{Name: "complete", Src: []string{"electing"}, Dst: "elected"},
+			{Name: "certified", Src: []string{"idle", "electing"}, Dst: "elected"},
 			{Name: "next", Src: []string{"elected"}, Dst: "idle"},
 		},
 		fsm.Callbacks{
@@ -64,97 +74,262 @@ func (self *Manager) View() int64 {
 	return self.view
 }
 
+// Restore sets the lowest view in which we will take part in an election.  It is used
+// after a restart so that views, once used, are never reused.
+func (self *Manager) Restore(view int64) {
+	if view > self.view {
+		self.view = view
+	}
+}
+
 func (self *Manager) Invalidate(member string) {
-	delete(self.votes, member)
+	self.discard(member)
 	if self.state.Current() == "elected" && member == self.leader {
 		self.state.Event("leader-lost")
 	}
 }
 
+// SetByzantine configures the election to tolerate faults byzantine members, which requires
+// 2f+1 votes out of 3f+1 members to win.  A member may then only vote once in each view;
+// a member that votes for a different candidate in the same view is equivocating.
+func (self *Manager) SetByzantine(faults int) {
+	self.faults = faults
+	self.threshold = util.ComputeFaultTolerantQuorum(len(self.members), faults)
+	self.strict = true
+
+	fmt.Printf("EM: Tolerating %d byzantine members with a quorum threshold %d\n", faults, self.threshold)
+}
+
+// SetStrict configures whether a member may only vote once in each view.  When strict, a
+// vote for a different candidate in the same view is refused as equivocation.
+func (self *Manager) SetStrict(strict bool) {
+	self.strict = strict
+}
+
+// Reachable reports whether a candidate could still win a view: whether the votes for it
+// there, together with those of the voters yet to vote in that view or a later one, would
+// make a quorum
+func (self *Manager) Reachable(candidate string, view int64) bool {
+	count := 0
+
+	for _, member := range self.members {
+		if self.excluded[member] {
+			continue
+		}
+
+		v, ok := self.ballots[member]
+		switch {
+		case !ok || v < view:
+			count++
+		case v == view && self.boxes[v].ballots[member] == candidate:
+			count++
+		}
+	}
+
+	return count >= self.threshold
+}
+
+// Threshold returns the number of votes needed to win an election
+func (self *Manager) Threshold() int {
+	return self.threshold
+}
+
 func (self *Manager) VoteCount() int {
-	return len(self.votes)
+	return len(self.ballots)
+}
+
+// Ballot returns the candidate and view of the ballot a voter holds, if any
+func (self *Manager) Ballot(voter string) (string, int64, bool) {
+	view, ok := self.ballots[voter]
+	if !ok {
+		return "", 0, false
+	}
+
+	return self.boxes[view].ballots[voter], view, true
 }
 
+// GetContender returns the candidate we should support in the current election.  Later
+// views are preferred, then higher priority candidates, then those with the most votes.
+// Any remaining tie goes to the lowest identity, so every member holding the same ballots
+// reaches the same conclusion.
 func (self *Manager) GetContender() (string, int64, error) {
-	if len(self.votes) == 0 {
-		return "", 0, errors.New("no candidates present")
+	var best *contender
+
+	for _, box := range self.boxes {
+		counts, candidates := box.tally()
+		for _, candidate := range candidates {
+			c := &contender{peerId: candidate, viewId: box.view, count: counts[candidate]}
+			if best == nil || self.better(c, best) {
+				best = c
+			}
+		}
 	}
 
-	results := make(map[string]int)
+	if best == nil {
+		return "", 0, ErrNoCandidates
+	}
 
-	var max int
+	return best.peerId, best.viewId, nil
+}
 
-	// Accumulate all the votes by peer, and make note of the largest
-	for _, vote := range self.votes {
-		peerId := vote.peerId
-		result := results[peerId]
-		result++
-		results[peerId] = result
+type contender struct {
+	peerId string
+	viewId int64
+	count  int
+}
 
-		if result > max {
-			max = result
-		}
+func (self *Manager) better(c *contender, than *contender) bool {
+	switch {
+	case c.viewId != than.viewId:
+		return c.viewId > than.viewId
+	case self.Priority(c.peerId) != self.Priority(than.peerId):
+		return self.Priority(c.peerId) > self.Priority(than.peerId)
+	case c.count != than.count:
+		return c.count > than.count
 	}
 
-	if max == 1 {
-		// If we don't have any one peer with more than one vote, the first vote received
-		// has the most weight
-		return self.first.peerId, self.first.viewId, nil
+	return c.peerId < than.peerId
+}
+
+// SetPriority configures a member's preference as leader.  Members with a higher priority
+// are favoured in elections.  The default priority is zero.
+func (self *Manager) SetPriority(member string, priority int) {
+	self.priorities[member] = priority
+}
+
+func (self *Manager) Priority(member string) int {
+	return self.priorities[member]
+}
+
+// SetEligible configures whether a member may stand for election
+func (self *Manager) SetEligible(member string, eligible bool) {
+	if eligible {
+		delete(self.ineligible, member)
 	} else {
-		// Now go find the first entry with the same max
-		for peerId, votes := range results {
-			if votes == max {
-				vote := self.votes[peerId]
-				return vote.peerId, vote.viewId, nil
-			}
-		}
+		self.ineligible[member] = true
+	}
+}
+
+func (self *Manager) Eligible(member string) bool {
+	return !self.ineligible[member] && !self.excluded[member]
+}
+
+// SetExcluded configures whether a member is excluded from elections altogether, as when
+// it has been revoked.  Its ballot and any ballots for it are discarded, its votes are
+// refused, and it may not stand for election.
+func (self *Manager) SetExcluded(member string, excluded bool) {
+	if !excluded {
+		delete(self.excluded, member)
+		return
 	}
 
-	return "", 0, errors.New("no candidates computed")
+	self.excluded[member] = true
+	self.discard(member)
 
+	for voter, view := range self.ballots {
+		if self.boxes[view].ballots[voter] == member {
+			self.discard(voter)
+		}
+	}
+}
+
+func (self *Manager) Excluded(member string) bool {
+	return self.excluded[member]
 }
 
 func (self *Manager) ProcessVote(from, peerId string, viewId int64) error {
 
 	fmt.Printf("EM: vote for %s in view %d from %s\n", peerId, viewId, from)
 
-	prevCount := len(self.votes)
+	// Once a view is decided, any further votes in it are too late to matter
+	if viewId < self.view || (viewId == self.view && self.state.Current() == "elected") {
+		return &StaleViewError{View: viewId, Current: self.view}
+	}
+
+	if self.excluded[from] {
+		return &ExcludedError{Voter: from}
+	}
+
+	if !self.Eligible(peerId) {
+		return &IneligibleError{Candidate: peerId}
+	}
+
+	if self.strict {
+		key := ballotKey{voter: from, view: viewId}
+		if candidate, ok := self.cast[key]; ok && candidate != peerId {
+			return &EquivocationError{Voter: from, View: viewId, First: candidate, Second: peerId}
+		}
+		self.cast[key] = peerId
+	}
+
+	prevCount := len(self.ballots)
+
+	// A voter holds a single ballot, so a new vote replaces any it cast before
+	self.discard(from)
 
-	vote := &Vote{viewId: viewId, peerId: peerId}
-	self.votes[from] = *vote
-	if prevCount == 0 {
-		self.first = vote // This gives extra weight to the first received vote
+	box, ok := self.boxes[viewId]
+	if !ok {
+		box = newBallotBox(viewId)
+		self.boxes[viewId] = box
 	}
+	box.ballots[from] = peerId
+	self.ballots[from] = viewId
 
-	currCount := len(self.votes)
+	currCount := len(self.ballots)
 
 	// Our criteria for proposal-quorum is threshold - 1 because we don't include ourselves
 	if prevCount != currCount && currCount == (self.threshold - 1) {
 		self.state.Event("quorum")
 	}
 
-	results := make(map[string]*int64)
+	// Only the box that changed can have reached quorum, and then only for one candidate
+	counts, candidates := box.tally()
+	for _, candidate := range candidates {
+		if counts[candidate] >= self.threshold {
+			self.state.Event("complete", candidate, viewId)
+			break
+		}
+	}
 
-	// We will choose the first entry with enough accumulated votes to exceed quorum.  There should
-	// only be one
-	for _, vote := range self.votes {
+	return nil
+}
 
-		index := vote.GetIndex()
+// discard removes the ballot cast by a voter, if any
+func (self *Manager) discard(voter string) {
+	view, ok := self.ballots[voter]
+	if !ok {
+		return
+	}
 
-		result, ok := results[index]
-		if !ok {
-			result = new(int64)
-			results[index] = result
-		}
+	box := self.boxes[view]
+	delete(box.ballots, voter)
+	if len(box.ballots) == 0 {
+		delete(self.boxes, view)
+	}
+	delete(self.ballots, voter)
+}
+
+// Certify concludes an election on the strength of proof that a quorum elected the leader
+// in the view, such as a quorum certificate, rather than on the votes we have received
+func (self *Manager) Certify(leader string, viewId int64) error {
+	if viewId < self.view {
+		return &StaleViewError{View: viewId, Current: self.view}
+	}
 
-		(*result)++
+	if self.state.Current() != "elected" {
+		self.state.Event("certified", leader, viewId)
+		return nil
+	}
 
-		if *result >= int64(self.threshold) {
-			self.state.Event("complete", vote.peerId, vote.viewId)
-			continue
+	if viewId == self.view {
+		if leader != self.leader {
+			return fmt.Errorf("%s cannot lead view %d, which was won by %s", leader, viewId, self.leader)
 		}
+		return nil
 	}
 
+	// We are behind: the election we know of has already been superseded
+	self.onElected(leader, viewId)
 	return nil
 }
 
@@ -167,8 +342,19 @@ func (self *Manager) onElected(leader string, view int64) {
 	fmt.Printf("EM: Election Complete, new leader = %s\n", leader)
 	self.leader = leader
 	self.view = view
-	self.votes = make(Votes) // clear any outstanding votes
-	self.first = nil
+
+	// Ballots for this view and earlier are settled, but those for later views still count
+	for voter, v := range self.ballots {
+		if v <= view {
+			self.discard(voter)
+		}
+	}
+	for key := range self.cast {
+		if key.view <= view {
+			delete(self.cast, key)
+		}
+	}
+
 	self.C <- true // notify our observers
 }
 
@@ -39,3 +39,212 @@ func TestElection(t *testing.T) {
 	err = em.ProcessVote("D", "B", 1)
 	assert.NotNil(t, err)
 }
+
+func TestRestoredView(t *testing.T) {
+	em := NewManager("A", []string{"A", "B", "C"})
+	em.Restore(5)
+	assert.Equal(t, int64(5), em.View())
+
+	// Views from before the restart are never reused
+	err := em.ProcessVote("B", "B", 4)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, em.VoteCount())
+
+	// The latest view is preferred when no candidate has more than one vote
+	em.ProcessVote("B", "B", 5)
+	em.ProcessVote("C", "C", 6)
+
+	contender, view, err := em.GetContender()
+	assert.Nil(t, err)
+	assert.Equal(t, "C", contender)
+	assert.Equal(t, int64(6), view)
+}
+
+func TestPriority(t *testing.T) {
+	em := NewManager("A", []string{"A", "B", "C", "D", "E"})
+	em.SetPriority("C", 10)
+	em.SetEligible("E", false)
+
+	// A candidate that may not lead cannot be voted for
+	err := em.ProcessVote("D", "E", 0)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, em.VoteCount())
+
+	// Priority outweighs the number of votes, and the order they arrived in
+	em.ProcessVote("A", "B", 0)
+	em.ProcessVote("B", "B", 0)
+	em.ProcessVote("D", "C", 0)
+
+	contender, _, err := em.GetContender()
+	assert.Nil(t, err)
+	assert.Equal(t, "C", contender)
+}
+
+type ballot struct {
+	from   string
+	peerId string
+	viewId int64
+}
+
+func TestTally(t *testing.T) {
+	cases := []struct {
+		name       string
+		priorities map[string]int
+		ballots    []ballot
+		contender  string
+		view       int64
+		leader     string
+	}{
+		{
+			name:      "split vote goes to the lowest identity",
+			ballots:   []ballot{{"A", "C", 0}, {"B", "B", 0}},
+			contender: "B",
+		},
+		{
+			name:      "split vote ignores arrival order",
+			ballots:   []ballot{{"B", "B", 0}, {"A", "C", 0}},
+			contender: "B",
+		},
+		{
+			name:      "most votes wins",
+			ballots:   []ballot{{"A", "C", 0}, {"B", "B", 0}, {"D", "C", 0}},
+			contender: "C",
+		},
+		{
+			name:       "priority breaks a split vote",
+			priorities: map[string]int{"C": 1},
+			ballots:    []ballot{{"A", "B", 0}, {"B", "C", 0}},
+			contender:  "C",
+		},
+		{
+			name:      "later view wins",
+			ballots:   []ballot{{"A", "B", 0}, {"B", "B", 0}, {"D", "C", 1}},
+			contender: "C",
+			view:      1,
+		},
+		{
+			name:      "changed vote moves the ballot",
+			ballots:   []ballot{{"A", "B", 0}, {"D", "B", 0}, {"D", "C", 0}, {"E", "C", 0}},
+			contender: "C",
+		},
+		{
+			name:      "votes in different views do not combine",
+			ballots:   []ballot{{"A", "B", 0}, {"D", "B", 1}, {"E", "B", 2}},
+			contender: "B",
+			view:      2,
+		},
+		{
+			name:      "quorum in a single view elects",
+			ballots:   []ballot{{"A", "C", 0}, {"B", "B", 0}, {"D", "C", 0}, {"E", "C", 0}},
+			contender: "C",
+			leader:    "C",
+		},
+	}
+
+	for _, c := range cases {
+		em := NewManager("A", []string{"A", "B", "C", "D", "E"})
+		for member, priority := range c.priorities {
+			em.SetPriority(member, priority)
+		}
+		for _, b := range c.ballots {
+			assert.Nil(t, em.ProcessVote(b.from, b.peerId, b.viewId), c.name)
+		}
+
+		leader, err := em.Current()
+		if c.leader != "" {
+			assert.Nil(t, err, c.name)
+			assert.Equal(t, c.leader, leader, c.name)
+			continue
+		}
+		assert.NotNil(t, err, c.name)
+
+		contender, view, err := em.GetContender()
+		assert.Nil(t, err, c.name)
+		assert.Equal(t, c.contender, contender, c.name)
+		assert.Equal(t, c.view, view, c.name)
+	}
+}
+
+func TestStaleVotes(t *testing.T) {
+	em := NewManager("A", []string{"A", "B", "C"})
+	em.ProcessVote("A", "B", 0)
+	em.ProcessVote("B", "B", 0)
+
+	err := em.ProcessVote("C", "C", 0)
+	stale, ok := err.(*StaleViewError)
+	assert.True(t, ok)
+	assert.Equal(t, int64(0), stale.View)
+
+	_, _, err = em.GetContender()
+	assert.Equal(t, ErrNoCandidates, err)
+
+	em.SetEligible("C", false)
+	_, ok = em.ProcessVote("B", "C", 1).(*IneligibleError)
+	assert.True(t, ok)
+}
+
+func TestByzantine(t *testing.T) {
+	em := NewManager("A", []string{"A", "B", "C", "D"})
+	em.SetByzantine(1)
+	assert.Equal(t, 3, em.Threshold())
+
+	assert.Nil(t, em.ProcessVote("B", "B", 0))
+
+	// Voting again for the same candidate is harmless, but changing it is not
+	assert.Nil(t, em.ProcessVote("B", "B", 0))
+	err := em.ProcessVote("B", "C", 0)
+	equivocation, ok := err.(*EquivocationError)
+	assert.True(t, ok)
+	assert.Equal(t, &EquivocationError{Voter: "B", View: 0, First: "B", Second: "C"}, equivocation)
+
+	// Moving to a later view doesn't erase the record of the earlier one
+	assert.Nil(t, em.ProcessVote("B", "C", 1))
+	_, ok = em.ProcessVote("B", "D", 0).(*EquivocationError)
+	assert.True(t, ok)
+
+	// Two votes are a majority, but not 2f+1
+	em.ProcessVote("C", "C", 1)
+	_, err = em.Current()
+	assert.NotNil(t, err)
+
+	em.ProcessVote("D", "C", 1)
+	leader, err := em.Current()
+	assert.Nil(t, err)
+	assert.Equal(t, "C", leader)
+}
+
+func TestExcluded(t *testing.T) {
+	em := NewManager("A", []string{"A", "B", "C", "D", "E"})
+	em.ProcessVote("A", "B", 0)
+	em.ProcessVote("B", "B", 0)
+	em.ProcessVote("C", "C", 0)
+
+	em.SetExcluded("B", true)
+	assert.False(t, em.Eligible("B"))
+	assert.Equal(t, 1, em.VoteCount())
+
+	_, ok := em.ProcessVote("B", "C", 0).(*ExcludedError)
+	assert.True(t, ok)
+	_, ok = em.ProcessVote("D", "B", 0).(*IneligibleError)
+	assert.True(t, ok)
+
+	contender, _, err := em.GetContender()
+	assert.Nil(t, err)
+	assert.Equal(t, "C", contender)
+}
+
+func TestReachable(t *testing.T) {
+	em := NewManager("A", []string{"A", "B", "C", "D"})
+	em.ProcessVote("A", "A", 0)
+	em.ProcessVote("C", "A", 0)
+	em.ProcessVote("B", "B", 0)
+
+	// D has yet to vote, so A could still make the three votes needed, but B cannot
+	assert.True(t, em.Reachable("A", 0))
+	assert.False(t, em.Reachable("B", 0))
+
+	// and once D moves on to a later view, nor can A
+	em.ProcessVote("D", "A", 1)
+	assert.False(t, em.Reachable("A", 0))
+	assert.True(t, em.Reachable("A", 1))
+}
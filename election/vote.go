@@ -1,20 +1,83 @@
 package election
 
 import (
+	"errors"
 	"fmt"
-	"bytes"
+	"sort"
 )
 
-type Vote struct {
-	viewId int64
-	peerId string
+var ErrNoCandidates = errors.New("no candidates present")
+
+// StaleViewError is returned for a vote in a view that has already been decided
+type StaleViewError struct {
+	View    int64 // the view the vote was cast in
+	Current int64 // the view we are in
+}
+
+func (self *StaleViewError) Error() string {
+	return fmt.Sprintf("vote for view %d is stale in view %d", self.View, self.Current)
+}
+
+// IneligibleError is returned for a vote for a member that may not stand for election
+type IneligibleError struct {
+	Candidate string
+}
+
+func (self *IneligibleError) Error() string {
+	return fmt.Sprintf("%s may not stand for election", self.Candidate)
+}
+
+// ExcludedError is returned for a vote by a member that is excluded from elections
+type ExcludedError struct {
+	Voter string
+}
+
+func (self *ExcludedError) Error() string {
+	return fmt.Sprintf("%s is excluded from elections", self.Voter)
 }
 
-func (self *Vote) GetIndex() string {
-	var buf bytes.Buffer
-	buf.WriteString(self.peerId)
-	buf.WriteString("-")
-	buf.WriteString(fmt.Sprintf("%d", self.viewId))
+// EquivocationError is returned when a member votes for two candidates in the same view,
+// which a correct member never does when byzantine faults are tolerated
+type EquivocationError struct {
+	Voter  string
+	View   int64
+	First  string // the candidate of the ballot we hold
+	Second string // the conflicting candidate
+}
+
+func (self *EquivocationError) Error() string {
+	return fmt.Sprintf("%s voted for both %s and %s in view %d", self.Voter, self.First, self.Second, self.View)
+}
+
+type ballotKey struct {
+	voter string
+	view  int64
+}
+
+// ballotBox holds the ballots cast in a single view.  Each voter holds at most one ballot
+// across all views, so a voter's ballot moves between boxes as it changes its mind.
+type ballotBox struct {
+	view    int64
+	ballots map[string]string // candidate by voter
+}
+
+func newBallotBox(view int64) *ballotBox {
+	return &ballotBox{view: view, ballots: make(map[string]string)}
+}
+
+// tally returns the number of ballots cast for each candidate, along with the
+// candidates in a stable order
+func (self *ballotBox) tally() (map[string]int, []string) {
+	counts := make(map[string]int)
+	for _, candidate := range self.ballots {
+		counts[candidate]++
+	}
+
+	candidates := make([]string, 0, len(counts))
+	for candidate := range counts {
+		candidates = append(candidates, candidate)
+	}
+	sort.Strings(candidates)
 
-	return buf.String()
+	return counts, candidates
 }
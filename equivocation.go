@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ghaskins/go-cluster/pb"
+)
+
+// Equivocation is evidence that a member voted for two candidates in the same view.  Both
+// votes carry the member's signature, so the evidence stands on its own.
+type Equivocation struct {
+	Voter  string
+	View   int64
+	First  *pb.Vote
+	Second *pb.Vote
+}
+
+func (self *Equivocation) String() string {
+	return fmt.Sprintf("%s voted for both %s and %s in view %d", self.Voter,
+		self.First.GetPeerId(), self.Second.GetPeerId(), self.View)
+}
+
+// EquivocationHandler is notified of each member caught equivocating
+type EquivocationHandler func(evidence *Equivocation)
+
+type voteKey struct {
+	voter string
+	view  int64
+}
+
+// checkEquivocation returns evidence of equivocation if a signed vote conflicts with one
+// the same member cast earlier in the view
+func (self *Controller) checkEquivocation(voter string, msg *pb.Vote) *Equivocation {
+	key := voteKey{voter: voter, view: msg.GetViewId()}
+
+	first, ok := self.firstVotes[key]
+	if !ok {
+		self.firstVotes[key] = msg
+		return nil
+	}
+
+	if first.GetPeerId() == msg.GetPeerId() {
+		return nil
+	}
+
+	return &Equivocation{Voter: voter, View: msg.GetViewId(), First: first, Second: msg}
+}
+
+// pruneVotes forgets the votes of views that have been decided
+func (self *Controller) pruneVotes(view int64) {
+	for key := range self.firstVotes {
+		if key.view <= view {
+			delete(self.firstVotes, key)
+		}
+	}
+	for key := range self.equivocators {
+		if key.view <= view {
+			delete(self.equivocators, key)
+		}
+	}
+}
+
+func (self *Controller) onEquivocation(evidence *Equivocation) {
+	key := voteKey{voter: evidence.Voter, view: evidence.View}
+	if self.equivocators[key] {
+		return // already reported
+	}
+	self.equivocators[key] = true
+
+	fmt.Printf("EQUIVOCATION: %s\n", evidence)
+	fmt.Printf("\tfirst:  %s\n", evidence.First)
+	fmt.Printf("\tsecond: %s\n", evidence.Second)
+
+	if self.onEquivocate != nil {
+		go self.onEquivocate(evidence)
+	}
+
+	if self.quarantine > 0 && evidence.Voter != self.myId {
+		fmt.Printf("quarantining %s for %v\n", evidence.Voter, self.quarantine)
+
+		if self.connMgr != nil {
+			self.connMgr.Quarantine(evidence.Voter, self.quarantine)
+		}
+		if peer, ok := self.activePeers[evidence.Voter]; ok {
+			peer.Close()
+		}
+	}
+}
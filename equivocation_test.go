@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/ghaskins/go-cluster/pb"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestEquivocationDetected(t *testing.T) {
+	controllers := newTestSignedControllers(t, "A", "B", "C")
+	a := controllers["A"]
+
+	first := controllers["B"].newVote("B", 2)
+	assert.Nil(t, a.checkEquivocation("B", first))
+	assert.Nil(t, a.checkEquivocation("B", controllers["B"].newVote("B", 2)))
+	assert.Nil(t, a.checkEquivocation("B", controllers["B"].newVote("C", 3)))
+
+	second := controllers["B"].newVote("C", 2)
+	evidence := a.checkEquivocation("B", second)
+	assert.NotNil(t, evidence)
+	assert.Equal(t, &Equivocation{Voter: "B", View: 2, First: first, Second: second}, evidence)
+
+	// The evidence is verifiable by anyone
+	for _, vote := range []*pb.Vote{evidence.First, evidence.Second} {
+		voter, err := controllers["C"].signer.verifyVote(vote)
+		assert.Nil(t, err)
+		assert.Equal(t, "B", voter)
+	}
+
+	// Once the view is decided its votes are forgotten
+	a.pruneVotes(2)
+	assert.Nil(t, a.checkEquivocation("B", second))
+}
+
+func TestEquivocationReportedAndQuarantined(t *testing.T) {
+	controllers := newTestSignedControllers(t, "A", "B", "C")
+	a := controllers["A"]
+	a.connMgr = &ConnectionManager{quarantined: make(map[string]time.Time)}
+	a.quarantine = time.Hour
+
+	reports := make(chan *Equivocation, 10)
+	a.onEquivocate = func(evidence *Equivocation) { reports <- evidence }
+
+	evidence := &Equivocation{
+		Voter:  "B",
+		View:   0,
+		First:  controllers["B"].newVote("B", 0),
+		Second: controllers["B"].newVote("C", 0),
+	}
+
+	// Each offence is reported once
+	a.onEquivocation(evidence)
+	a.onEquivocation(evidence)
+
+	assert.Equal(t, evidence, <-reports)
+	select {
+	case <-reports:
+		t.Fatal("equivocation reported twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.True(t, a.connMgr.quarantineRemaining("B") > 0)
+	assert.Equal(t, time.Duration(0), a.connMgr.quarantineRemaining("C"))
+}
+
+func TestQuarantineExpires(t *testing.T) {
+	connMgr := &ConnectionManager{quarantined: make(map[string]time.Time)}
+
+	connMgr.Quarantine("B", 10*time.Millisecond)
+	assert.True(t, connMgr.quarantineRemaining("B") > 0)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, time.Duration(0), connMgr.quarantineRemaining("B"))
+}
+
+func TestSignedSplitVoteResolved(t *testing.T) {
+	// Signed votes are binding even without byzantine tolerance
+	controllers := newTestSignedControllers(t, "A", "B", "C", "D")
+
+	splitVote(t, controllers)
+	assert.Equal(t, "A", resolveElection(t, controllers))
+}
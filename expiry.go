@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/x509"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the expiry monitor re-examines the members' certificates
+const expiryCheckInterval = time.Hour
+
+// The days until each member's certificate expires, published with the standard expvar
+// metrics as "certExpiryDays"
+var expiryMetric = expvar.NewMap("certExpiryDays")
+
+// ExpiryPolicy determines what becomes of a peer presenting a certificate outside its
+// validity period
+type ExpiryPolicy int
+
+const (
+	// ExpiryWarn logs the invalid certificate but accepts the connection
+	ExpiryWarn ExpiryPolicy = iota
+	// ExpiryReject refuses the connection
+	ExpiryReject
+	// ExpiryIgnore accepts the connection silently
+	ExpiryIgnore
+)
+
+var expiryPolicies = map[string]ExpiryPolicy{
+	"warn":   ExpiryWarn,
+	"reject": ExpiryReject,
+	"ignore": ExpiryIgnore,
+}
+
+func ParseExpiryPolicy(name string) (ExpiryPolicy, error) {
+	policy, ok := expiryPolicies[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown expiry policy \"%s\"", name)
+	}
+
+	return policy, nil
+}
+
+func (self ExpiryPolicy) String() string {
+	for name, policy := range expiryPolicies {
+		if policy == self {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("ExpiryPolicy(%d)", int(self))
+}
+
+// ParseExpiryThresholds parses a comma separated list of days, such as "30,7,1"
+func ParseExpiryThresholds(list string) ([]int, error) {
+	var thresholds []int
+
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		days, err := strconv.Atoi(field)
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("invalid expiry threshold \"%s\"", field)
+		}
+		thresholds = append(thresholds, days)
+	}
+
+	return thresholds, nil
+}
+
+// checkValidity returns an error if the certificate is not valid at the time given
+func checkValidity(cert *x509.Certificate, now time.Time) error {
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("certificate for %s is not valid until %v", cert.Subject.CommonName, cert.NotBefore)
+	}
+
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate for %s expired on %v", cert.Subject.CommonName, cert.NotAfter)
+	}
+
+	return nil
+}
+
+// daysUntilExpiry returns the whole days left before the certificate expires, which is
+// negative once it has expired
+func daysUntilExpiry(cert *x509.Certificate, now time.Time) int {
+	return int(math.Floor(cert.NotAfter.Sub(now).Hours() / 24))
+}
+
+// expiryMonitor warns as each member's certificate approaches expiry, once at each of the
+// thresholds it passes and once more when it expires
+type expiryMonitor struct {
+	lock       sync.Mutex
+	thresholds []int          // in days, from the furthest to the nearest
+	warned     map[string]int // the nearest threshold each member was warned at
+}
+
+func newExpiryMonitor(thresholds []int) *expiryMonitor {
+	self := &expiryMonitor{warned: make(map[string]int)}
+	self.setThresholds(thresholds)
+
+	return self
+}
+
+func (self *expiryMonitor) setThresholds(thresholds []int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.thresholds = append([]int{}, thresholds...)
+	sort.Sort(sort.Reverse(sort.IntSlice(self.thresholds)))
+}
+
+// check updates the metric and logs any warnings that are due.  It returns the days until
+// each member's certificate expires.
+func (self *expiryMonitor) check(members IdentityMap, now time.Time) map[string]int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	expiry := make(map[string]int)
+
+	for id, member := range members {
+		days := daysUntilExpiry(member.Cert, now)
+		expiry[id] = days
+
+		metric := new(expvar.Int)
+		metric.Set(int64(days))
+		expiryMetric.Set(id, metric)
+
+		// Expiry is the final threshold, below all those configured
+		level, due := -1, days < 0
+		if !due {
+			for _, threshold := range self.thresholds {
+				if days <= threshold {
+					level, due = threshold, true
+				}
+			}
+		}
+
+		if !due {
+			delete(self.warned, id) // the certificate has been renewed
+			continue
+		}
+
+		if warned, ok := self.warned[id]; ok && warned <= level {
+			continue
+		}
+		self.warned[id] = level
+
+		if days < 0 {
+			log.Printf("Certificate for %s (%s) expired on %v", member.Cert.Subject.CommonName, id, member.Cert.NotAfter)
+		} else {
+			log.Printf("Certificate for %s (%s) expires in %d days", member.Cert.Subject.CommonName, id, days)
+		}
+	}
+
+	return expiry
+}
+
+// run checks the members' certificates periodically, picking up any that are reloaded
+func (self *expiryMonitor) run(connMgr *ConnectionManager, done <-chan struct{}) {
+	for {
+		self.check(connMgr.members(), time.Now())
+
+		select {
+		case <-time.After(expiryCheckInterval):
+		case <-done:
+			return
+		}
+	}
+}
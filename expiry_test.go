@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestCertificateValidFor(t *testing.T, cn string, notBefore, notAfter time.Time) (*x509.Certificate, *tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCheckValidity(t *testing.T) {
+	now := time.Now()
+	cert, _ := newTestCertificateValidFor(t, "a", now.Add(-time.Hour), now.Add(time.Hour))
+
+	assert.Nil(t, checkValidity(cert, now))
+	assert.NotNil(t, checkValidity(cert, now.Add(-2*time.Hour)))
+	assert.NotNil(t, checkValidity(cert, now.Add(2*time.Hour)))
+
+	assert.Equal(t, 0, daysUntilExpiry(cert, now))
+	assert.Equal(t, -1, daysUntilExpiry(cert, now.Add(2*time.Hour)))
+	assert.Equal(t, 2, daysUntilExpiry(cert, now.Add(-48*time.Hour)))
+}
+
+func TestParseExpiry(t *testing.T) {
+	for _, name := range []string{"warn", "reject", "ignore"} {
+		policy, err := ParseExpiryPolicy(name)
+		assert.Nil(t, err)
+		assert.Equal(t, name, policy.String())
+	}
+
+	_, err := ParseExpiryPolicy("maybe")
+	assert.NotNil(t, err)
+
+	thresholds, err := ParseExpiryThresholds("30, 7,1")
+	assert.Nil(t, err)
+	assert.Equal(t, []int{30, 7, 1}, thresholds)
+
+	_, err = ParseExpiryThresholds("30,soon")
+	assert.NotNil(t, err)
+}
+
+func TestExpiryMonitor(t *testing.T) {
+	now := time.Now()
+	cert, _ := newTestCertificateValidFor(t, "a", now.Add(-time.Hour), now.Add(10*24*time.Hour+time.Hour))
+	members := IdentityMap{"a": NewIdentity(cert)}
+
+	monitor := newExpiryMonitor([]int{1, 30, 7})
+
+	assert.Equal(t, map[string]int{"a": 10}, monitor.check(members, now))
+	assert.Equal(t, 30, monitor.warned["a"])
+
+	// Each threshold is only warned about once
+	monitor.check(members, now.Add(24*time.Hour))
+	assert.Equal(t, 30, monitor.warned["a"])
+
+	monitor.check(members, now.Add(4*24*time.Hour))
+	assert.Equal(t, 7, monitor.warned["a"])
+
+	monitor.check(members, now.Add(11*24*time.Hour))
+	assert.Equal(t, -1, monitor.warned["a"])
+	assert.Equal(t, "-1", expiryMetric.Get("a").String())
+
+	// A renewed certificate is warned about afresh
+	renewed, _ := newTestCertificateValidFor(t, "a", now, now.Add(365*24*time.Hour))
+	monitor.check(IdentityMap{"a": NewIdentity(renewed)}, now)
+	_, warned := monitor.warned["a"]
+	assert.False(t, warned)
+}
+
+func TestExpiredPeerRejected(t *testing.T) {
+	now := time.Now()
+	_, serverCert := newTestCertificate(t, "server")
+	_, clientCert := newTestCertificateValidFor(t, "client", now.Add(-2*time.Hour), now.Add(-time.Hour))
+
+	for _, expiry := range []ExpiryPolicy{ExpiryWarn, ExpiryReject, ExpiryIgnore} {
+		a, b := net.Pipe()
+
+		server := tls.Server(a, newConfig(serverCert, nil))
+		client := tls.Client(b, newConfig(clientCert, nil))
+
+		go func() {
+			verifyCrypto(client, &connectionPolicy{})
+			client.Close()
+		}()
+
+		conn, err := verifyCrypto(server, &connectionPolicy{expiry: expiry})
+		if expiry == ExpiryReject {
+			assert.NotNil(t, err, expiry.String())
+		} else {
+			assert.Nil(t, err, expiry.String())
+			conn.Close()
+		}
+	}
+}
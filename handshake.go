@@ -0,0 +1,154 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"time"
+)
+
+// The most sources whose connection rate or failures we track
+const maxTrackedSources = 4096
+
+// The number of failed inbound handshakes, published with the standard expvar metrics
+var handshakeFailures = expvar.NewInt("handshakeFailures")
+
+// HandshakeLimits protect the listener from peers, or impostors, that connect and then
+// stall or flood it with connections
+type HandshakeLimits struct {
+	Timeout    time.Duration // to complete the TLS handshake and protocol negotiation
+	MaxPending int           // handshakes in progress at once, beyond which connections are refused
+	Rate       float64       // connections per second accepted from each source address
+	Burst      int           // connections accepted from a source in a burst
+}
+
+func DefaultHandshakeLimits() HandshakeLimits {
+	return HandshakeLimits{
+		Timeout:    10 * time.Second,
+		MaxPending: 64,
+		Rate:       1,
+		Burst:      10,
+	}
+}
+
+// admission decides which inbound connections are handshaken
+type admission struct {
+	lock    sync.Mutex
+	limits  HandshakeLimits
+	pending int
+	sources map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newAdmission(limits HandshakeLimits) *admission {
+	return &admission{limits: limits, sources: make(map[string]*tokenBucket)}
+}
+
+func (self *admission) setLimits(limits HandshakeLimits) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.limits = limits
+	self.sources = make(map[string]*tokenBucket)
+}
+
+func (self *admission) timeout() time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.limits.Timeout
+}
+
+// admit reserves a place for a connection's handshake, unless the source has connected
+// too often or too many handshakes are already in progress.  A place must be released
+// once the handshake is done.
+func (self *admission) admit(addr net.Addr, now time.Time) (bool, string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	// A connection refused for want of a place doesn't cost its source a token
+	if self.limits.MaxPending > 0 && self.pending >= self.limits.MaxPending {
+		return false, "too many handshakes in progress"
+	}
+
+	if !self.allow(sourceOf(addr), now) {
+		return false, "connecting too often"
+	}
+
+	self.pending++
+	return true, ""
+}
+
+func (self *admission) release() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.pending--
+}
+
+// allow takes a token from the source's bucket, which refills at the configured rate
+func (self *admission) allow(source string, now time.Time) bool {
+	if self.limits.Rate <= 0 {
+		return true
+	}
+
+	burst := float64(self.limits.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	bucket, ok := self.sources[source]
+	if !ok {
+		if len(self.sources) >= maxTrackedSources {
+			self.forget(now, burst)
+		}
+		bucket = &tokenBucket{tokens: burst, last: now}
+		self.sources[source] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * self.limits.Rate
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+	return true
+}
+
+// forget drops the sources whose buckets would have refilled by now, as tracking them no
+// longer makes a difference.  Should none have, the least recently seen source is dropped
+// instead, so that a flood of sources can't grow the map without bound.
+func (self *admission) forget(now time.Time, burst float64) {
+	var oldest string
+	var seen time.Time
+	for source, bucket := range self.sources {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*self.limits.Rate >= burst {
+			delete(self.sources, source)
+		} else if oldest == "" || bucket.last.Before(seen) {
+			oldest, seen = source, bucket.last
+		}
+	}
+
+	if len(self.sources) >= maxTrackedSources {
+		delete(self.sources, oldest)
+	}
+}
+
+// sourceOf identifies a connection's source by its host, as a client picks its own port
+func sourceOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
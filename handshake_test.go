@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestListener serves a connection manager that expects a single client, returning the
+// address it listens on and the client's certificate
+func newTestListener(t *testing.T, limits HandshakeLimits) (*ConnectionManager, string, *tls.Certificate) {
+	serverCert, serverTls := newTestCertificate(t, "server")
+	clientCert, clientTls := newTestCertificate(t, "client")
+	client := NewIdentity(clientCert)
+
+	cm := &ConnectionManager{
+		id:          NewIdentity(serverCert),
+		cert:        serverTls,
+		servers:     IdentityMap{client.Id: client},
+		quarantined: make(map[string]time.Time),
+		tls:         DefaultTLSPolicy(),
+		admission:   newAdmission(limits),
+		failures:    make(map[string]int),
+		C:           make(chan *Connection, 10),
+	}
+
+	listener, err := Listen(cm.serverConfig, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go cm.serve(listener)
+
+	return cm, listener.Addr().String(), clientTls
+}
+
+func dialTest(t *testing.T, addr string, cert *tls.Certificate) {
+	tlsConn, err := tls.Dial("tcp", addr, newConfig(cert, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := verifyCrypto(tlsConn, &connectionPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.offerProtocol(localProtocol); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+}
+
+// closedWithin reports whether the server closes a connection before the time given
+func closedWithin(conn net.Conn, timeout time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+
+	return err != nil
+}
+
+func accepted(cm *ConnectionManager) bool {
+	select {
+	case conn := <-cm.C:
+		conn.Close()
+		return true
+	case <-time.After(5 * time.Second):
+		return false
+	}
+}
+
+func TestStalledHandshake(t *testing.T) {
+	limits := DefaultHandshakeLimits()
+	limits.Timeout = 500 * time.Millisecond
+	cm, addr, clientCert := newTestListener(t, limits)
+
+	// A client that connects and then says nothing must not hold up the next
+	stalled, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+
+	dialTest(t, addr, clientCert)
+	assert.True(t, accepted(cm))
+
+	// and is disconnected once its time is up
+	assert.True(t, closedWithin(stalled, 5*time.Second))
+}
+
+func TestPendingHandshakeLimit(t *testing.T) {
+	limits := DefaultHandshakeLimits()
+	limits.MaxPending = 1
+	cm, addr, clientCert := newTestListener(t, limits)
+
+	stalled, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		cm.admission.lock.Lock()
+		pending := cm.admission.pending
+		cm.admission.lock.Unlock()
+		if pending == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Another connection is refused outright while the first is pending
+	refused, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	assert.True(t, closedWithin(refused, 2*time.Second))
+
+	// but once it gives up, there is room again
+	stalled.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	dialTest(t, addr, clientCert)
+	assert.True(t, accepted(cm))
+}
+
+func TestPendingReleasedAfterHandshake(t *testing.T) {
+	limits := DefaultHandshakeLimits()
+	limits.MaxPending = 1
+	cm, addr, clientCert := newTestListener(t, limits)
+
+	// Nobody is taking connections from the manager
+	for i := 0; i < cap(cm.C); i++ {
+		cm.C <- nil
+	}
+
+	// yet, having handshaken, they don't hold up the next
+	dialTest(t, addr, clientCert)
+	dialTest(t, addr, clientCert)
+
+	for i := 0; i < cap(cm.C)+2; i++ {
+		<-cm.C
+	}
+}
+
+func TestUnknownPeerRefused(t *testing.T) {
+	cm, addr, clientCert := newTestListener(t, DefaultHandshakeLimits())
+	_, stranger := newTestCertificate(t, "stranger")
+
+	// A stranger is refused by the handshake itself, before it can send anything
+	tlsConn, err := tls.Dial("tcp", addr, newConfig(stranger, nil))
+	if err == nil {
+		defer tlsConn.Close()
+		_, err = tlsConn.Read(make([]byte, 1))
+	}
+	assert.NotNil(t, err)
+
+	for i := 0; i < 100 && len(cm.HandshakeFailures()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, map[string]int{"127.0.0.1": 1}, cm.HandshakeFailures())
+
+	// while a member is still accepted
+	dialTest(t, addr, clientCert)
+	assert.True(t, accepted(cm))
+	assert.Equal(t, 1, cm.HandshakeFailures()["127.0.0.1"])
+}
+
+// refused reports whether the server refuses a client during the handshake
+func refused(t *testing.T, addr string, config *tls.Config) bool {
+	tlsConn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return true
+	}
+	defer tlsConn.Close()
+
+	// Under TLS 1.3 the server verifies the client after the client's handshake completes
+	tlsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = tlsConn.Read(make([]byte, 1))
+
+	return err != nil && !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func TestResumedPeerVerified(t *testing.T) {
+	cm, addr, clientCert := newTestListener(t, DefaultHandshakeLimits())
+
+	policy := DefaultTLSPolicy()
+	policy.SessionTickets = true
+	cm.SetTLSPolicy(policy)
+
+	config := newConfig(clientCert, policy)
+	config.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+
+	connect := func() *Connection {
+		tlsConn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := verifyCrypto(tlsConn, &connectionPolicy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := conn.offerProtocol(localProtocol); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		return conn
+	}
+
+	assert.False(t, connect().TLS.Resumed)
+	assert.True(t, connect().TLS.Resumed)
+
+	// Resuming a session is no way around quarantine
+	var client *Identity
+	for _, client = range cm.servers {
+	}
+
+	cm.Quarantine(client.Id, time.Hour)
+	assert.True(t, refused(t, addr, config))
+
+	// or revocation
+	revocations := NewRevocations()
+	revocations.ids[client.Id] = true
+
+	cm.lock.Lock()
+	delete(cm.quarantined, client.Id)
+	cm.revocations = revocations
+	cm.lock.Unlock()
+	assert.True(t, refused(t, addr, config))
+
+	// or a change of membership
+	cm.lock.Lock()
+	cm.revocations = nil
+	cm.servers = IdentityMap{}
+	cm.lock.Unlock()
+	assert.True(t, refused(t, addr, config))
+
+	for len(cm.C) > 0 {
+		<-cm.C
+	}
+}
+
+func TestHandshakeRateLimit(t *testing.T) {
+	limits := DefaultHandshakeLimits()
+	limits.Rate = 2
+	limits.Burst = 3
+	a := newAdmission(limits)
+
+	now := time.Now()
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	other := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000}
+
+	for i := 0; i < 3; i++ {
+		ok, _ := a.admit(addr, now)
+		assert.True(t, ok)
+		a.release()
+	}
+
+	// The burst is spent, though only for that source, whatever port it uses
+	addr.Port++
+	ok, reason := a.admit(addr, now)
+	assert.False(t, ok)
+	assert.Equal(t, "connecting too often", reason)
+
+	ok, _ = a.admit(other, now)
+	assert.True(t, ok)
+	a.release()
+
+	// Tokens return at the configured rate
+	ok, _ = a.admit(addr, now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+	a.release()
+
+	ok, _ = a.admit(addr, now.Add(500*time.Millisecond))
+	assert.False(t, ok)
+
+	// Sources that have been idle long enough are forgotten
+	a.forget(now.Add(time.Hour), float64(limits.Burst))
+	assert.Equal(t, 0, len(a.sources))
+}
+
+func TestTrackedSourcesBounded(t *testing.T) {
+	limits := DefaultHandshakeLimits()
+	limits.Rate = 0.001
+	limits.Burst = 1
+	a := newAdmission(limits)
+
+	now := time.Now()
+	first := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	ok, _ := a.admit(first, now)
+	assert.True(t, ok)
+	a.release()
+
+	// None of the buckets refill in the meantime, yet going past the cap evicts the least
+	// recently seen source rather than growing the map
+	for i := 1; i <= maxTrackedSources; i++ {
+		addr := &net.TCPAddr{IP: net.IPv4(10, 1, byte(i>>8), byte(i)), Port: 1000}
+		ok, _ := a.admit(addr, now.Add(time.Duration(i)*time.Millisecond))
+		assert.True(t, ok)
+		a.release()
+	}
+	assert.Equal(t, maxTrackedSources, len(a.sources))
+
+	_, tracked := a.sources[sourceOf(first)]
+	assert.False(t, tracked)
+}
+
+func TestPendingLimitSparesTokens(t *testing.T) {
+	limits := DefaultHandshakeLimits()
+	limits.MaxPending = 1
+	limits.Burst = 1
+	a := newAdmission(limits)
+
+	now := time.Now()
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	other := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000}
+
+	ok, _ := a.admit(other, now)
+	assert.True(t, ok)
+
+	for i := 0; i < 5; i++ {
+		ok, reason := a.admit(addr, now)
+		assert.False(t, ok)
+		assert.Equal(t, "too many handshakes in progress", reason)
+	}
+
+	// Connections refused for want of a place didn't spend the source's only token
+	a.release()
+	ok, _ = a.admit(addr, now)
+	assert.True(t, ok)
+}
@@ -1,23 +1,101 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"crypto/x509"
 	"fmt"
 )
 
+// IdentityScheme determines how a member's identity is derived from its certificate, and
+// so which certificate changes it survives
+type IdentityScheme int
+
+const (
+	// CertificateScheme identifies a member by a hash of its certificate, so any new
+	// certificate makes for a new member
+	CertificateScheme IdentityScheme = iota
+	// PublicKeyScheme identifies a member by a hash of its public key, so a certificate
+	// may be renewed for the same key
+	PublicKeyScheme
+	// NameScheme identifies a member by the common name of its certificate, so its key may
+	// be rotated
+	NameScheme
+)
+
+var identitySchemes = map[string]IdentityScheme{
+	"certificate": CertificateScheme,
+	"key":         PublicKeyScheme,
+	"name":        NameScheme,
+}
+
+func ParseIdentityScheme(name string) (IdentityScheme, error) {
+	scheme, ok := identitySchemes[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown identity scheme \"%s\"", name)
+	}
+
+	return scheme, nil
+}
+
+func (self IdentityScheme) String() string {
+	for name, scheme := range identitySchemes {
+		if scheme == self {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("IdentityScheme(%d)", int(self))
+}
+
 type Identity struct {
-	Id   string
-	Cert *x509.Certificate
+	Id          string
+	Cert        *x509.Certificate
+	Scheme      IdentityScheme
+	Observer    bool // observers follow the cluster but never vote or count toward quorum
+	Priority    int  // members with a higher priority are preferred as leader
+	NeverLeader bool // the member votes but never stands for election
 }
 
 func NewIdentity(cert *x509.Certificate) *Identity {
-	rawId := sha256.Sum256(cert.RawTBSCertificate)
+	return NewIdentityWithScheme(cert, CertificateScheme)
+}
+
+func NewIdentityWithScheme(cert *x509.Certificate, scheme IdentityScheme) *Identity {
+	var id string
+
+	switch scheme {
+	case PublicKeyScheme:
+		id = hashId(cert.RawSubjectPublicKeyInfo)
+	case NameScheme:
+		id = cert.Subject.CommonName
+	default:
+		id = hashId(cert.RawTBSCertificate)
+	}
+
+	return &Identity{Id: id, Cert: cert, Scheme: scheme}
+}
+
+func hashId(data []byte) string {
+	rawId := sha256.Sum256(data)
 	var id string
 
 	for _, val := range rawId {
 		id += fmt.Sprintf("%02x", int(val))
 	}
 
-	return &Identity{Id: id, Cert: cert}
+	return id
+}
+
+// Authenticates reports whether a certificate presented by a peer proves that it is this
+// member.  Whatever the scheme, the peer must hold the member's key.
+func (self *Identity) Authenticates(cert *x509.Certificate) bool {
+	return bytes.Equal(self.Cert.RawSubjectPublicKeyInfo, cert.RawSubjectPublicKeyInfo)
+}
+
+// withCert returns a copy of the identity for a replacement certificate
+func (self *Identity) withCert(cert *x509.Certificate) *Identity {
+	identity := *self
+	identity.Cert = cert
+	return &identity
 }
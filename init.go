@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// clusterSpec describes the cluster "go-cluster init" generates
+type clusterSpec struct {
+	addrs    []string // the host:port of each member, which becomes its common name
+	keyType  string   // "ecdsa" or "ed25519"
+	withCA   bool     // sign the member certificates with a generated CA rather than themselves
+	validity time.Duration
+	scheme   IdentityScheme
+	dir      string
+	force    bool // overwrite existing files
+}
+
+func initUsage(flags *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "usage: go-cluster init [options]\n\n")
+	fmt.Fprintf(os.Stderr, "Generates a key and certificate for each member and the membership file listing them.\n\n")
+	fmt.Fprintf(os.Stderr, "options:\n")
+	flags.PrintDefaults()
+}
+
+// runInitCommand implements "go-cluster init", which bootstraps the keys, certificates and
+// membership file for a new cluster
+func runInitCommand(args []string) int {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	members := flags.Int("n", 3, "the number of members, listening on consecutive ports")
+	host := flags.String("host", "localhost", "the host the members listen on")
+	port := flags.Int("port", 2001, "the port the first member listens on")
+	addrs := flags.String("addrs", "", "a comma separated list of member addresses, instead of -n, -host and -port")
+	keyType := flags.String("key-type", "ecdsa", "the type of key to generate: \"ecdsa\" or \"ed25519\"")
+	withCA := flags.Bool("ca", false, "issue the certificates from a generated CA rather than self-signing them")
+	days := flags.Int("days", 365, "how many days the certificates are valid for")
+	identity := flags.String("identity", "certificate", "the identity scheme the members will use, for the identities printed")
+	dir := flags.String("dir", ".", "the directory to write the files to")
+	force := flags.Bool("force", false, "overwrite any existing files")
+	flags.Usage = func() { initUsage(flags) }
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	scheme, err := ParseIdentityScheme(*identity)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 2
+	}
+
+	spec := &clusterSpec{
+		keyType:  *keyType,
+		withCA:   *withCA,
+		validity: time.Duration(*days) * 24 * time.Hour,
+		scheme:   scheme,
+		dir:      *dir,
+		force:    *force,
+	}
+
+	if *addrs != "" {
+		for _, addr := range strings.Split(*addrs, ",") {
+			spec.addrs = append(spec.addrs, strings.TrimSpace(addr))
+		}
+	} else {
+		for i := 0; i < *members; i++ {
+			spec.addrs = append(spec.addrs, fmt.Sprintf("%s:%d", *host, *port+i))
+		}
+	}
+
+	ids, err := spec.generate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	certsPath := filepath.Join(spec.dir, "certs.conf")
+	for i, id := range ids {
+		fmt.Printf("%d\t%s\t%s\n", i, spec.addrs[i], id)
+	}
+	var ca string
+	if spec.withCA {
+		ca = " -ca " + filepath.Join(spec.dir, "ca.pem")
+	}
+
+	fmt.Printf("\nstart each member with:\n")
+	for i := range ids {
+		fmt.Printf("\tgo-cluster -certs %s%s -id %d -key %s -identity %s\n", certsPath, ca, i, spec.keyPath(i), scheme)
+	}
+
+	return 0
+}
+
+func (self *clusterSpec) keyPath(i int) string {
+	return filepath.Join(self.dir, fmt.Sprintf("key%d.pem", i))
+}
+
+// generate writes the membership file, each member's key and, if requested, the CA's
+// certificate and key.  It returns each member's identity.
+func (self *clusterSpec) generate() ([]string, error) {
+	if len(self.addrs) == 0 {
+		return nil, fmt.Errorf("a cluster needs at least one member")
+	}
+
+	seen := make(map[string]bool)
+	for _, addr := range self.addrs {
+		if seen[addr] {
+			return nil, fmt.Errorf("%s appears more than once", addr)
+		}
+		seen[addr] = true
+	}
+
+	files := []string{filepath.Join(self.dir, "certs.conf")}
+	for i := range self.addrs {
+		files = append(files, self.keyPath(i))
+	}
+	if self.withCA {
+		files = append(files, filepath.Join(self.dir, "ca.pem"), filepath.Join(self.dir, "ca-key.pem"))
+	}
+
+	if !self.force {
+		for _, path := range files {
+			if _, err := os.Stat(path); err == nil {
+				return nil, fmt.Errorf("%s already exists", path)
+			}
+		}
+	}
+
+	if err := os.MkdirAll(self.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	var issuer *x509.Certificate
+	var issuerKey crypto.Signer
+
+	if self.withCA {
+		key, err := self.newKey()
+		if err != nil {
+			return nil, err
+		}
+
+		template := &x509.Certificate{
+			Subject:               pkix.Name{CommonName: "go-cluster CA"},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(self.validity),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+
+		if issuer, err = self.issue(template, key.Public(), nil, key); err != nil {
+			return nil, err
+		}
+		issuerKey = key
+
+		if err := writePem(filepath.Join(self.dir, "ca.pem"), "CERTIFICATE", issuer.Raw); err != nil {
+			return nil, err
+		}
+		if err := writeKey(filepath.Join(self.dir, "ca-key.pem"), key); err != nil {
+			return nil, err
+		}
+	}
+
+	var certs []byte
+	var ids []string
+
+	for i, addr := range self.addrs {
+		key, err := self.newKey()
+		if err != nil {
+			return nil, err
+		}
+
+		template := &x509.Certificate{
+			Subject:     pkix.Name{CommonName: addr},
+			NotBefore:   now.Add(-time.Hour),
+			NotAfter:    now.Add(self.validity),
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+
+		signer := issuerKey
+		if signer == nil {
+			signer = key
+		}
+
+		cert, err := self.issue(template, key.Public(), issuer, signer)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := writeKey(self.keyPath(i), key); err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		ids = append(ids, NewIdentityWithScheme(cert, self.scheme).Id)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(self.dir, "certs.conf"), certs, 0644); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (self *clusterSpec) newKey() (crypto.Signer, error) {
+	switch self.keyType {
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unknown key type \"%s\"", self.keyType)
+	}
+}
+
+// issue creates a certificate from the template, self-signed if no issuer is given
+func (self *clusterSpec) issue(template *x509.Certificate, public crypto.PublicKey, issuer *x509.Certificate, key crypto.Signer) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+
+	if issuer == nil {
+		issuer = template
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, public, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+func writeKey(path string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	return writePem(path, "PRIVATE KEY", der)
+}
+
+func writePem(path, kind string, der []byte) error {
+	mode := os.FileMode(0644)
+	if strings.HasSuffix(kind, "PRIVATE KEY") {
+		mode = 0600
+	}
+
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), mode)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInitCluster(t *testing.T) {
+	for _, keyType := range []string{"ecdsa", "ed25519"} {
+		for _, withCA := range []bool{false, true} {
+			dir, err := ioutil.TempDir("", "init")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			spec := &clusterSpec{
+				addrs:    []string{"localhost:3001", "localhost:3002", "localhost:3003"},
+				keyType:  keyType,
+				withCA:   withCA,
+				validity: 24 * time.Hour,
+				scheme:   PublicKeyScheme,
+				dir:      dir,
+			}
+
+			ids, err := spec.generate()
+			assert.Nil(t, err)
+			assert.Equal(t, 3, len(ids))
+
+			// Every member can load its identity from the files written
+			for i, id := range ids {
+				files := &memberFiles{index: i, keyPath: spec.keyPath(i), certsPath: filepath.Join(dir, "certs.conf"), scheme: PublicKeyScheme}
+				if withCA {
+					// Certificates from an untrusted CA are dropped
+					_, _, _, err := files.load()
+					assert.NotNil(t, err)
+
+					files.ca = filepath.Join(dir, "ca.pem")
+				}
+
+				member, tlsCert, members, err := files.load()
+				if !assert.Nil(t, err, "%s ca=%v", keyType, withCA) {
+					continue
+				}
+
+				assert.Equal(t, id, member.Id)
+				assert.Equal(t, spec.addrs[i], member.Cert.Subject.CommonName)
+				assert.Equal(t, 3, len(members))
+				assert.Nil(t, checkKeyPair(member.Cert, tlsCert.PrivateKey))
+				assert.Nil(t, checkValidity(member.Cert, member.Cert.NotBefore.Add(2*time.Hour)))
+
+				if withCA {
+					ca, err := ParseCertificates(filepath.Join(dir, "ca.pem"))
+					assert.Nil(t, err)
+					assert.Nil(t, member.Cert.CheckSignatureFrom(ca[0]))
+				}
+			}
+
+			// Existing files are only replaced when forced
+			_, err = spec.generate()
+			assert.NotNil(t, err)
+
+			spec.force = true
+			_, err = spec.generate()
+			assert.Nil(t, err)
+		}
+	}
+}
+
+func TestInitClusterInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = (&clusterSpec{dir: dir, keyType: "ecdsa"}).generate()
+	assert.NotNil(t, err)
+
+	_, err = (&clusterSpec{dir: dir, keyType: "ecdsa", addrs: []string{"a:1", "a:1"}}).generate()
+	assert.NotNil(t, err)
+
+	_, err = (&clusterSpec{dir: dir, keyType: "dsa", addrs: []string{"a:1"}}).generate()
+	assert.NotNil(t, err)
+}
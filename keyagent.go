@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+)
+
+// KeyAgent holds a private key on behalf of the nodes on this host, which sign with it over
+// a local socket rather than reading the key themselves.  It stands in for a hardware
+// token or signing service.
+type KeyAgent struct {
+	key crypto.Signer
+}
+
+type SignArgs struct {
+	Digest        []byte
+	Hash          crypto.Hash
+	PSS           bool // sign with RSA-PSS rather than PKCS#1 v1.5
+	PSSSaltLength int
+}
+
+type SignReply struct {
+	Signature []byte
+}
+
+type PublicReply struct {
+	PKIX []byte // the public key, DER encoded
+}
+
+func NewKeyAgent(key crypto.Signer) *KeyAgent {
+	return &KeyAgent{key: key}
+}
+
+func (self *KeyAgent) Public(_ int, reply *PublicReply) error {
+	der, err := x509.MarshalPKIXPublicKey(self.key.Public())
+	if err != nil {
+		return err
+	}
+
+	reply.PKIX = der
+	return nil
+}
+
+func (self *KeyAgent) Sign(args SignArgs, reply *SignReply) error {
+	var opts crypto.SignerOpts = args.Hash
+	if args.PSS {
+		opts = &rsa.PSSOptions{SaltLength: args.PSSSaltLength, Hash: args.Hash}
+	}
+
+	signature, err := self.key.Sign(rand.Reader, args.Digest, opts)
+	if err != nil {
+		return err
+	}
+
+	reply.Signature = signature
+	return nil
+}
+
+// Serve answers signing requests on the listener until it is closed
+func (self *KeyAgent) Serve(listener net.Listener) {
+	server := rpc.NewServer()
+	server.RegisterName("KeyAgent", self)
+	server.Accept(listener)
+}
+
+// agentSigner is a crypto.Signer for a key held by a KeyAgent
+type agentSigner struct {
+	client *rpc.Client
+	public crypto.PublicKey
+}
+
+// DialKeyAgent returns a signer for the key held by the agent listening on a unix socket.
+// It is the KeyProvider for keys given as "agent:<socket>".
+func DialKeyAgent(socket string) (crypto.Signer, error) {
+	client, err := rpc.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach key agent \"%s\": %s", socket, err.Error())
+	}
+
+	var reply PublicReply
+	if err := client.Call("KeyAgent.Public", 0, &reply); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	public, err := x509.ParsePKIXPublicKey(reply.PKIX)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &agentSigner{client: client, public: public}, nil
+}
+
+func (self *agentSigner) Public() crypto.PublicKey {
+	return self.public
+}
+
+func (self *agentSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	args := SignArgs{Digest: digest, Hash: opts.HashFunc()}
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		args.PSS = true
+		args.PSSSaltLength = pss.SaltLength
+	}
+
+	var reply SignReply
+	if err := self.client.Call("KeyAgent.Sign", args, &reply); err != nil {
+		return nil, err
+	}
+
+	return reply.Signature, nil
+}
+
+// runAgentCommand implements "go-cluster agent", which serves a key to the nodes on this
+// host, which are given "-key agent:<socket>"
+func runAgentCommand(args []string) int {
+	flags := flag.NewFlagSet("agent", flag.ExitOnError)
+	keyPath := flags.String("key", "key0.pem", "the path to the private key to hold")
+	socket := flags.String("socket", "agent.sock", "the path of the unix socket to listen on")
+	passphraseFile := flags.String("key-passphrase-file", "", "the file holding the passphrase for an encrypted key, if any")
+	passphraseEnv := flags.String("key-passphrase-env", "", "the environment variable holding the passphrase for an encrypted key, if any")
+	flags.Parse(args)
+
+	key, err := LoadPrivateKey(*keyPath, newPassphrase(*passphraseFile, *passphraseEnv))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	listener, err := listenPrivate(*socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	fmt.Printf("holding %s on %s\n", *keyPath, *socket)
+	NewKeyAgent(key).Serve(listener)
+	return 0
+}
+
+// listenPrivate listens on a unix socket that only our user may connect to.  The socket is
+// created in a directory that only we may enter, and only moved into place once it has
+// been chmod-ed, so others can never reach it in between.  A stale socket left at the path
+// is replaced.
+func listenPrivate(path string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".agent")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", private)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(private, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	if err := os.Rename(private, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// newPassphrase returns the passphrase source configured, if any, preferring the file
+func newPassphrase(file, env string) Passphrase {
+	switch {
+	case file != "":
+		return PassphraseFromFile(file)
+	case env != "":
+		return PassphraseFromEnv(env)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,409 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrKeyNotFound     = errors.New("key not found")
+	ErrWatcherOverflow = errors.New("watcher fell too far behind")
+	ErrWatcherReset    = errors.New("store was restored from a snapshot")
+)
+
+// How many undelivered events a watcher may accumulate before it is cancelled
+const watcherBacklog = 1024
+
+type Op int
+
+const (
+	OpPut Op = iota + 1
+	OpDelete
+	OpCompareAndSwap
+	OpExpire
+)
+
+// Command is a mutation submitted through the replicated log.  Now is the leader's clock
+// at the time the command was submitted and is the only notion of time the store uses,
+// which keeps every replica's view of key expiry identical.
+type Command struct {
+	Op       Op            `json:"op"`
+	Key      string        `json:"key,omitempty"`
+	Value    []byte        `json:"value,omitempty"`
+	TTL      time.Duration `json:"ttl,omitempty"`
+	Revision uint64        `json:"revision,omitempty"` // CAS only: the expected revision, or 0 if the key must not exist
+	Now      int64         `json:"now"`
+}
+
+type Result struct {
+	Succeeded bool      `json:"succeeded"`
+	Revision  uint64    `json:"revision"`
+	Previous  *KeyValue `json:"previous,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type KeyValue struct {
+	Key      string `json:"key"`
+	Value    []byte `json:"value"`
+	Created  uint64 `json:"created"`           // the revision at which the key was created
+	Revision uint64 `json:"revision"`          // the revision at which the key was last modified
+	Expires  int64  `json:"expires,omitempty"` // in nanoseconds since the epoch, or 0 for never
+}
+
+type EventType int
+
+const (
+	EventPut EventType = iota + 1
+	EventDelete
+	EventExpire
+)
+
+func (self EventType) String() string {
+	switch self {
+	case EventPut:
+		return "PUT"
+	case EventDelete:
+		return "DELETE"
+	case EventExpire:
+		return "EXPIRE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Event describes a single change.  Every replica produces the same events in the same
+// order, numbered by the revision of the command that caused them.
+type Event struct {
+	Type     EventType `json:"type"`
+	Revision uint64    `json:"revision"`
+	Kv       KeyValue  `json:"kv"`
+}
+
+// Store is a key-value state machine suitable for driving from the replicated log
+type Store struct {
+	mutex    sync.RWMutex
+	data     map[string]*KeyValue
+	revision uint64
+	clock    int64
+	watchers map[*Watcher]bool
+}
+
+type snapshot struct {
+	Revision uint64      `json:"revision"`
+	Clock    int64       `json:"clock"`
+	Keys     []*KeyValue `json:"keys"`
+}
+
+func NewStore() *Store {
+	return &Store{
+		data:     make(map[string]*KeyValue),
+		watchers: make(map[*Watcher]bool),
+	}
+}
+
+// Revision returns the revision of the most recent change
+func (self *Store) Revision() uint64 {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	return self.revision
+}
+
+func (self *Store) live(kv *KeyValue) bool {
+	return kv.Expires == 0 || kv.Expires > self.clock
+}
+
+// Get returns a copy of the current value of key.  Like expiry itself, this goes by the
+// clock of the commands applied so far rather than by wall time: a key is hidden once a
+// later command shows its TTL to have elapsed, even if its expiry has not been applied
+// yet, but until then it is returned however long ago its TTL elapsed.
+func (self *Store) Get(key string) (*KeyValue, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	kv, ok := self.data[key]
+	if !ok || !self.live(kv) {
+		return nil, ErrKeyNotFound
+	}
+
+	c := *kv
+	return &c, nil
+}
+
+// List returns copies of every key with the given prefix in key order
+func (self *Store) List(prefix string) []*KeyValue {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	var result []*KeyValue
+	for key, kv := range self.data {
+		if strings.HasPrefix(key, prefix) && self.live(kv) {
+			c := *kv
+			result = append(result, &c)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+// Expired reports whether any key has a TTL that elapsed before now
+func (self *Store) Expired(now int64) bool {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	for _, kv := range self.data {
+		if kv.Expires != 0 && kv.Expires <= now {
+			return true
+		}
+	}
+
+	return false
+}
+
+//---------------------------------------------------------
+// state machine
+//---------------------------------------------------------
+
+func (self *Store) Apply(command []byte) []byte {
+	var cmd Command
+	var result *Result
+
+	if err := json.Unmarshal(command, &cmd); err != nil {
+		result = &Result{Error: err.Error()}
+	} else {
+		result = self.apply(&cmd)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}
+
+func (self *Store) apply(cmd *Command) *Result {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if cmd.Now > self.clock {
+		self.clock = cmd.Now
+	}
+
+	var events []Event
+	result := &Result{}
+
+	existing, ok := self.data[cmd.Key]
+	if ok && !self.live(existing) {
+		existing, ok = nil, false
+	}
+
+	switch cmd.Op {
+	case OpCompareAndSwap:
+		if (ok && existing.Revision != cmd.Revision) || (!ok && cmd.Revision != 0) {
+			result.Previous = existing
+			break
+		}
+		fallthrough
+	case OpPut:
+		kv := &KeyValue{
+			Key:      cmd.Key,
+			Value:    cmd.Value,
+			Created:  self.revision + 1,
+			Revision: self.revision + 1,
+		}
+		if ok {
+			kv.Created = existing.Created
+		}
+		if cmd.TTL > 0 {
+			kv.Expires = self.clock + int64(cmd.TTL)
+		}
+
+		self.data[cmd.Key] = kv
+		result.Succeeded = true
+		result.Previous = existing
+		events = append(events, Event{Type: EventPut, Kv: *kv})
+	case OpDelete:
+		if ok {
+			delete(self.data, cmd.Key)
+			result.Succeeded = true
+			result.Previous = existing
+			events = append(events, Event{Type: EventDelete, Kv: KeyValue{Key: cmd.Key}})
+		}
+	case OpExpire:
+		var keys []string
+		for key, kv := range self.data {
+			if kv.Expires != 0 && kv.Expires <= self.clock {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			delete(self.data, key)
+			events = append(events, Event{Type: EventExpire, Kv: KeyValue{Key: key}})
+		}
+		result.Succeeded = len(keys) > 0
+	default:
+		result.Error = "unknown operation"
+	}
+
+	if len(events) > 0 {
+		self.revision++
+		for i := range events {
+			events[i].Revision = self.revision
+			if events[i].Type != EventPut {
+				events[i].Kv.Revision = self.revision
+			}
+		}
+		self.notify(events)
+	}
+
+	result.Revision = self.revision
+	return result
+}
+
+func (self *Store) Snapshot() (io.ReadCloser, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	s := &snapshot{Revision: self.revision, Clock: self.clock}
+	for _, kv := range self.data {
+		c := *kv
+		s.Keys = append(s.Keys, &c)
+	}
+	sort.Slice(s.Keys, func(i, j int) bool { return s.Keys[i].Key < s.Keys[j].Key })
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Restore replaces the contents of the store.  The changes between the old and new state
+// are unknown, so every watcher is cancelled with ErrWatcherReset.
+func (self *Store) Restore(r io.Reader) error {
+	var s snapshot
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.data = make(map[string]*KeyValue)
+	for _, kv := range s.Keys {
+		self.data[kv.Key] = kv
+	}
+	self.revision = s.Revision
+	self.clock = s.Clock
+
+	for w := range self.watchers {
+		w.cancel(ErrWatcherReset)
+	}
+	self.watchers = make(map[*Watcher]bool)
+
+	return nil
+}
+
+//---------------------------------------------------------
+// watches
+//---------------------------------------------------------
+
+// Watcher delivers the changes to keys with a given prefix, in revision order
+type Watcher struct {
+	store    *Store
+	prefix   string
+	revision uint64
+	events   chan Event
+	err      error
+}
+
+// Watch begins delivering every change to keys with the given prefix made after the
+// current revision, which is returned by Watcher.Revision.  Events reflect the local
+// replica and so may lag the leader slightly.
+func (self *Store) Watch(prefix string) *Watcher {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	w := &Watcher{
+		store:    self,
+		prefix:   prefix,
+		revision: self.revision,
+		events:   make(chan Event, watcherBacklog),
+	}
+	self.watchers[w] = true
+
+	return w
+}
+
+// notify must be called with the store locked
+func (self *Store) notify(events []Event) {
+	for w := range self.watchers {
+		for _, event := range events {
+			if !strings.HasPrefix(event.Kv.Key, w.prefix) {
+				continue
+			}
+
+			select {
+			case w.events <- event:
+			default:
+				// Dropping an event would silently break ordering guarantees
+				w.cancel(ErrWatcherOverflow)
+				delete(self.watchers, w)
+			}
+
+			if w.err != nil {
+				break
+			}
+		}
+	}
+}
+
+// Revision is the revision of the store when the watch began
+func (self *Watcher) Revision() uint64 {
+	return self.revision
+}
+
+// Events is closed when the watcher stops, after which Err reports why
+func (self *Watcher) Events() <-chan Event {
+	return self.events
+}
+
+// Err must only be called once Events has been closed
+func (self *Watcher) Err() error {
+	return self.err
+}
+
+func (self *Watcher) Close() {
+	self.store.mutex.Lock()
+	defer self.store.mutex.Unlock()
+
+	if self.store.watchers[self] {
+		delete(self.store.watchers, self)
+		self.cancel(nil)
+	}
+}
+
+// cancel must be called with the store locked
+func (self *Watcher) cancel(err error) {
+	self.err = err
+	close(self.events)
+}
@@ -0,0 +1,171 @@
+package kv
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func apply(t *testing.T, store *Store, cmd *Command) *Result {
+	data, err := json.Marshal(cmd)
+	assert.Nil(t, err)
+
+	var result Result
+	assert.Nil(t, json.Unmarshal(store.Apply(data), &result))
+	return &result
+}
+
+func TestStorePutGetDelete(t *testing.T) {
+	store := NewStore()
+
+	_, err := store.Get("a")
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	result := apply(t, store, &Command{Op: OpPut, Key: "a", Value: []byte("1")})
+	assert.True(t, result.Succeeded)
+	assert.Equal(t, uint64(1), result.Revision)
+
+	result = apply(t, store, &Command{Op: OpPut, Key: "a", Value: []byte("2")})
+	assert.Equal(t, uint64(2), result.Revision)
+	assert.Equal(t, "1", string(result.Previous.Value))
+
+	kv, err := store.Get("a")
+	assert.Nil(t, err)
+	assert.Equal(t, "2", string(kv.Value))
+	assert.Equal(t, uint64(1), kv.Created)
+	assert.Equal(t, uint64(2), kv.Revision)
+
+	assert.True(t, apply(t, store, &Command{Op: OpDelete, Key: "a"}).Succeeded)
+	assert.False(t, apply(t, store, &Command{Op: OpDelete, Key: "a"}).Succeeded)
+	assert.Equal(t, uint64(3), store.Revision())
+
+	_, err = store.Get("a")
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.NotEmpty(t, apply(t, store, &Command{Op: Op(99)}).Error)
+}
+
+func TestStoreCompareAndSwap(t *testing.T) {
+	store := NewStore()
+
+	cases := []struct {
+		revision  uint64
+		succeeded bool
+	}{
+		{1, false}, // the key doesn't exist yet
+		{0, true},  // so creating it succeeds
+		{0, false}, // but only once
+		{2, false}, // revisions must match exactly
+		{1, true},
+		{1, false},
+	}
+
+	for i, c := range cases {
+		result := apply(t, store, &Command{Op: OpCompareAndSwap, Key: "k", Value: []byte("v"), Revision: c.revision})
+		assert.Equal(t, c.succeeded, result.Succeeded, "case %d", i)
+	}
+
+	assert.Equal(t, uint64(2), store.Revision())
+}
+
+func TestStoreTTL(t *testing.T) {
+	store := NewStore()
+	now := time.Now().UnixNano()
+
+	apply(t, store, &Command{Op: OpPut, Key: "lease", TTL: time.Second, Now: now})
+	apply(t, store, &Command{Op: OpPut, Key: "forever", Now: now})
+
+	assert.False(t, store.Expired(now))
+	assert.True(t, store.Expired(now+int64(time.Second)))
+
+	// Expiry is driven only by the clock carried in commands
+	_, err := store.Get("lease")
+	assert.Nil(t, err)
+
+	w := store.Watch("")
+	defer w.Close()
+
+	result := apply(t, store, &Command{Op: OpExpire, Now: now + int64(2*time.Second)})
+	assert.True(t, result.Succeeded)
+
+	_, err = store.Get("lease")
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = store.Get("forever")
+	assert.Nil(t, err)
+
+	event := <-w.Events()
+	assert.Equal(t, EventExpire, event.Type)
+	assert.Equal(t, "lease", event.Kv.Key)
+
+	// An elapsed key that hasn't been reaped yet is treated as absent
+	apply(t, store, &Command{Op: OpPut, Key: "short", TTL: time.Second, Now: now + int64(2*time.Second)})
+	apply(t, store, &Command{Op: OpPut, Key: "other", Now: now + int64(4*time.Second)})
+	_, err = store.Get("short")
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.True(t, apply(t, store, &Command{Op: OpCompareAndSwap, Key: "short", Now: now + int64(4*time.Second)}).Succeeded)
+}
+
+func TestStoreWatchOrder(t *testing.T) {
+	store := NewStore()
+	apply(t, store, &Command{Op: OpPut, Key: "a/0"})
+
+	w := store.Watch("a/")
+	assert.Equal(t, uint64(1), w.Revision())
+
+	apply(t, store, &Command{Op: OpPut, Key: "a/1", Value: []byte("x")})
+	apply(t, store, &Command{Op: OpPut, Key: "b/1", Value: []byte("y")})
+	apply(t, store, &Command{Op: OpDelete, Key: "a/0"})
+
+	event := <-w.Events()
+	assert.Equal(t, EventPut, event.Type)
+	assert.Equal(t, uint64(2), event.Revision)
+	assert.Equal(t, "x", string(event.Kv.Value))
+
+	event = <-w.Events()
+	assert.Equal(t, EventDelete, event.Type)
+	assert.Equal(t, uint64(4), event.Revision)
+	assert.Equal(t, "a/0", event.Kv.Key)
+
+	w.Close()
+	_, ok := <-w.Events()
+	assert.False(t, ok)
+	assert.Nil(t, w.Err())
+}
+
+func TestStoreWatchOverflow(t *testing.T) {
+	store := NewStore()
+	w := store.Watch("")
+
+	for i := 0; i <= watcherBacklog; i++ {
+		apply(t, store, &Command{Op: OpPut, Key: "k"})
+	}
+
+	for range w.Events() {
+	}
+	assert.Equal(t, ErrWatcherOverflow, w.Err())
+
+	// Closing a cancelled watcher is harmless
+	w.Close()
+}
+
+func TestStoreSnapshotRestore(t *testing.T) {
+	store := NewStore()
+	apply(t, store, &Command{Op: OpPut, Key: "a", Value: []byte("1")})
+	apply(t, store, &Command{Op: OpPut, Key: "b", Value: []byte("2"), TTL: time.Second})
+
+	snapshot, err := store.Snapshot()
+	assert.Nil(t, err)
+	defer snapshot.Close()
+
+	other := NewStore()
+	w := other.Watch("")
+
+	assert.Nil(t, other.Restore(snapshot))
+	assert.Equal(t, store.List(""), other.List(""))
+	assert.Equal(t, uint64(2), other.Revision())
+
+	for range w.Events() {
+	}
+	assert.Equal(t, ErrWatcherReset, w.Err())
+}
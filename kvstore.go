@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ghaskins/go-cluster/kv"
+	"github.com/ghaskins/go-cluster/pb"
+	"time"
+)
+
+const (
+	kvUpdateMethod = "kv.update"
+	kvGetMethod    = "kv.get"
+
+	// How often the leader checks for keys whose TTL has elapsed
+	expiryInterval = time.Second
+)
+
+// KV is a replicated key-value store driven by the cluster's replicated log.  Updates and
+// reads are serviced by the leader and are linearizable; watches are serviced by the
+// local replica.
+type KV struct {
+	node  *Node
+	store *kv.Store
+}
+
+// NewKV installs a key-value store as the node's state machine.  It must be called before
+// the node is Run.
+func NewKV(node *Node) *KV {
+	self := &KV{
+		node:  node,
+		store: kv.NewStore(),
+	}
+
+	node.SetStateMachine(self.store)
+	node.HandleCall(kvUpdateMethod, self.serveUpdate)
+	node.HandleCall(kvGetMethod, self.serveGet)
+
+	go self.expire()
+
+	return self
+}
+
+// Get returns the current value of key, or kv.ErrKeyNotFound
+func (self *KV) Get(ctx context.Context, key string) (*kv.KeyValue, error) {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+
+	resp, err := self.node.CallLeader(ctx, kvGetMethod, []byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) == 0 {
+		return nil, kv.ErrKeyNotFound
+	}
+
+	var result kv.KeyValue
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Put sets the value of key, returning the new revision.  A key with a non-zero ttl is
+// deleted once the ttl elapses unless it is updated again first.
+func (self *KV) Put(ctx context.Context, key string, value []byte, ttl time.Duration) (uint64, error) {
+	result, err := self.update(ctx, &kv.Command{Op: kv.OpPut, Key: key, Value: value, TTL: ttl})
+	if err != nil {
+		return 0, err
+	}
+
+	return result.Revision, nil
+}
+
+// Delete removes key, reporting whether it existed
+func (self *KV) Delete(ctx context.Context, key string) (bool, error) {
+	result, err := self.update(ctx, &kv.Command{Op: kv.OpDelete, Key: key})
+	if err != nil {
+		return false, err
+	}
+
+	return result.Succeeded, nil
+}
+
+// CompareAndSwap sets the value of key only if it was last modified at revision, or if
+// revision is 0 and the key does not exist.  It returns whether the swap succeeded along
+// with the revision of the store afterwards.
+func (self *KV) CompareAndSwap(ctx context.Context, key string, revision uint64, value []byte, ttl time.Duration) (bool, uint64, error) {
+	result, err := self.update(ctx, &kv.Command{Op: kv.OpCompareAndSwap, Key: key, Revision: revision, Value: value, TTL: ttl})
+	if err != nil {
+		return false, 0, err
+	}
+
+	return result.Succeeded, result.Revision, nil
+}
+
+// Watch delivers every subsequent change to keys with the given prefix, as applied by
+// this replica.  The caller must Close the watcher when finished with it.
+func (self *KV) Watch(prefix string) *kv.Watcher {
+	return self.store.Watch(prefix)
+}
+
+func (self *KV) update(ctx context.Context, cmd *kv.Command) (*kv.Result, error) {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+
+	request, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := self.node.CallLeader(ctx, kvUpdateMethod, request)
+	if err != nil {
+		return nil, err
+	}
+
+	var result kv.Result
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return nil, err
+	}
+
+	if result.Error != "" {
+		return nil, &RpcError{Status: pb.Status_ERROR, Message: result.Error}
+	}
+
+	return &result, nil
+}
+
+// serveUpdate stamps a command with the leader's clock before committing it, so that
+// every replica agrees on when keys expire
+func (self *KV) serveUpdate(ctx context.Context, from string, request []byte) ([]byte, error) {
+	if self.node.Leader().Leader != self.node.Id() {
+		return nil, ErrNotLeader
+	}
+
+	var cmd kv.Command
+	if err := json.Unmarshal(request, &cmd); err != nil {
+		return nil, err
+	}
+
+	cmd.Now = time.Now().UnixNano()
+
+	stamped, err := json.Marshal(&cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return self.node.Replicate(ctx, stamped)
+}
+
+func (self *KV) serveGet(ctx context.Context, from string, request []byte) ([]byte, error) {
+	if err := self.node.LinearizableRead(ctx); err != nil {
+		return nil, err
+	}
+
+	result, err := self.store.Get(string(request))
+	if err == kv.ErrKeyNotFound {
+		return nil, nil
+	}
+
+	return json.Marshal(result)
+}
+
+// expire periodically commits the removal of keys whose TTL has elapsed, until the node
+// is stopped.  Only the leader does so, using its own clock.
+func (self *KV) expire() {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-self.node.Done():
+			return
+		}
+
+		now := time.Now().UnixNano()
+
+		if self.node.Leader().Leader != self.node.Id() || !self.store.Expired(now) {
+			continue
+		}
+
+		request, err := json.Marshal(&kv.Command{Op: kv.OpExpire, Now: now})
+		if err != nil {
+			panic(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), expiryInterval)
+		if _, err := self.node.Replicate(ctx, request); err != nil {
+			fmt.Printf("KV: failed to expire keys: %s\n", err.Error())
+		}
+		cancel()
+	}
+}
+
+func withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, DefaultProposalTimeout)
+}
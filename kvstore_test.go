@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/ghaskins/go-cluster/kv"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+type testMember struct {
+	node *Node
+	kv   *KV
+	done chan struct{} // closed once Run returns
+}
+
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
+// newTestKVCluster runs a cluster of the given size over loopback, each member serving a
+// key-value store, and waits for it to elect a leader
+func newTestKVCluster(t *testing.T, size int) []*testMember {
+	members := IdentityMap{}
+	var ids []*Identity
+	var certs []*tls.Certificate
+
+	for i := 0; i < size; i++ {
+		cert, tlsCert := newTestCertificate(t, freeAddr(t))
+		id := NewIdentity(cert)
+
+		members[id.Id] = id
+		ids = append(ids, id)
+		certs = append(certs, tlsCert)
+	}
+
+	var cluster []*testMember
+	for i, id := range ids {
+		node := NewNode(id, certs[i], members)
+		m := &testMember{node: node, kv: NewKV(node), done: make(chan struct{})}
+
+		go func() {
+			node.Run()
+			close(m.done)
+		}()
+		t.Cleanup(node.Stop)
+
+		cluster = append(cluster, m)
+	}
+
+	assert.Eventually(t, func() bool {
+		leader := cluster[0].node.Leader().Leader
+		for _, m := range cluster {
+			if m.node.Leader().Leader == "" || m.node.Leader().Leader != leader {
+				return false
+			}
+		}
+		return true
+	}, 20*time.Second, 10*time.Millisecond, "no leader was elected")
+
+	return cluster
+}
+
+func TestKVExpiry(t *testing.T) {
+	cluster := newTestKVCluster(t, 2)
+	ctx := context.Background()
+
+	_, err := cluster[0].kv.Put(ctx, "lease", []byte("held"), time.Second)
+	assert.Nil(t, err)
+
+	result, err := cluster[1].kv.Get(ctx, "lease")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "held", string(result.Value))
+	}
+
+	// The leader expires the key once its TTL has elapsed
+	assert.Eventually(t, func() bool {
+		_, err := cluster[1].kv.Get(ctx, "lease")
+		return err == kv.ErrKeyNotFound
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// Stopping a member ends its Run, along with the work of its store
+	for _, m := range cluster {
+		m.node.Stop()
+
+		select {
+		case <-m.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s did not stop", m.node.Id())
+		}
+	}
+}
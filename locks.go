@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ghaskins/go-cluster/pb"
+	"sync"
+	"time"
+)
+
+const (
+	acquireMethod = "lock.acquire"
+	releaseMethod = "lock.release"
+)
+
+// How long the leader waits for a disconnected member to return before releasing the
+// locks it holds
+const DefaultLockGracePeriod = 10 * time.Second
+
+// FencingToken identifies a single grant of a lock or semaphore.  Tokens are ordered: any
+// grant made after another carries a greater token, even across changes of leadership,
+// because the lock table only lives as long as the view that created it.  Downstream
+// systems should reject requests carrying a token older than the newest they have seen.
+type FencingToken struct {
+	View     int64  `json:"view"`
+	Sequence uint64 `json:"sequence"`
+}
+
+// Compare returns -1, 0 or 1 as the token is older than, equal to, or newer than other
+func (self FencingToken) Compare(other FencingToken) int {
+	switch {
+	case self.View < other.View:
+		return -1
+	case self.View > other.View:
+		return 1
+	case self.Sequence < other.Sequence:
+		return -1
+	case self.Sequence > other.Sequence:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Supersedes reports whether the token was issued after other
+func (self FencingToken) Supersedes(other FencingToken) bool {
+	return self.Compare(other) > 0
+}
+
+func (self FencingToken) String() string {
+	return fmt.Sprintf("%d.%d", self.View, self.Sequence)
+}
+
+// Lease represents a held lock or semaphore slot
+type Lease struct {
+	Name  string
+	Token FencingToken
+	id    string
+	lost  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Lost is closed if the lease may have been revoked because leadership changed or the
+// lease was released.  A holder should stop relying on the lease once it is closed.
+func (self *Lease) Lost() <-chan struct{} {
+	return self.lost
+}
+
+type acquireRequest struct {
+	Name  string `json:"name"`
+	Limit int    `json:"limit"`
+	Id    string `json:"id"`
+}
+
+type releaseRequest struct {
+	Name string `json:"name"`
+	Id   string `json:"id"`
+}
+
+//---------------------------------------------------------
+// client API
+//---------------------------------------------------------
+
+// Lock blocks until this node holds the named lock or ctx ends
+func (self *Node) Lock(ctx context.Context, name string) (*Lease, error) {
+	return self.Acquire(ctx, name, 1)
+}
+
+// Unlock releases a lock obtained from Lock
+func (self *Node) Unlock(ctx context.Context, lease *Lease) error {
+	return self.Release(ctx, lease)
+}
+
+// Acquire blocks until this node holds one of the limit slots of the named semaphore, or
+// ctx ends.  Every holder of a semaphore must agree on its limit.  Slots are granted in
+// the order they were requested.
+func (self *Node) Acquire(ctx context.Context, name string, limit int) (*Lease, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	request, err := json.Marshal(&acquireRequest{Name: name, Limit: limit, Id: hex.EncodeToString(id)})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := self.CallLeader(ctx, acquireMethod, request)
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &Lease{
+		Name: name,
+		id:   hex.EncodeToString(id),
+		lost: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err := json.Unmarshal(resp, &lease.Token); err != nil {
+		return nil, err
+	}
+
+	go self.monitorLease(lease)
+
+	return lease, nil
+}
+
+// Release gives up a lease obtained from Acquire.  Releasing a lease that has already
+// been lost is not an error.
+func (self *Node) Release(ctx context.Context, lease *Lease) error {
+	lease.once.Do(func() { close(lease.done) })
+
+	if self.controller.Leader().View != lease.Token.View {
+		// The leader that granted the lease is gone, and the lease with it
+		return nil
+	}
+
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+
+	request, err := json.Marshal(&releaseRequest{Name: lease.Name, Id: lease.id})
+	if err != nil {
+		return err
+	}
+
+	_, err = self.CallLeader(ctx, releaseMethod, request)
+	return err
+}
+
+func (self *Node) monitorLease(lease *Lease) {
+	defer close(lease.lost)
+
+	for {
+		leadership := self.controller.Leader()
+		if leadership.View != lease.Token.View || leadership.Leader == "" {
+			return
+		}
+
+		select {
+		case <-leadership.Changed:
+		case <-lease.done:
+			return
+		}
+	}
+}
+
+//---------------------------------------------------------
+// leader
+//---------------------------------------------------------
+
+type lockHolder struct {
+	member string
+	token  FencingToken
+}
+
+type lockWaiter struct {
+	member  string
+	id      string
+	granted chan FencingToken
+}
+
+type semaphore struct {
+	limit   int
+	holders map[string]*lockHolder // by request id
+	waiters []*lockWaiter
+}
+
+// lockManager keeps the table of locks on the leader.  It is discarded whenever the view
+// changes, so a new leader always starts with every lock free.
+type lockManager struct {
+	node       *Node
+	grace      time.Duration
+	mutex      sync.Mutex
+	view       int64
+	sequence   uint64
+	semaphores map[string]*semaphore
+	monitored  map[string]bool
+	reset      chan struct{} // closed when the table is discarded
+}
+
+func newLockManager(node *Node) *lockManager {
+	return &lockManager{
+		node:       node,
+		grace:      DefaultLockGracePeriod,
+		semaphores: make(map[string]*semaphore),
+		monitored:  make(map[string]bool),
+		reset:      make(chan struct{}),
+	}
+}
+
+// SetLockGracePeriod configures how long a member may be disconnected before the leader
+// releases its locks.  It must be called before Run.
+func (self *Node) SetLockGracePeriod(grace time.Duration) {
+	self.locks.grace = grace
+}
+
+// run discards the lock table whenever leadership changes
+func (self *lockManager) run() {
+	for {
+		leadership := self.node.controller.Leader()
+
+		self.mutex.Lock()
+		self.sync(leadership)
+		self.mutex.Unlock()
+
+		select {
+		case <-leadership.Changed:
+		case <-self.node.Done():
+			return
+		}
+	}
+}
+
+// sync must be called with the manager locked.  It returns false if we are not the
+// leader.
+func (self *lockManager) sync(leadership Leadership) bool {
+	if leadership.View != self.view || leadership.Leader != self.node.Id() {
+		if len(self.semaphores) > 0 {
+			fmt.Printf("LOCKS: discarding %d locks from view %d\n", len(self.semaphores), self.view)
+		}
+
+		close(self.reset)
+		self.reset = make(chan struct{})
+		self.semaphores = make(map[string]*semaphore)
+		self.monitored = make(map[string]bool)
+		self.sequence = 0
+		self.view = leadership.View
+	}
+
+	return leadership.Leader == self.node.Id()
+}
+
+func (self *lockManager) serveAcquire(ctx context.Context, from string, data []byte) ([]byte, error) {
+	var request acquireRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, err
+	}
+
+	if request.Limit < 1 {
+		return nil, &RpcError{Status: pb.Status_ERROR, Message: "semaphore limit must be positive"}
+	}
+
+	self.mutex.Lock()
+
+	if !self.sync(self.node.controller.Leader()) {
+		self.mutex.Unlock()
+		return nil, ErrNotLeader
+	}
+
+	sem, ok := self.semaphores[request.Name]
+	if !ok {
+		sem = &semaphore{limit: request.Limit, holders: make(map[string]*lockHolder)}
+		self.semaphores[request.Name] = sem
+	}
+
+	if sem.limit != request.Limit {
+		self.mutex.Unlock()
+		return nil, &RpcError{Status: pb.Status_ERROR, Message: fmt.Sprintf("%s has a limit of %d", request.Name, sem.limit)}
+	}
+
+	// The caller may be retrying a request that we already granted
+	if holder, ok := sem.holders[request.Id]; ok {
+		self.mutex.Unlock()
+		return json.Marshal(&holder.token)
+	}
+
+	waiter := &lockWaiter{member: from, id: request.Id, granted: make(chan FencingToken, 1)}
+	sem.waiters = append(sem.waiters, waiter)
+	self.promote(sem)
+
+	reset := self.reset
+	self.mutex.Unlock()
+
+	select {
+	case token := <-waiter.granted:
+		return json.Marshal(&token)
+	case <-reset:
+		return nil, ErrNotLeader
+	case <-ctx.Done():
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.reset == reset {
+		self.cancelWaiter(request.Name, sem, waiter)
+	}
+
+	return nil, ctx.Err()
+}
+
+func (self *lockManager) serveRelease(ctx context.Context, from string, data []byte) ([]byte, error) {
+	var request releaseRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, err
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if !self.sync(self.node.controller.Leader()) {
+		return nil, ErrNotLeader
+	}
+
+	if sem, ok := self.semaphores[request.Name]; ok {
+		delete(sem.holders, request.Id)
+		self.promote(sem)
+		self.prune(request.Name, sem)
+	}
+
+	return nil, nil
+}
+
+// promote grants free slots to waiters in order.  It must be called with the manager
+// locked.
+func (self *lockManager) promote(sem *semaphore) {
+	for len(sem.waiters) > 0 && len(sem.holders) < sem.limit {
+		waiter := sem.waiters[0]
+		sem.waiters = sem.waiters[1:]
+
+		self.sequence++
+		token := FencingToken{View: self.view, Sequence: self.sequence}
+
+		sem.holders[waiter.id] = &lockHolder{member: waiter.member, token: token}
+		waiter.granted <- token
+
+		self.monitor(waiter.member)
+	}
+}
+
+// cancelWaiter withdraws a request whose caller gave up.  If it was granted in the
+// meantime, the grant is undone.
+func (self *lockManager) cancelWaiter(name string, sem *semaphore, waiter *lockWaiter) {
+	for i, w := range sem.waiters {
+		if w == waiter {
+			sem.waiters = append(sem.waiters[:i], sem.waiters[i+1:]...)
+			break
+		}
+	}
+
+	delete(sem.holders, waiter.id)
+	self.promote(sem)
+	self.prune(name, sem)
+}
+
+func (self *lockManager) prune(name string, sem *semaphore) {
+	if len(sem.holders) == 0 && len(sem.waiters) == 0 {
+		delete(self.semaphores, name)
+	}
+}
+
+// holds must be called with the manager locked
+func (self *lockManager) holds(member string) bool {
+	for _, sem := range self.semaphores {
+		for _, holder := range sem.holders {
+			if holder.member == member {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// monitor watches the connection to a member that holds locks.  It must be called with
+// the manager locked.
+func (self *lockManager) monitor(member string) {
+	if member == self.node.Id() || self.monitored[member] {
+		return
+	}
+
+	self.monitored[member] = true
+	go self.monitorMember(member, self.reset)
+}
+
+func (self *lockManager) connected(member string) (*Peer, bool) {
+	peer, ok := self.node.controller.getPeer(member)
+	return peer, ok && !peer.closed()
+}
+
+func (self *lockManager) monitorMember(member string, reset chan struct{}) {
+	for {
+		if peer, ok := self.connected(member); ok {
+			select {
+			case <-peer.Done():
+			case <-reset:
+				return
+			}
+		}
+
+		// Give the member a chance to reconnect before we take its locks away
+		select {
+		case <-time.After(self.grace):
+		case <-reset:
+			return
+		}
+
+		self.mutex.Lock()
+
+		if self.reset != reset {
+			self.mutex.Unlock()
+			return
+		}
+
+		if _, ok := self.connected(member); ok && self.holds(member) {
+			self.mutex.Unlock()
+			continue
+		}
+
+		delete(self.monitored, member)
+		self.releaseMember(member)
+		self.mutex.Unlock()
+		return
+	}
+}
+
+// releaseMember must be called with the manager locked
+func (self *lockManager) releaseMember(member string) {
+	for name, sem := range self.semaphores {
+		released := false
+		for id, holder := range sem.holders {
+			if holder.member == member {
+				fmt.Printf("LOCKS: releasing %s held by disconnected member %s\n", name, member)
+				delete(sem.holders, id)
+				released = true
+			}
+		}
+
+		if released {
+			self.promote(sem)
+			self.prune(name, sem)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestLeader(t *testing.T, self string, members ...string) *Node {
+	node := &Node{
+		id:         &Identity{Id: self},
+		controller: newTestController(self, members...),
+		router:     NewRouter(),
+	}
+	node.locks = newLockManager(node)
+
+	setLeadership(node, self, 1)
+
+	return node
+}
+
+func setLeadership(node *Node, leader string, view int64) {
+	c := node.controller
+
+	c.leaderLock.Lock()
+	defer c.leaderLock.Unlock()
+
+	close(c.leaderChanged)
+	c.leaderChanged = make(chan struct{})
+	c.leadership = Leadership{Leader: leader, View: view, Quorum: true, Changed: c.leaderChanged}
+}
+
+type acquireOutcome struct {
+	token FencingToken
+	err   error
+}
+
+func acquireAsync(node *Node, ctx context.Context, from, name string, limit int, id string) chan acquireOutcome {
+	result := make(chan acquireOutcome, 1)
+
+	go func() {
+		request, _ := json.Marshal(&acquireRequest{Name: name, Limit: limit, Id: id})
+		resp, err := node.locks.serveAcquire(ctx, from, request)
+
+		var outcome acquireOutcome
+		outcome.err = err
+		if err == nil {
+			json.Unmarshal(resp, &outcome.token)
+		}
+		result <- outcome
+	}()
+
+	return result
+}
+
+func release(t *testing.T, node *Node, name, id string) {
+	request, _ := json.Marshal(&releaseRequest{Name: name, Id: id})
+	_, err := node.locks.serveRelease(context.Background(), "A", request)
+	assert.Nil(t, err)
+}
+
+func granted(t *testing.T, result chan acquireOutcome) FencingToken {
+	select {
+	case outcome := <-result:
+		assert.Nil(t, outcome.err)
+		return outcome.token
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock was not granted")
+		return FencingToken{}
+	}
+}
+
+func blocked(result chan acquireOutcome) bool {
+	select {
+	case <-result:
+		return false
+	case <-time.After(50 * time.Millisecond):
+		return true
+	}
+}
+
+func TestFencingTokenOrder(t *testing.T) {
+	cases := []struct {
+		a, b     FencingToken
+		expected int
+	}{
+		{FencingToken{1, 1}, FencingToken{1, 1}, 0},
+		{FencingToken{1, 2}, FencingToken{1, 1}, 1},
+		{FencingToken{1, 9}, FencingToken{2, 1}, -1},
+		{FencingToken{3, 1}, FencingToken{2, 9}, 1},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, c.a.Compare(c.b), "%s vs %s", c.a, c.b)
+		assert.Equal(t, c.expected > 0, c.a.Supersedes(c.b))
+	}
+}
+
+func TestLockMutualExclusion(t *testing.T) {
+	node := newTestLeader(t, "A", "B", "C")
+	ctx := context.Background()
+
+	first := granted(t, acquireAsync(node, ctx, "A", "l", 1, "1"))
+
+	second := acquireAsync(node, ctx, "A", "l", 1, "2")
+	assert.True(t, blocked(second))
+	third := acquireAsync(node, ctx, "A", "l", 1, "3")
+	assert.True(t, blocked(third))
+
+	// A retried request is granted the same token
+	assert.Equal(t, first, granted(t, acquireAsync(node, ctx, "A", "l", 1, "1")))
+
+	// Disagreeing about the limit is an error
+	outcome := <-acquireAsync(node, ctx, "A", "l", 2, "4")
+	assert.NotNil(t, outcome.err)
+
+	release(t, node, "l", "1")
+	token := granted(t, second)
+	assert.True(t, token.Supersedes(first))
+
+	release(t, node, "l", "2")
+	assert.True(t, granted(t, third).Supersedes(token))
+}
+
+func TestSemaphoreLimit(t *testing.T) {
+	node := newTestLeader(t, "A", "B", "C")
+	ctx := context.Background()
+
+	granted(t, acquireAsync(node, ctx, "A", "s", 2, "1"))
+	granted(t, acquireAsync(node, ctx, "A", "s", 2, "2"))
+
+	waiting := acquireAsync(node, ctx, "A", "s", 2, "3")
+	assert.True(t, blocked(waiting))
+
+	// A caller that gives up leaves the queue
+	cancelled, cancel := context.WithCancel(ctx)
+	abandoned := acquireAsync(node, cancelled, "A", "s", 2, "4")
+	assert.True(t, blocked(abandoned))
+	cancel()
+	assert.Equal(t, context.Canceled, (<-abandoned).err)
+
+	release(t, node, "s", "1")
+	granted(t, waiting)
+
+	node.locks.mutex.Lock()
+	assert.Len(t, node.locks.semaphores["s"].holders, 2)
+	assert.Empty(t, node.locks.semaphores["s"].waiters)
+	node.locks.mutex.Unlock()
+}
+
+func TestLockReleasedAfterGracePeriod(t *testing.T) {
+	node := newTestLeader(t, "A", "B", "C")
+	node.SetLockGracePeriod(10 * time.Millisecond)
+	ctx := context.Background()
+
+	// B is not connected, so its lock is reclaimed once the grace period expires
+	held := granted(t, acquireAsync(node, ctx, "B", "l", 1, "1"))
+	token := granted(t, acquireAsync(node, ctx, "A", "l", 1, "2"))
+	assert.True(t, token.Supersedes(held))
+}
+
+func TestLocksDiscardedOnViewChange(t *testing.T) {
+	node := newTestLeader(t, "A", "B", "C")
+	ctx := context.Background()
+
+	first := granted(t, acquireAsync(node, ctx, "A", "l", 1, "1"))
+	waiting := acquireAsync(node, ctx, "A", "l", 1, "2")
+	assert.True(t, blocked(waiting))
+
+	// We are deposed, then elected again in a later view
+	go node.locks.run()
+	setLeadership(node, "", 1)
+	assert.Equal(t, ErrNotLeader, (<-waiting).err)
+
+	setLeadership(node, "A", 2)
+
+	token := granted(t, acquireAsync(node, ctx, "A", "l", 1, "3"))
+	assert.True(t, token.Supersedes(first))
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/ghaskins/go-cluster/pb"
+	"github.com/golang/protobuf/proto"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// How long CallLeader waits before retrying when the leader is known but unreachable
+const leaderRetryInterval = 100 * time.Millisecond
+
+// The days before a member's certificate expires at which we warn, by default
+var defaultExpiryThresholds = []int{30, 7, 1}
+
+var (
+	ErrPeerNotConnected = errors.New("peer is not connected")
+	ErrNotLeader        = errors.New("not the leader")
+	ErrNoQuorum         = errors.New("no quorum")
+	ErrStopped          = errors.New("node is stopped")
+	ErrNoBarrierQuorum  = errors.New("too few members can confirm a barrier")
+)
+
+// Node is the application-facing handle on a cluster member
+type Node struct {
+	id         *Identity
+	connMgr    *ConnectionManager
+	controller *Controller
+	router     *Router
+	locks      *lockManager
+	expiry     *expiryMonitor
+	done       chan struct{} // closed once the node is stopped
+	stopOnce   sync.Once
+}
+
+func NewNode(self *Identity, tlsCert *tls.Certificate, members IdentityMap) *Node {
+	peers := IdentityMap{}
+
+	for id, member := range members {
+		peers[id] = member
+	}
+
+	delete(peers, self.Id) // peers are all members _except_ ourselves
+
+	router := NewRouter()
+	connMgr := NewConnectionManager(self, tlsCert, peers)
+
+	node := &Node{
+		id:         self,
+		connMgr:    connMgr,
+		controller: NewController(self.Id, members, connMgr, router),
+		router:     router,
+		expiry:     newExpiryMonitor(defaultExpiryThresholds),
+		done:       make(chan struct{}),
+	}
+
+	node.controller.done = node.done
+
+	node.locks = newLockManager(node)
+
+	router.HandleCall(replicateMethod, node.serveReplicate)
+	router.HandleCall(acquireMethod, node.locks.serveAcquire)
+	router.HandleCall(releaseMethod, node.locks.serveRelease)
+
+	return node
+}
+
+func (self *Node) Id() string {
+	return self.id.Id
+}
+
+// SetStateDir configures the directory in which the node persists the state it needs to
+// survive a restart: the latest election view and the replicated log.  Without one, the
+// log is held in memory only and a restarted member rejoins with an empty log, so
+// committed entries survive only as long as a quorum of members keeps running.  It must
+// be called before Run.
+func (self *Node) SetStateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	if err := self.controller.restoreView(newViewStore(filepath.Join(dir, "view"))); err != nil {
+		return err
+	}
+
+	return self.controller.replicator.restoreLog(filepath.Join(dir, "log"))
+}
+
+// EnableSignatures signs the votes and heartbeats this node originates with its
+// certificate key, and refuses any from other members that are not signed.  Every member
+// must enable signatures for the cluster to function.  It must be called before Run.
+func (self *Node) EnableSignatures() error {
+	signer, err := newSigner(self.Id(), self.connMgr.cert.PrivateKey, self.controller.peers)
+	if err != nil {
+		return err
+	}
+
+	self.controller.enableSignatures(signer)
+	return nil
+}
+
+// EnableByzantine elects leaders in a way that tolerates as many byzantine members as the
+// membership allows: f out of 3f+1 voters.  Votes and heartbeats are signed, a quorum is
+// 2f+1 voters, and a member that votes for two candidates in one view is reported.  Every
+// member must enable it, and it must be called before Run.
+func (self *Node) EnableByzantine() error {
+	if self.controller.signer == nil {
+		if err := self.EnableSignatures(); err != nil {
+			return err
+		}
+	}
+
+	return self.controller.enableByzantine()
+}
+
+// HandleEquivocation registers the handler notified with the evidence whenever a member is
+// caught voting for two candidates in the same view.  Equivocation can only be detected
+// when signatures are enabled.  It must be called before Run.
+func (self *Node) HandleEquivocation(handler EquivocationHandler) {
+	self.controller.onEquivocate = handler
+}
+
+// SetQuarantine disconnects a member caught equivocating and refuses to connect with it
+// again until the cooldown expires.  A zero cooldown, the default, disables quarantine.
+// It must be called before Run.
+func (self *Node) SetQuarantine(cooldown time.Duration) {
+	self.controller.quarantine = cooldown
+}
+
+// SetRevocations refuses connections with revoked members, disconnects any that are
+// connected, and excludes them from elections.  It replaces any earlier revocations, and
+// may be called from any goroutine.
+func (self *Node) SetRevocations(revocations *Revocations) {
+	self.connMgr.SetRevocations(revocations)
+}
+
+// SetTLSPolicy restricts the TLS connections with other members.  Connections already
+// established are unaffected.  It may be called from any goroutine.
+func (self *Node) SetTLSPolicy(policy *TLSPolicy) {
+	self.connMgr.SetTLSPolicy(policy)
+}
+
+// SetIssuers trusts the CAs given to issue members' certificates.  Members with
+// self-signed certificates need no CA, but any other certificate a member presents must be
+// issued by one of them.  It may be called from any goroutine.
+func (self *Node) SetIssuers(issuers []*x509.Certificate) {
+	self.connMgr.SetIssuers(issuers)
+}
+
+// SetHandshakeLimits bounds the time an inbound connection may take to handshake, the
+// handshakes in progress at once, and how often each source address may connect.  It may
+// be called from any goroutine.
+func (self *Node) SetHandshakeLimits(limits HandshakeLimits) {
+	self.connMgr.SetHandshakeLimits(limits)
+}
+
+// SetExpiryPolicy determines whether members presenting certificates outside their validity
+// period may connect: ExpiryWarn, the default, logs them; ExpiryReject refuses them; and
+// ExpiryIgnore lets them connect silently.  It may be called from any goroutine.
+func (self *Node) SetExpiryPolicy(policy ExpiryPolicy) {
+	self.connMgr.SetExpiryPolicy(policy)
+}
+
+// SetExpiryWarnings configures the days before each member's certificate expires at which
+// a warning is logged.  It must be called before Run.
+func (self *Node) SetExpiryWarnings(thresholds []int) {
+	self.expiry.setThresholds(thresholds)
+}
+
+// CertificateExpiry returns the days until each member's certificate expires, which are
+// negative for those that already have.  It may be called from any goroutine.
+func (self *Node) CertificateExpiry() map[string]int {
+	return self.expiry.check(self.connMgr.members(), time.Now())
+}
+
+// Run participates in the cluster until the node is stopped
+func (self *Node) Run() {
+	go self.controller.replicator.applier.run()
+	go self.locks.run()
+	go self.expiry.run(self.connMgr, self.done)
+	self.controller.Run()
+}
+
+// Stop disconnects the node from its peers and ends its background work, including that
+// of the services layered on it, after which Run returns.  A stopped node cannot be run
+// again.
+func (self *Node) Stop() {
+	self.stopOnce.Do(func() {
+		close(self.done)
+		self.connMgr.Close()
+		self.controller.replicator.applier.close()
+	})
+}
+
+// Done returns a channel that is closed once the node is stopped
+func (self *Node) Done() <-chan struct{} {
+	return self.done
+}
+
+// Leader returns the current leadership, and may be called from any goroutine
+func (self *Node) Leader() Leadership {
+	return self.controller.Leader()
+}
+
+// Handle registers the handler for application messages arriving on a topic, replacing
+// any previous registration.  A nil handler removes the registration.
+func (self *Node) Handle(topic string, handler Handler) {
+	self.router.Handle(topic, handler)
+}
+
+// Send queues a message for delivery to a single peer.  The payload must not be modified
+// after it is passed to Send.
+func (self *Node) Send(peerId, topic string, payload []byte) error {
+	peer, ok := self.controller.getPeer(peerId)
+	if !ok {
+		return ErrPeerNotConnected
+	}
+
+	return peer.Send(newApplication(topic, payload))
+}
+
+// Broadcast queues a message for delivery to every connected peer.  Delivery is best
+// effort: peers that are not connected do not receive the message.
+func (self *Node) Broadcast(topic string, payload []byte) {
+	msg := newApplication(topic, payload)
+
+	for _, peer := range self.controller.getPeers() {
+		peer.Send(msg)
+	}
+}
+
+// HandleCall registers the handler for a request/response method, replacing any previous
+// registration.  A nil handler removes the registration.
+func (self *Node) HandleCall(method string, handler RpcHandler) {
+	self.router.HandleCall(method, handler)
+}
+
+// Call issues a request to a single peer and waits for its response
+func (self *Node) Call(ctx context.Context, peerId, method string, request []byte) ([]byte, error) {
+	if peerId == self.Id() {
+		return self.router.call(ctx, peerId, method, request)
+	}
+
+	peer, ok := self.controller.getPeer(peerId)
+	if !ok {
+		return nil, ErrPeerNotConnected
+	}
+
+	return peer.Call(ctx, method, request)
+}
+
+// CallLeader issues a request to the current leader, waiting for one to be elected if
+// necessary.  If the leader is lost or steps down before it responds, the request is
+// re-issued to its successor, so methods invoked through CallLeader should be idempotent.
+// If ctx expires while no leader is available, ErrNoQuorum or ErrNotLeader is returned
+// depending on whether an election could be held.  If it is cancelled, or expires while
+// a leader is known but unreachable, ctx.Err() is returned instead.
+func (self *Node) CallLeader(ctx context.Context, method string, request []byte) ([]byte, error) {
+	for {
+		leadership := self.controller.Leader()
+
+		if leadership.Leader != "" {
+			resp, err := self.Call(ctx, leadership.Leader, method, request)
+			switch err {
+			case ErrPeerClosed, ErrPeerNotConnected, ErrNotLeader:
+				// The leader we knew about is gone or has stepped down; try its successor
+			default:
+				return resp, err
+			}
+		}
+
+		select {
+		case <-leadership.Changed:
+		case <-time.After(leaderRetryInterval):
+		case <-ctx.Done():
+			if ctx.Err() == context.Canceled || leadership.Leader != "" {
+				return nil, ctx.Err()
+			}
+			if !self.controller.Leader().Quorum {
+				return nil, ErrNoQuorum
+			}
+			return nil, ErrNotLeader
+		}
+	}
+}
+
+func newApplication(topic string, payload []byte) *pb.Application {
+	return &pb.Application{
+		Topic:   proto.String(topic),
+		Payload: payload,
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newTestControllerWithObservers(self string, voters []string, observers []string) *Controller {
+	peers := IdentityMap{}
+	for _, id := range voters {
+		peers[id] = &Identity{Id: id}
+	}
+	for _, id := range observers {
+		peers[id] = &Identity{Id: id, Observer: true}
+	}
+
+	return NewController(self, peers, nil, NewRouter())
+}
+
+func TestObserversDoNotAffectQuorum(t *testing.T) {
+	// Three voters need two, regardless of how many observers there are
+	c := newTestControllerWithObservers("A", []string{"A", "B", "C"}, []string{"X", "Y", "Z"})
+	assert.Equal(t, 1, c.quorumThreshold)
+	assert.False(t, c.observer)
+
+	// An observer needs to hear from a full quorum since it doesn't count itself
+	c = newTestControllerWithObservers("X", []string{"A", "B", "C"}, []string{"X", "Y", "Z"})
+	assert.Equal(t, 2, c.quorumThreshold)
+	assert.True(t, c.observer)
+
+	c.activePeers["A"] = nil
+	c.activePeers["Y"] = nil
+	c.activePeers["Z"] = nil
+	assert.Equal(t, 1, c.connectedVoters())
+}
+
+func TestObserversDoNotVote(t *testing.T) {
+	c := newTestControllerWithObservers("A", []string{"A", "B", "C"}, []string{"X"})
+
+	// Votes by or for an observer are ignored
+	c.onVote("X", "B", 0)
+	c.onVote("B", "X", 0)
+	assert.Equal(t, 0, c.electionManager.VoteCount())
+
+	c.onVote("B", "B", 0)
+	assert.Equal(t, 1, c.electionManager.VoteCount())
+
+	// Nor does an observer cast ballots
+	o := newTestControllerWithObservers("X", []string{"A", "B", "C"}, []string{"X"})
+	o.castPreferredBallot()
+	assert.Equal(t, 0, o.electionManager.VoteCount())
+}
+
+func TestObserverAcksDoNotConfirmBarriers(t *testing.T) {
+	c := newTestControllerWithObservers("A", []string{"A", "B", "C"}, []string{"X"})
+	c.state.SetState("leading")
+
+	b := newTestBarrier()
+	c.onBarrier(b)
+	c.onHeartbeatAck("X", c.electionManager.View(), b.seq)
+	assert.True(t, pending(b))
+
+	c.onHeartbeatAck("B", c.electionManager.View(), b.seq)
+	assert.Nil(t, <-b.result)
+}
+
+func TestReplicatorObserver(t *testing.T) {
+	net := newTestNetwork(SnapshotPolicy{}, "A", "B", "X")
+	defer net.close()
+
+	for _, r := range net.replicators {
+		r.observers = map[string]bool{"X": true}
+		r.quorumThreshold = 1
+	}
+
+	net.elect("A", 1)
+	assert.True(t, net.replicators["A"].ready)
+
+	// The observer receives the log but its acknowledgements don't commit anything
+	net.down["B"] = true
+	net.replicators["A"].propose([]byte("x"))
+	net.pump()
+	assert.Equal(t, uint64(2), net.replicators["X"].log.LastIndex())
+	assert.Equal(t, uint64(1), net.replicators["A"].commitIndex)
+
+	net.down["B"] = false
+	net.replicators["A"].tick()
+	net.pump()
+	assert.Equal(t, uint64(2), net.replicators["A"].commitIndex)
+
+	// Followers learn of the commit on the next append
+	net.replicators["A"].tick()
+	net.converged(t, "x", "A", "B", "X")
+}
+
+func TestConfigApply(t *testing.T) {
+	cert, _ := newTestCertificate(t, "localhost:2001")
+	voter := NewIdentity(cert)
+	cert, _ = newTestCertificate(t, "localhost:2002")
+	observer := NewIdentity(cert)
+
+	members := IdentityMap{voter.Id: voter, observer.Id: observer}
+
+	config := &ClusterConfig{Members: map[string]*MemberConfig{"localhost:2002": {Observer: true}}}
+	assert.Nil(t, config.Apply(members))
+	assert.False(t, voter.Observer)
+	assert.True(t, observer.Observer)
+
+	config.Members[voter.Id] = &MemberConfig{Observer: true}
+	assert.NotNil(t, config.Apply(members))
+
+	config.Members = map[string]*MemberConfig{"localhost:9999": {}}
+	assert.NotNil(t, config.Apply(members))
+}
@@ -12,7 +12,21 @@ It has these top-level messages:
 	Negotiate
 	Header
 	Heartbeat
+	HeartbeatAck
 	Vote
+	QuorumCertificate
+	Application
+	Request
+	Response
+	Cancel
+	Entry
+	AppendEntries
+	AppendResponse
+	InstallSnapshot
+	SnapshotAck
+	LogQuery
+	LogState
+	LogFetch
 */
 package pb
 
@@ -28,17 +42,53 @@ var _ = math.Inf
 type Type int32
 
 const (
-	Type_HEARTBEAT Type = 1
-	Type_VOTE      Type = 2
+	Type_HEARTBEAT        Type = 1
+	Type_VOTE             Type = 2
+	Type_APPLICATION      Type = 3
+	Type_REQUEST          Type = 4
+	Type_RESPONSE         Type = 5
+	Type_CANCEL           Type = 6
+	Type_HEARTBEAT_ACK    Type = 7
+	Type_APPEND_ENTRIES   Type = 8
+	Type_APPEND_RESPONSE  Type = 9
+	Type_INSTALL_SNAPSHOT Type = 10
+	Type_SNAPSHOT_ACK     Type = 11
+	Type_LOG_QUERY        Type = 12
+	Type_LOG_STATE        Type = 13
+	Type_LOG_FETCH        Type = 14
 )
 
 var Type_name = map[int32]string{
-	1: "HEARTBEAT",
-	2: "VOTE",
+	1:  "HEARTBEAT",
+	2:  "VOTE",
+	3:  "APPLICATION",
+	4:  "REQUEST",
+	5:  "RESPONSE",
+	6:  "CANCEL",
+	7:  "HEARTBEAT_ACK",
+	8:  "APPEND_ENTRIES",
+	9:  "APPEND_RESPONSE",
+	10: "INSTALL_SNAPSHOT",
+	11: "SNAPSHOT_ACK",
+	12: "LOG_QUERY",
+	13: "LOG_STATE",
+	14: "LOG_FETCH",
 }
 var Type_value = map[string]int32{
-	"HEARTBEAT": 1,
-	"VOTE":      2,
+	"HEARTBEAT":        1,
+	"VOTE":             2,
+	"APPLICATION":      3,
+	"REQUEST":          4,
+	"RESPONSE":         5,
+	"CANCEL":           6,
+	"HEARTBEAT_ACK":    7,
+	"APPEND_ENTRIES":   8,
+	"APPEND_RESPONSE":  9,
+	"INSTALL_SNAPSHOT": 10,
+	"SNAPSHOT_ACK":     11,
+	"LOG_QUERY":        12,
+	"LOG_STATE":        13,
+	"LOG_FETCH":        14,
 }
 
 func (x Type) Enum() *Type {
@@ -58,10 +108,59 @@ func (x *Type) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+type Status int32
+
+const (
+	Status_OK                Status = 1
+	Status_ERROR             Status = 2
+	Status_UNKNOWN_METHOD    Status = 3
+	Status_CANCELLED         Status = 4
+	Status_DEADLINE_EXCEEDED Status = 5
+	Status_NOT_LEADER        Status = 6
+	Status_NO_QUORUM         Status = 7
+)
+
+var Status_name = map[int32]string{
+	1: "OK",
+	2: "ERROR",
+	3: "UNKNOWN_METHOD",
+	4: "CANCELLED",
+	5: "DEADLINE_EXCEEDED",
+	6: "NOT_LEADER",
+	7: "NO_QUORUM",
+}
+var Status_value = map[string]int32{
+	"OK":                1,
+	"ERROR":             2,
+	"UNKNOWN_METHOD":    3,
+	"CANCELLED":         4,
+	"DEADLINE_EXCEEDED": 5,
+	"NOT_LEADER":        6,
+	"NO_QUORUM":         7,
+}
+
+func (x Status) Enum() *Status {
+	p := new(Status)
+	*p = x
+	return p
+}
+func (x Status) String() string {
+	return proto.EnumName(Status_name, int32(x))
+}
+func (x *Status) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(Status_value, data, "Status")
+	if err != nil {
+		return err
+	}
+	*x = Status(value)
+	return nil
+}
+
 type Negotiate struct {
 	Magic            *string  `protobuf:"bytes,1,req,name=magic" json:"magic,omitempty"`
 	Version          *int32   `protobuf:"varint,2,req,name=version" json:"version,omitempty"`
 	Options          []string `protobuf:"bytes,3,rep,name=options" json:"options,omitempty"`
+	MaxVersion       *int32   `protobuf:"varint,4,opt,name=maxVersion" json:"maxVersion,omitempty"`
 	XXX_unrecognized []byte   `json:"-"`
 }
 
@@ -90,6 +189,13 @@ func (m *Negotiate) GetOptions() []string {
 	return nil
 }
 
+func (m *Negotiate) GetMaxVersion() int32 {
+	if m != nil && m.MaxVersion != nil {
+		return *m.MaxVersion
+	}
+	return 0
+}
+
 type Header struct {
 	Type             *Type  `protobuf:"varint,1,opt,name=type,enum=pb.Type" json:"type,omitempty"`
 	XXX_unrecognized []byte `json:"-"`
@@ -107,8 +213,12 @@ func (m *Header) GetType() Type {
 }
 
 type Heartbeat struct {
-	ViewId           *int64 `protobuf:"varint,1,opt,name=viewId" json:"viewId,omitempty"`
-	XXX_unrecognized []byte `json:"-"`
+	ViewId           *int64             `protobuf:"varint,1,opt,name=viewId" json:"viewId,omitempty"`
+	Seq              *uint64            `protobuf:"varint,2,opt,name=seq" json:"seq,omitempty"`
+	Leader           *string            `protobuf:"bytes,3,opt,name=leader" json:"leader,omitempty"`
+	Signature        []byte             `protobuf:"bytes,4,opt,name=signature" json:"signature,omitempty"`
+	Certificate      *QuorumCertificate `protobuf:"bytes,5,opt,name=certificate" json:"certificate,omitempty"`
+	XXX_unrecognized []byte             `json:"-"`
 }
 
 func (m *Heartbeat) Reset()         { *m = Heartbeat{} }
@@ -122,9 +232,63 @@ func (m *Heartbeat) GetViewId() int64 {
 	return 0
 }
 
+func (m *Heartbeat) GetSeq() uint64 {
+	if m != nil && m.Seq != nil {
+		return *m.Seq
+	}
+	return 0
+}
+
+func (m *Heartbeat) GetLeader() string {
+	if m != nil && m.Leader != nil {
+		return *m.Leader
+	}
+	return ""
+}
+
+func (m *Heartbeat) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+func (m *Heartbeat) GetCertificate() *QuorumCertificate {
+	if m != nil {
+		return m.Certificate
+	}
+	return nil
+}
+
+type HeartbeatAck struct {
+	ViewId           *int64  `protobuf:"varint,1,opt,name=viewId" json:"viewId,omitempty"`
+	Seq              *uint64 `protobuf:"varint,2,opt,name=seq" json:"seq,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *HeartbeatAck) Reset()         { *m = HeartbeatAck{} }
+func (m *HeartbeatAck) String() string { return proto.CompactTextString(m) }
+func (*HeartbeatAck) ProtoMessage()    {}
+
+func (m *HeartbeatAck) GetViewId() int64 {
+	if m != nil && m.ViewId != nil {
+		return *m.ViewId
+	}
+	return 0
+}
+
+func (m *HeartbeatAck) GetSeq() uint64 {
+	if m != nil && m.Seq != nil {
+		return *m.Seq
+	}
+	return 0
+}
+
 type Vote struct {
 	ViewId           *int64  `protobuf:"varint,1,opt,name=viewId" json:"viewId,omitempty"`
 	PeerId           *string `protobuf:"bytes,2,opt,name=peerId" json:"peerId,omitempty"`
+	Voter            *string `protobuf:"bytes,3,opt,name=voter" json:"voter,omitempty"`
+	Signature        []byte  `protobuf:"bytes,4,opt,name=signature" json:"signature,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -146,10 +310,472 @@ func (m *Vote) GetPeerId() string {
 	return ""
 }
 
+func (m *Vote) GetVoter() string {
+	if m != nil && m.Voter != nil {
+		return *m.Voter
+	}
+	return ""
+}
+
+func (m *Vote) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
+// QuorumCertificate proves a leader's election with the signed votes that elected it
+type QuorumCertificate struct {
+	ViewId           *int64  `protobuf:"varint,1,opt,name=viewId" json:"viewId,omitempty"`
+	Leader           *string `protobuf:"bytes,2,opt,name=leader" json:"leader,omitempty"`
+	Votes            []*Vote `protobuf:"bytes,3,rep,name=votes" json:"votes,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *QuorumCertificate) Reset()         { *m = QuorumCertificate{} }
+func (m *QuorumCertificate) String() string { return proto.CompactTextString(m) }
+func (*QuorumCertificate) ProtoMessage()    {}
+
+func (m *QuorumCertificate) GetViewId() int64 {
+	if m != nil && m.ViewId != nil {
+		return *m.ViewId
+	}
+	return 0
+}
+
+func (m *QuorumCertificate) GetLeader() string {
+	if m != nil && m.Leader != nil {
+		return *m.Leader
+	}
+	return ""
+}
+
+func (m *QuorumCertificate) GetVotes() []*Vote {
+	if m != nil {
+		return m.Votes
+	}
+	return nil
+}
+
+type Application struct {
+	Topic            *string `protobuf:"bytes,1,opt,name=topic" json:"topic,omitempty"`
+	Payload          []byte  `protobuf:"bytes,2,opt,name=payload" json:"payload,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Application) Reset()         { *m = Application{} }
+func (m *Application) String() string { return proto.CompactTextString(m) }
+func (*Application) ProtoMessage()    {}
+
+func (m *Application) GetTopic() string {
+	if m != nil && m.Topic != nil {
+		return *m.Topic
+	}
+	return ""
+}
+
+func (m *Application) GetPayload() []byte {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
+type Request struct {
+	Id               *uint64 `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
+	Method           *string `protobuf:"bytes,2,opt,name=method" json:"method,omitempty"`
+	Payload          []byte  `protobuf:"bytes,3,opt,name=payload" json:"payload,omitempty"`
+	Timeout          *int64  `protobuf:"varint,4,opt,name=timeout" json:"timeout,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Request) Reset()         { *m = Request{} }
+func (m *Request) String() string { return proto.CompactTextString(m) }
+func (*Request) ProtoMessage()    {}
+
+func (m *Request) GetId() uint64 {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return 0
+}
+
+func (m *Request) GetMethod() string {
+	if m != nil && m.Method != nil {
+		return *m.Method
+	}
+	return ""
+}
+
+func (m *Request) GetPayload() []byte {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
+func (m *Request) GetTimeout() int64 {
+	if m != nil && m.Timeout != nil {
+		return *m.Timeout
+	}
+	return 0
+}
+
+type Response struct {
+	Id               *uint64 `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
+	Status           *Status `protobuf:"varint,2,opt,name=status,enum=pb.Status" json:"status,omitempty"`
+	Error            *string `protobuf:"bytes,3,opt,name=error" json:"error,omitempty"`
+	Payload          []byte  `protobuf:"bytes,4,opt,name=payload" json:"payload,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Response) Reset()         { *m = Response{} }
+func (m *Response) String() string { return proto.CompactTextString(m) }
+func (*Response) ProtoMessage()    {}
+
+func (m *Response) GetId() uint64 {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return 0
+}
+
+func (m *Response) GetStatus() Status {
+	if m != nil && m.Status != nil {
+		return *m.Status
+	}
+	return Status_OK
+}
+
+func (m *Response) GetError() string {
+	if m != nil && m.Error != nil {
+		return *m.Error
+	}
+	return ""
+}
+
+func (m *Response) GetPayload() []byte {
+	if m != nil {
+		return m.Payload
+	}
+	return nil
+}
+
+type Cancel struct {
+	Id               *uint64 `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Cancel) Reset()         { *m = Cancel{} }
+func (m *Cancel) String() string { return proto.CompactTextString(m) }
+func (*Cancel) ProtoMessage()    {}
+
+func (m *Cancel) GetId() uint64 {
+	if m != nil && m.Id != nil {
+		return *m.Id
+	}
+	return 0
+}
+
+type Entry struct {
+	Index            *uint64 `protobuf:"varint,1,opt,name=index" json:"index,omitempty"`
+	ViewId           *int64  `protobuf:"varint,2,opt,name=viewId" json:"viewId,omitempty"`
+	Data             []byte  `protobuf:"bytes,3,opt,name=data" json:"data,omitempty"`
+	Noop             *bool   `protobuf:"varint,4,opt,name=noop" json:"noop,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Entry) Reset()         { *m = Entry{} }
+func (m *Entry) String() string { return proto.CompactTextString(m) }
+func (*Entry) ProtoMessage()    {}
+
+func (m *Entry) GetIndex() uint64 {
+	if m != nil && m.Index != nil {
+		return *m.Index
+	}
+	return 0
+}
+
+func (m *Entry) GetViewId() int64 {
+	if m != nil && m.ViewId != nil {
+		return *m.ViewId
+	}
+	return 0
+}
+
+func (m *Entry) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+func (m *Entry) GetNoop() bool {
+	if m != nil && m.Noop != nil {
+		return *m.Noop
+	}
+	return false
+}
+
+type AppendEntries struct {
+	ViewId           *int64   `protobuf:"varint,1,opt,name=viewId" json:"viewId,omitempty"`
+	PrevIndex        *uint64  `protobuf:"varint,2,opt,name=prevIndex" json:"prevIndex,omitempty"`
+	PrevViewId       *int64   `protobuf:"varint,3,opt,name=prevViewId" json:"prevViewId,omitempty"`
+	Entries          []*Entry `protobuf:"bytes,4,rep,name=entries" json:"entries,omitempty"`
+	CommitIndex      *uint64  `protobuf:"varint,5,opt,name=commitIndex" json:"commitIndex,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *AppendEntries) Reset()         { *m = AppendEntries{} }
+func (m *AppendEntries) String() string { return proto.CompactTextString(m) }
+func (*AppendEntries) ProtoMessage()    {}
+
+func (m *AppendEntries) GetViewId() int64 {
+	if m != nil && m.ViewId != nil {
+		return *m.ViewId
+	}
+	return 0
+}
+
+func (m *AppendEntries) GetPrevIndex() uint64 {
+	if m != nil && m.PrevIndex != nil {
+		return *m.PrevIndex
+	}
+	return 0
+}
+
+func (m *AppendEntries) GetPrevViewId() int64 {
+	if m != nil && m.PrevViewId != nil {
+		return *m.PrevViewId
+	}
+	return 0
+}
+
+func (m *AppendEntries) GetEntries() []*Entry {
+	if m != nil {
+		return m.Entries
+	}
+	return nil
+}
+
+func (m *AppendEntries) GetCommitIndex() uint64 {
+	if m != nil && m.CommitIndex != nil {
+		return *m.CommitIndex
+	}
+	return 0
+}
+
+type AppendResponse struct {
+	ViewId           *int64  `protobuf:"varint,1,opt,name=viewId" json:"viewId,omitempty"`
+	Success          *bool   `protobuf:"varint,2,opt,name=success" json:"success,omitempty"`
+	LastIndex        *uint64 `protobuf:"varint,3,opt,name=lastIndex" json:"lastIndex,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *AppendResponse) Reset()         { *m = AppendResponse{} }
+func (m *AppendResponse) String() string { return proto.CompactTextString(m) }
+func (*AppendResponse) ProtoMessage()    {}
+
+func (m *AppendResponse) GetViewId() int64 {
+	if m != nil && m.ViewId != nil {
+		return *m.ViewId
+	}
+	return 0
+}
+
+func (m *AppendResponse) GetSuccess() bool {
+	if m != nil && m.Success != nil {
+		return *m.Success
+	}
+	return false
+}
+
+func (m *AppendResponse) GetLastIndex() uint64 {
+	if m != nil && m.LastIndex != nil {
+		return *m.LastIndex
+	}
+	return 0
+}
+
+type InstallSnapshot struct {
+	ViewId           *int64  `protobuf:"varint,1,opt,name=viewId" json:"viewId,omitempty"`
+	LastIndex        *uint64 `protobuf:"varint,2,opt,name=lastIndex" json:"lastIndex,omitempty"`
+	LastViewId       *int64  `protobuf:"varint,3,opt,name=lastViewId" json:"lastViewId,omitempty"`
+	Offset           *uint64 `protobuf:"varint,4,opt,name=offset" json:"offset,omitempty"`
+	Data             []byte  `protobuf:"bytes,5,opt,name=data" json:"data,omitempty"`
+	Done             *bool   `protobuf:"varint,6,opt,name=done" json:"done,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *InstallSnapshot) Reset()         { *m = InstallSnapshot{} }
+func (m *InstallSnapshot) String() string { return proto.CompactTextString(m) }
+func (*InstallSnapshot) ProtoMessage()    {}
+
+func (m *InstallSnapshot) GetViewId() int64 {
+	if m != nil && m.ViewId != nil {
+		return *m.ViewId
+	}
+	return 0
+}
+
+func (m *InstallSnapshot) GetLastIndex() uint64 {
+	if m != nil && m.LastIndex != nil {
+		return *m.LastIndex
+	}
+	return 0
+}
+
+func (m *InstallSnapshot) GetLastViewId() int64 {
+	if m != nil && m.LastViewId != nil {
+		return *m.LastViewId
+	}
+	return 0
+}
+
+func (m *InstallSnapshot) GetOffset() uint64 {
+	if m != nil && m.Offset != nil {
+		return *m.Offset
+	}
+	return 0
+}
+
+func (m *InstallSnapshot) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+func (m *InstallSnapshot) GetDone() bool {
+	if m != nil && m.Done != nil {
+		return *m.Done
+	}
+	return false
+}
+
+type SnapshotAck struct {
+	ViewId           *int64  `protobuf:"varint,1,opt,name=viewId" json:"viewId,omitempty"`
+	LastIndex        *uint64 `protobuf:"varint,2,opt,name=lastIndex" json:"lastIndex,omitempty"`
+	Offset           *uint64 `protobuf:"varint,3,opt,name=offset" json:"offset,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *SnapshotAck) Reset()         { *m = SnapshotAck{} }
+func (m *SnapshotAck) String() string { return proto.CompactTextString(m) }
+func (*SnapshotAck) ProtoMessage()    {}
+
+func (m *SnapshotAck) GetViewId() int64 {
+	if m != nil && m.ViewId != nil {
+		return *m.ViewId
+	}
+	return 0
+}
+
+func (m *SnapshotAck) GetLastIndex() uint64 {
+	if m != nil && m.LastIndex != nil {
+		return *m.LastIndex
+	}
+	return 0
+}
+
+func (m *SnapshotAck) GetOffset() uint64 {
+	if m != nil && m.Offset != nil {
+		return *m.Offset
+	}
+	return 0
+}
+
+type LogQuery struct {
+	ViewId           *int64 `protobuf:"varint,1,opt,name=viewId" json:"viewId,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *LogQuery) Reset()         { *m = LogQuery{} }
+func (m *LogQuery) String() string { return proto.CompactTextString(m) }
+func (*LogQuery) ProtoMessage()    {}
+
+func (m *LogQuery) GetViewId() int64 {
+	if m != nil && m.ViewId != nil {
+		return *m.ViewId
+	}
+	return 0
+}
+
+type LogState struct {
+	ViewId           *int64  `protobuf:"varint,1,opt,name=viewId" json:"viewId,omitempty"`
+	LastIndex        *uint64 `protobuf:"varint,2,opt,name=lastIndex" json:"lastIndex,omitempty"`
+	LastViewId       *int64  `protobuf:"varint,3,opt,name=lastViewId" json:"lastViewId,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *LogState) Reset()         { *m = LogState{} }
+func (m *LogState) String() string { return proto.CompactTextString(m) }
+func (*LogState) ProtoMessage()    {}
+
+func (m *LogState) GetViewId() int64 {
+	if m != nil && m.ViewId != nil {
+		return *m.ViewId
+	}
+	return 0
+}
+
+func (m *LogState) GetLastIndex() uint64 {
+	if m != nil && m.LastIndex != nil {
+		return *m.LastIndex
+	}
+	return 0
+}
+
+func (m *LogState) GetLastViewId() int64 {
+	if m != nil && m.LastViewId != nil {
+		return *m.LastViewId
+	}
+	return 0
+}
+
+type LogFetch struct {
+	ViewId           *int64  `protobuf:"varint,1,opt,name=viewId" json:"viewId,omitempty"`
+	FromIndex        *uint64 `protobuf:"varint,2,opt,name=fromIndex" json:"fromIndex,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *LogFetch) Reset()         { *m = LogFetch{} }
+func (m *LogFetch) String() string { return proto.CompactTextString(m) }
+func (*LogFetch) ProtoMessage()    {}
+
+func (m *LogFetch) GetViewId() int64 {
+	if m != nil && m.ViewId != nil {
+		return *m.ViewId
+	}
+	return 0
+}
+
+func (m *LogFetch) GetFromIndex() uint64 {
+	if m != nil && m.FromIndex != nil {
+		return *m.FromIndex
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Negotiate)(nil), "pb.Negotiate")
 	proto.RegisterType((*Header)(nil), "pb.Header")
 	proto.RegisterType((*Heartbeat)(nil), "pb.Heartbeat")
+	proto.RegisterType((*HeartbeatAck)(nil), "pb.HeartbeatAck")
 	proto.RegisterType((*Vote)(nil), "pb.Vote")
+	proto.RegisterType((*QuorumCertificate)(nil), "pb.QuorumCertificate")
+	proto.RegisterType((*Application)(nil), "pb.Application")
+	proto.RegisterType((*Request)(nil), "pb.Request")
+	proto.RegisterType((*Response)(nil), "pb.Response")
+	proto.RegisterType((*Cancel)(nil), "pb.Cancel")
+	proto.RegisterType((*Entry)(nil), "pb.Entry")
+	proto.RegisterType((*AppendEntries)(nil), "pb.AppendEntries")
+	proto.RegisterType((*AppendResponse)(nil), "pb.AppendResponse")
+	proto.RegisterType((*InstallSnapshot)(nil), "pb.InstallSnapshot")
+	proto.RegisterType((*SnapshotAck)(nil), "pb.SnapshotAck")
+	proto.RegisterType((*LogQuery)(nil), "pb.LogQuery")
+	proto.RegisterType((*LogState)(nil), "pb.LogState")
+	proto.RegisterType((*LogFetch)(nil), "pb.LogFetch")
 	proto.RegisterEnum("pb.Type", Type_name, Type_value)
+	proto.RegisterEnum("pb.Status", Status_name, Status_value)
 }
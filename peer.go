@@ -1,22 +1,46 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"expvar"
 	"fmt"
 	"github.com/ghaskins/go-cluster/pb"
 	"github.com/golang/protobuf/proto"
 	"io"
+	"sync"
+	"sync/atomic"
 )
 
 type MessageChannel chan Message
-type DisconnectChannel chan string
+type DisconnectChannel chan *Peer
 
+var ErrPeerClosed = errors.New("peer connection closed")
+
+// The application messages dropped because a peer's receive queue was full, by peer,
+// published with the standard expvar metrics
+var appMessagesDropped = expvar.NewMap("appMessagesDropped")
+
+// Peer multiplexes two classes of traffic over a single connection.  Control traffic
+// (heartbeats and votes) is queued separately from application traffic and always
+// takes priority on transmit, so that a busy application can never starve the cluster
+// protocol.
 type Peer struct {
 	conn              *Connection
+	router            *Router
 	rxChannel         *MessageChannel
 	txChannel         chan proto.Message
-	txStop            chan bool
+	appRxChannel      chan *pb.Application
+	appTxChannel      chan proto.Message
 	disconnectChannel *DisconnectChannel
+	ctx               context.Context
+	cancel            context.CancelFunc
+	closeOnce         sync.Once
+	rpcLock           sync.Mutex
+	nextCallId        uint64
+	pendingCalls      map[uint64]chan *pb.Response
+	inflightCalls     map[uint64]context.CancelFunc
+	dropped           uint64 // application messages dropped on receipt
 }
 
 type Message struct {
@@ -24,10 +48,82 @@ type Message struct {
 	Payload proto.Message
 }
 
+func NewPeer(conn *Connection, router *Router, rxChannel *MessageChannel, disconnectChannel *DisconnectChannel) *Peer {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Peer{
+		conn:              conn,
+		router:            router,
+		rxChannel:         rxChannel,
+		txChannel:         make(chan proto.Message, 100),
+		appRxChannel:      make(chan *pb.Application, 1000),
+		appTxChannel:      make(chan proto.Message, 1000),
+		disconnectChannel: disconnectChannel,
+		ctx:               ctx,
+		cancel:            cancel,
+		pendingCalls:      make(map[uint64]chan *pb.Response),
+		inflightCalls:     make(map[uint64]context.CancelFunc),
+	}
+}
+
 func (self *Peer) Id() string {
 	return self.conn.Id.Id
 }
 
+// Done returns a channel that is closed once the peer has been shut down, either
+// locally via Close() or because the underlying connection failed
+func (self *Peer) Done() <-chan struct{} {
+	return self.ctx.Done()
+}
+
+func (self *Peer) closed() bool {
+	return self.ctx.Err() != nil
+}
+
+func messageType(msg proto.Message) pb.Type {
+	switch msg.(type) {
+	case *pb.Heartbeat:
+		return pb.Type_HEARTBEAT
+	case *pb.HeartbeatAck:
+		return pb.Type_HEARTBEAT_ACK
+	case *pb.Vote:
+		return pb.Type_VOTE
+	case *pb.Application:
+		return pb.Type_APPLICATION
+	case *pb.Request:
+		return pb.Type_REQUEST
+	case *pb.Response:
+		return pb.Type_RESPONSE
+	case *pb.Cancel:
+		return pb.Type_CANCEL
+	case *pb.AppendEntries:
+		return pb.Type_APPEND_ENTRIES
+	case *pb.AppendResponse:
+		return pb.Type_APPEND_RESPONSE
+	case *pb.InstallSnapshot:
+		return pb.Type_INSTALL_SNAPSHOT
+	case *pb.SnapshotAck:
+		return pb.Type_SNAPSHOT_ACK
+	case *pb.LogQuery:
+		return pb.Type_LOG_QUERY
+	case *pb.LogState:
+		return pb.Type_LOG_STATE
+	case *pb.LogFetch:
+		return pb.Type_LOG_FETCH
+	default:
+		panic(fmt.Sprintf("unexpected message type %T", msg))
+	}
+}
+
+func isControl(t pb.Type) bool {
+	switch t {
+	case pb.Type_HEARTBEAT, pb.Type_HEARTBEAT_ACK, pb.Type_VOTE:
+		return true
+	default:
+		return false
+	}
+}
+
 func (self *Peer) rxLoop() error {
 
 	for {
@@ -47,9 +143,37 @@ func (self *Peer) rxLoop() error {
 		switch header.GetType() {
 		case pb.Type_HEARTBEAT:
 			payload = new(pb.Heartbeat)
+		case pb.Type_HEARTBEAT_ACK:
+			payload = new(pb.HeartbeatAck)
 		case pb.Type_VOTE:
 			payload = new(pb.Vote)
+		case pb.Type_APPLICATION:
+			payload = new(pb.Application)
+		case pb.Type_REQUEST:
+			payload = new(pb.Request)
+		case pb.Type_RESPONSE:
+			payload = new(pb.Response)
+		case pb.Type_CANCEL:
+			payload = new(pb.Cancel)
+		case pb.Type_APPEND_ENTRIES:
+			payload = new(pb.AppendEntries)
+		case pb.Type_APPEND_RESPONSE:
+			payload = new(pb.AppendResponse)
+		case pb.Type_INSTALL_SNAPSHOT:
+			payload = new(pb.InstallSnapshot)
+		case pb.Type_SNAPSHOT_ACK:
+			payload = new(pb.SnapshotAck)
+		case pb.Type_LOG_QUERY:
+			payload = new(pb.LogQuery)
+		case pb.Type_LOG_STATE:
+			payload = new(pb.LogState)
+		case pb.Type_LOG_FETCH:
+			payload = new(pb.LogFetch)
 		default:
+			// A newer peer should only send what we negotiated, but stay in step regardless
+			if err := self.conn.skip(); err != nil {
+				return errors.New(fmt.Sprintf("payload recv error %s", err.Error()))
+			}
 			continue
 		}
 
@@ -62,51 +186,154 @@ func (self *Peer) rxLoop() error {
 			}
 		}
 
-		*self.rxChannel <- Message{From: self, Payload: payload}
+		switch msg := payload.(type) {
+		case *pb.Application:
+			// Application traffic is handed off to the dispatcher so that slow handlers
+			// cannot hold up the control messages that follow it on the wire
+			select {
+			case self.appRxChannel <- msg:
+			default:
+				self.drop(msg)
+			}
+		case *pb.Request:
+			self.serveCall(msg)
+		case *pb.Response:
+			self.completeCall(msg)
+		case *pb.Cancel:
+			self.cancelCall(msg)
+		default:
+			select {
+			case *self.rxChannel <- Message{From: self, Payload: payload}:
+			case <-self.ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// drop discards an application message that arrived while the receive queue was full.
+// Blocking instead would hold up the control traffic behind it on the wire.
+func (self *Peer) drop(msg *pb.Application) {
+	count := atomic.AddUint64(&self.dropped, 1)
+	appMessagesDropped.Add(self.Id(), 1)
+
+	fmt.Printf("%s: application receive queue full, dropping message on \"%s\" (%d dropped)\n",
+		self.Id(), msg.GetTopic(), count)
+}
+
+// Dropped returns the number of application messages from the peer that were dropped
+// because its handlers could not keep up
+func (self *Peer) Dropped() uint64 {
+	return atomic.LoadUint64(&self.dropped)
+}
+
+func (self *Peer) runDispatch() {
+	for {
+		select {
+		case msg := <-self.appRxChannel:
+			self.router.dispatch(self.Id(), msg)
+		case <-self.ctx.Done():
+			return
+		}
 	}
 }
 
 func (self *Peer) runRx() {
 	err := self.rxLoop()
-	if err != nil {
-		fmt.Printf("%s: %s", self.conn.Id.Id, err.Error())
+	if err != nil && !self.closed() {
+		fmt.Printf("%s: %s\n", self.Id(), err.Error())
 	}
 
-	*self.disconnectChannel <- self.conn.Id.Id
-	self.txStop <- true
+	self.Close()
+
+	// runRx is the only path that reports the disconnect, so observers hear about
+	// each peer exactly once regardless of which side initiated the shutdown
+	*self.disconnectChannel <- self
+}
+
+func (self *Peer) transmit(msg proto.Message) error {
+	t := messageType(msg)
+	header := &pb.Header{Type: &t}
+
+	return self.conn.Send(header, msg)
 }
 
 func (self *Peer) runTx() {
 	for {
-		select {
-		case msg := <-self.txChannel:
+		var msg proto.Message
 
-			var t pb.Type
-
-			switch msg.(type) {
-			case *pb.Heartbeat:
-				t = pb.Type_HEARTBEAT
-			case *pb.Vote:
-				t = pb.Type_VOTE
+		// Drain any pending control traffic before considering the application queue
+		select {
+		case msg = <-self.txChannel:
+		default:
+			select {
+			case msg = <-self.txChannel:
+			case msg = <-self.appTxChannel:
+			case <-self.ctx.Done():
+				return
 			}
+		}
 
-			header := &pb.Header{Type: &t}
-			self.conn.Send(header)
-			self.conn.Send(msg)
-		case _ = <-self.txStop:
+		if err := self.transmit(msg); err != nil {
+			self.Close()
 			return
 		}
 	}
 }
 
 func (self *Peer) Run() {
-	self.txChannel = make(chan proto.Message, 100)
-	self.txStop = make(chan bool)
 	go self.runRx()
 	go self.runTx()
+	go self.runDispatch()
+}
+
+// Close shuts down the peer.  It is safe to call multiple times and from any goroutine.
+// Closing the underlying connection unblocks any pending Send/Recv operations.
+func (self *Peer) Close() {
+	self.closeOnce.Do(func() {
+		self.cancel()
+		self.conn.Close()
+	})
+}
+
+// trySend queues a message only if doing so would not block
+func (self *Peer) trySend(msg proto.Message) bool {
+	if self.closed() || !self.conn.Supports(messageFeature(messageType(msg))) {
+		return false
+	}
+
+	queue := self.appTxChannel
+	if isControl(messageType(msg)) {
+		queue = self.txChannel
+	}
+
+	select {
+	case queue <- msg:
+		return true
+	default:
+		return false
+	}
 }
 
-func (self *Peer) Send(msg proto.Message) {
+func (self *Peer) Send(msg proto.Message) error {
+	if self.closed() {
+		return ErrPeerClosed
+	}
+
+	if !self.conn.Supports(messageFeature(messageType(msg))) {
+		return ErrUnsupported
+	}
+
+	queue := self.appTxChannel
+	if isControl(messageType(msg)) {
+		queue = self.txChannel
+	}
+
 	// We send it indirectly on a channel so that the header+payload transfer is atomic
-	self.txChannel <- msg
+	select {
+	case queue <- msg:
+		return nil
+	case <-self.ctx.Done():
+		return ErrPeerClosed
+	}
 }
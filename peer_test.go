@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"expvar"
+	"github.com/ghaskins/go-cluster/pb"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestCertificate(t *testing.T, cn string) (*x509.Certificate, *tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTestConnectionPair returns both ends of an in-memory, mutually authenticated connection
+func newTestConnectionPair(t *testing.T) (*Connection, *Connection) {
+	_, serverCert := newTestCertificate(t, "server")
+	_, clientCert := newTestCertificate(t, "client")
+
+	a, b := net.Pipe()
+
+	server := tls.Server(a, newConfig(serverCert, nil))
+	client := tls.Client(b, newConfig(clientCert, nil))
+
+	type result struct {
+		conn *Connection
+		err  error
+	}
+
+	results := make(chan result)
+	go func() {
+		conn, err := verifyCrypto(server, &connectionPolicy{})
+		results <- result{conn, err}
+	}()
+
+	clientConn, err := verifyCrypto(client, &connectionPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-results
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	return r.conn, clientConn
+}
+
+func newTestPeer(conn *Connection) (*Peer, MessageChannel, DisconnectChannel) {
+	return newTestPeerWithRouter(conn, NewRouter())
+}
+
+func newTestPeerWithRouter(conn *Connection, router *Router) (*Peer, MessageChannel, DisconnectChannel) {
+	rx := make(MessageChannel, 100)
+	disconnects := make(DisconnectChannel, 1)
+
+	return NewPeer(conn, router, &rx, &disconnects), rx, disconnects
+}
+
+func TestPeerSendRecv(t *testing.T) {
+	a, b := newTestConnectionPair(t)
+
+	sender, _, _ := newTestPeer(a)
+	receiver, rx, _ := newTestPeer(b)
+	sender.Run()
+	receiver.Run()
+	defer sender.Close()
+	defer receiver.Close()
+
+	viewId := int64(42)
+	assert.Nil(t, sender.Send(&pb.Heartbeat{ViewId: &viewId}))
+
+	select {
+	case msg := <-rx:
+		hb, ok := msg.Payload.(*pb.Heartbeat)
+		assert.True(t, ok)
+		assert.Equal(t, viewId, hb.GetViewId())
+		assert.Equal(t, receiver, msg.From)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for heartbeat")
+	}
+}
+
+func TestPeerSendAfterClose(t *testing.T) {
+	a, b := newTestConnectionPair(t)
+
+	// Keep the remote end reading so that the TLS close_notify can be delivered
+	remote, _, _ := newTestPeer(b)
+	remote.Run()
+	defer remote.Close()
+
+	peer, _, disconnects := newTestPeer(a)
+	peer.Run()
+	peer.Close()
+	peer.Close() // must be idempotent
+
+	<-peer.Done()
+
+	viewId := int64(1)
+	assert.Equal(t, ErrPeerClosed, peer.Send(&pb.Heartbeat{ViewId: &viewId}))
+
+	select {
+	case p := <-disconnects:
+		assert.Equal(t, peer, p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for disconnect")
+	}
+}
+
+// The remote side never reads, so the transmitter blocks inside conn.Send and the
+// transmit queue eventually fills.  Losing the connection must release everything.
+func TestPeerDisconnectDuringSend(t *testing.T) {
+	a, b := newTestConnectionPair(t)
+
+	peer, _, disconnects := newTestPeer(a)
+	peer.Run()
+
+	senders := 4
+	errs := make(chan error, senders)
+
+	for i := 0; i < senders; i++ {
+		go func() {
+			viewId := int64(1)
+			for {
+				if err := peer.Send(&pb.Heartbeat{ViewId: &viewId}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	// Give the senders time to fill the queue and wedge the transmitter
+	time.Sleep(100 * time.Millisecond)
+	b.Close()
+
+	select {
+	case p := <-disconnects:
+		assert.Equal(t, peer, p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for disconnect")
+	}
+
+	for i := 0; i < senders; i++ {
+		select {
+		case err := <-errs:
+			assert.Equal(t, ErrPeerClosed, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("sender remained blocked after disconnect")
+		}
+	}
+
+	<-peer.Done()
+}
+
+func TestPeerApplicationDoesNotBlockControl(t *testing.T) {
+	a, b := newTestConnectionPair(t)
+
+	received := make(chan string, 10)
+	release := make(chan struct{})
+
+	router := NewRouter()
+	router.Handle("test", func(from string, payload []byte) {
+		received <- string(payload)
+		<-release // simulate a slow handler
+	})
+
+	sender, _, _ := newTestPeer(a)
+	receiver, rx, _ := newTestPeerWithRouter(b, router)
+	sender.Run()
+	receiver.Run()
+	defer sender.Close()
+	defer receiver.Close()
+	defer close(release)
+
+	assert.Nil(t, sender.Send(newApplication("test", []byte("first"))))
+	assert.Nil(t, sender.Send(newApplication("test", []byte("second"))))
+
+	viewId := int64(7)
+	assert.Nil(t, sender.Send(&pb.Heartbeat{ViewId: &viewId}))
+
+	select {
+	case payload := <-received:
+		assert.Equal(t, "first", payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for application message")
+	}
+
+	// The handler is still blocked on the first message, yet the heartbeat must get through
+	select {
+	case msg := <-rx:
+		hb, ok := msg.Payload.(*pb.Heartbeat)
+		assert.True(t, ok)
+		assert.Equal(t, viewId, hb.GetViewId())
+	case <-time.After(5 * time.Second):
+		t.Fatal("heartbeat was starved by application traffic")
+	}
+}
+
+func metricValue(metric *expvar.Map, key string) int64 {
+	if value, ok := metric.Get(key).(*expvar.Int); ok {
+		return value.Value()
+	}
+
+	return 0
+}
+
+func TestPeerApplicationQueueFull(t *testing.T) {
+	a, b := newTestConnectionPair(t)
+
+	sender, _, _ := newTestPeer(a)
+	receiver, _, _ := newTestPeer(b)
+	receiver.appRxChannel = make(chan *pb.Application, 1)
+
+	// Without a dispatcher, nothing drains the receive queue
+	sender.Run()
+	go receiver.runRx()
+	go receiver.runTx()
+	defer sender.Close()
+	defer receiver.Close()
+
+	before := metricValue(appMessagesDropped, receiver.Id())
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, sender.Send(newApplication("test", []byte("message"))))
+	}
+
+	// The first is queued, and the others are dropped and counted
+	for i := 0; i < 500 && receiver.Dropped() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, uint64(2), receiver.Dropped())
+	assert.Equal(t, 1, len(receiver.appRxChannel))
+	assert.Equal(t, before+2, metricValue(appMessagesDropped, receiver.Id()))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestControllerWithPriorities(self string, priorities map[string]int, neverLeader ...string) *Controller {
+	peers := IdentityMap{}
+	for id, priority := range priorities {
+		peers[id] = &Identity{Id: id, Priority: priority}
+	}
+	for _, id := range neverLeader {
+		peers[id].NeverLeader = true
+	}
+
+	return NewController(self, peers, nil, NewRouter())
+}
+
+func TestPreferredCandidate(t *testing.T) {
+	c := newTestControllerWithPriorities("A", map[string]int{"A": 1, "B": 5, "C": 3}, "B")
+
+	// B has the highest priority but may not lead
+	c.activePeers["B"] = nil
+	c.activePeers["C"] = nil
+	candidate, ok := c.preferredCandidate()
+	assert.True(t, ok)
+	assert.Equal(t, "C", candidate)
+
+	// We win ties
+	c = newTestControllerWithPriorities("C", map[string]int{"A": 1, "B": 1, "C": 1})
+	c.activePeers["A"] = nil
+	candidate, _ = c.preferredCandidate()
+	assert.Equal(t, "C", candidate)
+
+	// A member that may not lead votes for somebody else
+	c = newTestControllerWithPriorities("A", map[string]int{"A": 0, "B": 0, "C": 0}, "A")
+	_, ok = c.preferredCandidate()
+	assert.False(t, ok)
+	c.activePeers["B"] = nil
+	candidate, _ = c.preferredCandidate()
+	assert.Equal(t, "B", candidate)
+}
+
+func TestHandoffCandidate(t *testing.T) {
+	c := newTestControllerWithPriorities("A", map[string]int{"A": 1, "B": 5, "C": 0})
+
+	// B has only just connected
+	c.activePeers["B"] = nil
+	c.activePeers["C"] = nil
+	c.connectedAt["B"] = time.Now()
+	c.connectedAt["C"] = time.Now().Add(-time.Hour)
+	_, ok := c.handoffCandidate()
+	assert.False(t, ok)
+
+	c.connectedAt["B"] = time.Now().Add(-handoffDelay)
+	candidate, ok := c.handoffCandidate()
+	assert.True(t, ok)
+	assert.Equal(t, "B", candidate)
+}
+
+func TestFollowersEchoHandoff(t *testing.T) {
+	c := newTestControllerWithPriorities("B", map[string]int{"A": 0, "B": 0, "C": 5})
+
+	// A was elected in view 0
+	c.electionManager.ProcessVote("A", "A", 0)
+	c.electionManager.ProcessVote("C", "A", 0)
+	leader, err := c.electionManager.Current()
+	assert.Nil(t, err)
+	assert.Equal(t, "A", leader)
+	c.state.SetState("following")
+
+	// A hands off to C, and our echo completes the election
+	c.onVote("A", "C", 1)
+
+	leader, err = c.electionManager.Current()
+	assert.Nil(t, err)
+	assert.Equal(t, "C", leader)
+	assert.Equal(t, int64(1), c.electionManager.View())
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+const proposeMethod = "cluster.propose"
+
+// Proposals submitted without a deadline give up after this long
+const DefaultProposalTimeout = 5 * time.Second
+
+// ProposalHandler services proposals on the leader, regardless of which member they were
+// submitted to.  The from argument identifies the member that submitted the proposal.
+type ProposalHandler func(ctx context.Context, from string, proposal []byte) ([]byte, error)
+
+// HandleProposals registers the handler that services proposals while this node leads
+func (self *Node) HandleProposals(handler ProposalHandler) {
+	if handler == nil {
+		self.router.HandleCall(proposeMethod, nil)
+		return
+	}
+
+	self.router.HandleCall(proposeMethod, func(ctx context.Context, from string, proposal []byte) ([]byte, error) {
+		// We may have been deposed while the proposal was in flight
+		if self.controller.Leader().Leader != self.Id() {
+			return nil, ErrNotLeader
+		}
+
+		return handler(ctx, from, proposal)
+	})
+}
+
+// Propose submits a proposal to the current leader and returns its result.  Proposals made
+// on a follower are forwarded to the leader, and proposals made during an election wait
+// for it to complete.  ErrNotLeader and ErrNoQuorum are returned if no leader emerges
+// before the deadline, and may be retried.
+func (self *Node) Propose(ctx context.Context, proposal []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultProposalTimeout)
+		defer cancel()
+	}
+
+	return self.CallLeader(ctx, proposeMethod, proposal)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestProposeWithoutQuorum(t *testing.T) {
+	cert, tlsCert := newTestCertificate(t, "localhost:0")
+	self := NewIdentity(cert)
+
+	node := NewNode(self, tlsCert, IdentityMap{self.Id: self})
+	node.HandleProposals(func(ctx context.Context, from string, proposal []byte) ([]byte, error) {
+		t.Fatal("proposal should not have been serviced")
+		return nil, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// The controller never runs, so the node remains convening
+	_, err := node.Propose(ctx, []byte("work"))
+	assert.Equal(t, ErrNoQuorum, err)
+}
+
+func TestCallLeaderContextErrors(t *testing.T) {
+	node := newTestLeader(t, "A", "A", "B")
+
+	// The leader is known, but not connected, so the deadline passes while retrying
+	setLeadership(node, "B", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := node.CallLeader(ctx, "test", nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// A caller that gives up is told so, even while no leader is known
+	setLeadership(node, "", 2)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err = node.CallLeader(ctx, "test", nil)
+	assert.Equal(t, context.Canceled, err)
+}
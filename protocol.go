@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ghaskins/go-cluster/pb"
+	"github.com/golang/protobuf/proto"
+	"sort"
+)
+
+const protocolMagic = "cluster"
+
+const (
+	// Version 1 predates negotiation: both ends had to run the same version, which knew
+	// only heartbeats and votes
+	legacyProtocolVersion = 1
+	// From version 2, each end advertises its features and uses only those both support
+	negotiatedProtocolVersion = 2
+)
+
+// Features that a peer may or may not support, named as they appear in Negotiate.options.
+// A feature is needed to send the messages that belong to it.
+const (
+	FeatureApplication  = "application"   // application messages
+	FeatureRpc          = "rpc"           // requests, responses and cancellations
+	FeatureHeartbeatAck = "heartbeat-ack" // acknowledgements of heartbeats
+	FeatureReplication  = "replication"   // log replication and snapshots
+)
+
+var ErrUnsupported = errors.New("peer does not support the message")
+
+// legacyFeatures are those a peer speaking version 1 supports: none at all.  It skips the
+// header of any message other than a heartbeat or vote without reading the payload, so
+// sending it anything else would corrupt the rest of the stream.
+var legacyFeatures []string
+
+// protocol describes the range of wire protocol versions and the features we support
+type protocol struct {
+	minVersion int32
+	maxVersion int32
+	features   []string
+}
+
+var localProtocol = &protocol{
+	minVersion: legacyProtocolVersion,
+	maxVersion: negotiatedProtocolVersion,
+	features:   []string{FeatureApplication, FeatureRpc, FeatureHeartbeatAck, FeatureReplication},
+}
+
+// agreement is what the two ends of a connection negotiated
+type agreement struct {
+	version  int32
+	features map[string]bool
+}
+
+// offer is sent by the dialing end.  The version field holds our lowest version, which a
+// peer running version 1 will accept so long as we still speak it.
+func (self *protocol) offer() *pb.Negotiate {
+	return &pb.Negotiate{
+		Magic:      proto.String(protocolMagic),
+		Version:    proto.Int32(self.minVersion),
+		MaxVersion: proto.Int32(self.maxVersion),
+		Options:    self.features,
+	}
+}
+
+// negotiate settles on the highest version and the features both we and the peer support
+func (self *protocol) negotiate(theirs *pb.Negotiate) (*agreement, error) {
+	minVersion, maxVersion := theirs.GetVersion(), theirs.GetMaxVersion()
+	if theirs.MaxVersion == nil {
+		maxVersion = minVersion // a peer predating negotiation speaks a single version
+	}
+
+	if theirs.GetMagic() != protocolMagic || maxVersion < self.minVersion || minVersion > self.maxVersion {
+		return nil, fmt.Errorf("incompatible wire protocol (ours: %d-%d, theirs: %v)", self.minVersion, self.maxVersion, theirs)
+	}
+
+	result := &agreement{version: maxVersion, features: make(map[string]bool)}
+	if result.version > self.maxVersion {
+		result.version = self.maxVersion
+	}
+
+	offered := theirs.GetOptions()
+	if result.version == legacyProtocolVersion {
+		offered = legacyFeatures
+	}
+
+	for _, feature := range offered {
+		for _, ours := range self.features {
+			if feature == ours {
+				result.features[feature] = true
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// reply is sent by the accepting end with the version and features agreed.  The version
+// field holds the version agreed, which is all a peer running version 1 looks at.
+func (self *agreement) reply() *pb.Negotiate {
+	msg := &pb.Negotiate{
+		Magic:      proto.String(protocolMagic),
+		Version:    proto.Int32(self.version),
+		MaxVersion: proto.Int32(self.version),
+	}
+
+	for feature := range self.features {
+		msg.Options = append(msg.Options, feature)
+	}
+	sort.Strings(msg.Options)
+
+	return msg
+}
+
+// messageFeature returns the feature needed to send a message, if any
+func messageFeature(t pb.Type) string {
+	switch t {
+	case pb.Type_APPLICATION:
+		return FeatureApplication
+	case pb.Type_REQUEST, pb.Type_RESPONSE, pb.Type_CANCEL:
+		return FeatureRpc
+	case pb.Type_HEARTBEAT_ACK:
+		return FeatureHeartbeatAck
+	case pb.Type_APPEND_ENTRIES, pb.Type_APPEND_RESPONSE, pb.Type_INSTALL_SNAPSHOT, pb.Type_SNAPSHOT_ACK,
+		pb.Type_LOG_QUERY, pb.Type_LOG_STATE, pb.Type_LOG_FETCH:
+		return FeatureReplication
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"github.com/ghaskins/go-cluster/pb"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// A release predating negotiation: it offers exactly version 1, and accepts only that
+var legacyOffer = &pb.Negotiate{Magic: proto.String("cluster"), Version: proto.Int32(1)}
+
+func legacyAccepts(theirs *pb.Negotiate) bool {
+	return theirs.GetMagic() == legacyOffer.GetMagic() && theirs.GetVersion() == legacyOffer.GetVersion()
+}
+
+// A future release, which has dropped version 1 and added a feature
+var futureProtocol = &protocol{
+	minVersion: 2,
+	maxVersion: 3,
+	features:   []string{FeatureApplication, FeatureRpc, FeatureReplication, "compression"},
+}
+
+func TestNegotiateVersions(t *testing.T) {
+	// A legacy peer accepts our offer, and we agree on version 1 with its features
+	assert.True(t, legacyAccepts(localProtocol.offer()))
+
+	agreed, err := localProtocol.negotiate(legacyOffer)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), agreed.version)
+	assert.Equal(t, 0, len(agreed.features))
+	assert.True(t, legacyAccepts(agreed.reply()))
+
+	// Two current peers agree on the latest version and all features
+	agreed, err = localProtocol.negotiate(localProtocol.offer())
+	assert.Nil(t, err)
+	assert.Equal(t, int32(negotiatedProtocolVersion), agreed.version)
+	assert.Equal(t, len(localProtocol.features), len(agreed.features))
+
+	// With a future peer, we agree on the highest version we share and the common features
+	for _, pair := range [][2]*protocol{{localProtocol, futureProtocol}, {futureProtocol, localProtocol}} {
+		server, client := pair[0], pair[1]
+
+		agreed, err := server.negotiate(client.offer())
+		assert.Nil(t, err)
+		assert.Equal(t, int32(2), agreed.version)
+		assert.False(t, agreed.features["compression"])
+		assert.False(t, agreed.features[FeatureHeartbeatAck])
+		assert.True(t, agreed.features[FeatureRpc])
+
+		// The client reaches the same agreement from the reply
+		confirmed, err := client.negotiate(agreed.reply())
+		assert.Nil(t, err)
+		assert.Equal(t, agreed, confirmed)
+	}
+
+	// A future peer no longer speaks to a legacy one
+	_, err = futureProtocol.negotiate(legacyOffer)
+	assert.NotNil(t, err)
+	assert.False(t, legacyAccepts(futureProtocol.offer()))
+
+	_, err = localProtocol.negotiate(&pb.Negotiate{Magic: proto.String("other"), Version: proto.Int32(1)})
+	assert.NotNil(t, err)
+}
+
+func TestNegotiateOverConnection(t *testing.T) {
+	for _, pair := range [][2]*protocol{
+		{localProtocol, localProtocol},
+		{localProtocol, futureProtocol},
+		{futureProtocol, localProtocol},
+	} {
+		a, b := newTestConnectionPair(t)
+
+		errs := make(chan error)
+		go func() {
+			errs <- a.acceptProtocol(pair[0])
+		}()
+
+		assert.Nil(t, b.offerProtocol(pair[1]))
+		assert.Nil(t, <-errs)
+		assert.Equal(t, a.protocol, b.protocol)
+
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestUnsupportedMessages(t *testing.T) {
+	a, b := newTestConnectionPair(t)
+	a.protocol = &agreement{version: 2, features: map[string]bool{}}
+
+	sender, _, _ := newTestPeer(a)
+	receiver, rx, _ := newTestPeer(b)
+	sender.Run()
+	receiver.Run()
+	defer sender.Close()
+	defer receiver.Close()
+
+	assert.Equal(t, ErrUnsupported, sender.Send(newApplication("test", []byte("hello"))))
+	assert.False(t, sender.trySend(&pb.HeartbeatAck{}))
+
+	// Messages we don't understand are skipped without losing our place in the stream
+	unknown := pb.Type(99)
+	assert.Nil(t, a.Send(&pb.Header{Type: &unknown}, &pb.Vote{PeerId: proto.String("unknown")}))
+
+	viewId := int64(5)
+	assert.Nil(t, sender.Send(&pb.Heartbeat{ViewId: &viewId}))
+
+	select {
+	case msg := <-rx:
+		hb, ok := msg.Payload.(*pb.Heartbeat)
+		assert.True(t, ok)
+		assert.Equal(t, viewId, hb.GetViewId())
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for heartbeat")
+	}
+}
+
+// legacyReceive reads messages as a release predating negotiation did: it understands only
+// heartbeats and votes, and skips the header of anything else without reading its payload
+func legacyReceive(conn *Connection, rx chan<- proto.Message) {
+	defer close(rx)
+
+	for {
+		header := &pb.Header{}
+		if err := conn.Recv(header); err != nil {
+			return
+		}
+
+		var payload proto.Message
+
+		switch header.GetType() {
+		case pb.Type_HEARTBEAT:
+			payload = new(pb.Heartbeat)
+		case pb.Type_VOTE:
+			payload = new(pb.Vote)
+		default:
+			continue
+		}
+
+		if err := conn.Recv(payload); err != nil {
+			return
+		}
+
+		rx <- payload
+	}
+}
+
+func TestLegacyPeerStreamIntact(t *testing.T) {
+	a, b := newTestConnectionPair(t)
+	defer b.Close()
+
+	agreed, err := localProtocol.negotiate(legacyOffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.protocol = agreed
+
+	sender, _, _ := newTestPeer(a)
+	sender.Run()
+	defer sender.Close()
+
+	rx := make(chan proto.Message, 10)
+	go legacyReceive(b, rx)
+
+	// Nothing but heartbeats and votes is sent its way
+	viewId := int64(3)
+	for _, msg := range []proto.Message{
+		newApplication("test", []byte("hello")),
+		&pb.Request{},
+		&pb.HeartbeatAck{ViewId: &viewId},
+		&pb.AppendEntries{},
+		&pb.LogQuery{},
+	} {
+		assert.Equal(t, ErrUnsupported, sender.Send(msg), "%T", msg)
+	}
+
+	assert.Nil(t, sender.Send(&pb.Heartbeat{ViewId: &viewId}))
+	assert.Nil(t, sender.Send(&pb.Vote{ViewId: &viewId, PeerId: proto.String("A")}))
+
+	for _, expected := range []proto.Message{
+		&pb.Heartbeat{ViewId: &viewId},
+		&pb.Vote{ViewId: &viewId, PeerId: proto.String("A")},
+	} {
+		select {
+		case msg, ok := <-rx:
+			if !ok {
+				t.Fatal("the stream was corrupted")
+			}
+			assert.True(t, proto.Equal(expected, msg), "%v", msg)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a message")
+		}
+	}
+}
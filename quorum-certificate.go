@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ghaskins/go-cluster/pb"
+	"github.com/golang/protobuf/proto"
+	"sort"
+)
+
+// recordVote retains the latest signed vote cast by each member, so that a leader can
+// present the votes that elected it as a quorum certificate
+func (self *Controller) recordVote(voter string, msg *pb.Vote) {
+	if existing, ok := self.signedVotes[voter]; ok && existing.GetViewId() > msg.GetViewId() {
+		return
+	}
+
+	self.signedVotes[voter] = msg
+}
+
+// buildCertificate gathers the signed votes that elected us in the current view.  It
+// returns nil if we hold too few of them, for instance because signatures are disabled.
+func (self *Controller) buildCertificate() *pb.QuorumCertificate {
+	view := self.electionManager.View()
+	qc := &pb.QuorumCertificate{
+		ViewId: proto.Int64(view),
+		Leader: proto.String(self.myId),
+	}
+
+	var voters []string
+	for voter := range self.signedVotes {
+		voters = append(voters, voter)
+	}
+	sort.Strings(voters)
+
+	for _, voter := range voters {
+		vote := self.signedVotes[voter]
+		if vote.GetViewId() == view && vote.GetPeerId() == self.myId {
+			qc.Votes = append(qc.Votes, vote)
+		}
+	}
+
+	if len(qc.Votes) < self.electionManager.Threshold() {
+		return nil
+	}
+
+	return qc
+}
+
+// verifyCertificate checks that a quorum of voters signed votes for the certificate's
+// leader in its view
+func (self *Controller) verifyCertificate(qc *pb.QuorumCertificate) error {
+	if self.signer == nil {
+		return fmt.Errorf("signatures are not enabled")
+	}
+
+	leader := qc.GetLeader()
+	if !self.isVoter(leader) || !self.electionManager.Eligible(leader) {
+		return fmt.Errorf("%s may not stand for election", leader)
+	}
+
+	voters := make(map[string]bool)
+
+	for _, vote := range qc.GetVotes() {
+		voter, err := self.signer.verifyVote(vote)
+		if err != nil {
+			return err
+		}
+
+		if vote.GetPeerId() != leader || vote.GetViewId() != qc.GetViewId() {
+			return fmt.Errorf("vote by %s is for %s in view %d", voter, vote.GetPeerId(), vote.GetViewId())
+		}
+
+		if self.isVoter(voter) && !self.electionManager.Excluded(voter) {
+			voters[voter] = true
+		}
+	}
+
+	if len(voters) < self.electionManager.Threshold() {
+		return fmt.Errorf("%d votes are short of a quorum of %d", len(voters), self.electionManager.Threshold())
+	}
+
+	return nil
+}
+
+// onCertificate learns the leader from the certificate on its first heartbeat of a view,
+// which lets a member that has just (re)joined follow without holding an election
+func (self *Controller) onCertificate(from string, qc *pb.QuorumCertificate) {
+	switch self.state.Current() {
+	case "following", "leading":
+		return // we already know who leads
+	}
+
+	if qc.GetLeader() != from {
+		fmt.Printf("Dropping certificate from %s for %s\n", from, qc.GetLeader())
+		return
+	}
+
+	if err := self.verifyCertificate(qc); err != nil {
+		fmt.Printf("Dropping certificate from %s: %s\n", from, err.Error())
+		return
+	}
+
+	if self.state.Current() == "convening" {
+		// We can't follow until we have a quorum, so hold on to it until then
+		self.pendingCert = qc
+		return
+	}
+
+	self.adoptCertificate(qc)
+}
+
+func (self *Controller) adoptCertificate(qc *pb.QuorumCertificate) {
+	fmt.Printf("%s proved its election in view %d\n", qc.GetLeader(), qc.GetViewId())
+
+	if err := self.electionManager.Certify(qc.GetLeader(), qc.GetViewId()); err != nil {
+		fmt.Printf("Dropping certificate from %s: %s\n", qc.GetLeader(), err.Error())
+	}
+}
+
+// announceSigned tells a newly connected peer what we know of the election.  Signed votes
+// are binding, so we only vouch for what we can prove: our election while leading, and
+// otherwise the vote we actually cast.
+func (self *Controller) announceSigned(peer *Peer) {
+	if self.state.Current() == "leading" && self.certificate != nil {
+		peer.Send(self.newHeartbeat(self.certificate))
+		return
+	}
+
+	if vote, ok := self.signedVotes[self.myId]; ok {
+		peer.Send(vote)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"github.com/ghaskins/go-cluster/pb"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// newTestSignedControllers returns a controller with signatures enabled for each member
+func newTestSignedControllers(t *testing.T, ids ...string) map[string]*Controller {
+	signers := newTestSigners(t, ids...)
+
+	controllers := make(map[string]*Controller)
+	for _, id := range ids {
+		c := NewController(id, signers[id].members, nil, NewRouter())
+		c.enableSignatures(signers[id])
+		controllers[id] = c
+	}
+
+	return controllers
+}
+
+// elect records signed votes for the leader at c, as though they had arrived over the network
+func elect(c *Controller, controllers map[string]*Controller, leader string, view int64, voters ...string) {
+	for _, voter := range voters {
+		vote := controllers[voter].newVote(leader, view)
+		from, _ := c.voteOrigin(voter, vote)
+		c.recordVote(from, vote)
+		c.electionManager.ProcessVote(from, leader, view)
+	}
+}
+
+func TestQuorumCertificate(t *testing.T) {
+	controllers := newTestSignedControllers(t, "A", "B", "C", "D", "E")
+	a := controllers["A"]
+
+	// Too few votes to prove anything
+	elect(a, controllers, "A", 0, "A", "B")
+	assert.Nil(t, a.buildCertificate())
+
+	// Votes for others, or in other views, are left out
+	elect(a, controllers, "A", 0, "C")
+	elect(a, controllers, "B", 0, "D")
+	assert.Equal(t, int64(0), a.electionManager.View())
+
+	qc := a.buildCertificate()
+	assert.NotNil(t, qc)
+	assert.Len(t, qc.Votes, 3)
+
+	// Every member can verify the certificate
+	for _, c := range controllers {
+		assert.Nil(t, c.verifyCertificate(qc))
+	}
+
+	b := controllers["B"]
+
+	// Removing a vote leaves it short of quorum
+	short := proto.Clone(qc).(*pb.QuorumCertificate)
+	short.Votes = short.Votes[1:]
+	assert.NotNil(t, b.verifyCertificate(short))
+
+	// Counting the same voter twice doesn't help
+	short.Votes = append(short.Votes, short.Votes[0])
+	assert.NotNil(t, b.verifyCertificate(short))
+
+	// Nor can the certificate be reused for another leader or view
+	forged := proto.Clone(qc).(*pb.QuorumCertificate)
+	forged.Leader = proto.String("B")
+	assert.NotNil(t, b.verifyCertificate(forged))
+
+	forged = proto.Clone(qc).(*pb.QuorumCertificate)
+	forged.ViewId = proto.Int64(1)
+	assert.NotNil(t, b.verifyCertificate(forged))
+}
+
+func TestCertificateAdoptedOnReconnect(t *testing.T) {
+	controllers := newTestSignedControllers(t, "A", "B", "C")
+	a := controllers["A"]
+
+	elect(a, controllers, "A", 3, "A", "B")
+	qc := a.buildCertificate()
+	assert.NotNil(t, qc)
+
+	// C was away for the election, and learns the outcome from the certificate alone
+	c := controllers["C"]
+	c.state.SetState("initializing")
+
+	c.onCertificate("B", qc)
+	_, err := c.electionManager.Current()
+	assert.NotNil(t, err)
+
+	c.onCertificate("A", qc)
+	leader, err := c.electionManager.Current()
+	assert.Nil(t, err)
+	assert.Equal(t, "A", leader)
+	assert.Equal(t, int64(3), c.electionManager.View())
+	assert.True(t, <-c.electionManager.C)
+}
+
+func TestCertificateHeldUntilQuorum(t *testing.T) {
+	controllers := newTestSignedControllers(t, "A", "B", "C")
+	a := controllers["A"]
+
+	elect(a, controllers, "A", 0, "A", "B")
+	qc := a.buildCertificate()
+
+	c := controllers["C"]
+	c.onCertificate("A", qc)
+	_, err := c.electionManager.Current()
+	assert.NotNil(t, err)
+
+	c.state.SetState("initializing")
+	c.onInitializing()
+	leader, err := c.electionManager.Current()
+	assert.Nil(t, err)
+	assert.Equal(t, "A", leader)
+}
+
+func TestFirstHeartbeatCarriesCertificate(t *testing.T) {
+	controllers := newTestSignedControllers(t, "A", "B", "C")
+	a := controllers["A"]
+
+	elect(a, controllers, "A", 0, "A", "B")
+	a.certificate = a.buildCertificate()
+
+	b := controllers["B"]
+	first := a.newHeartbeat(a.certificate)
+	leader, err := b.signer.verifyHeartbeat(first)
+	assert.Nil(t, err)
+	assert.Equal(t, "A", leader)
+	assert.Nil(t, b.verifyCertificate(first.GetCertificate()))
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+type reloadRequest struct {
+	key     crypto.PrivateKey
+	members IdentityMap
+	result  chan error
+}
+
+// Reload replaces this node's certificate and key, along with the certificates, priorities
+// and never-leader settings of the other members, without a restart.  The membership itself
+// cannot change, so every member must keep its identity; rotating to a new certificate
+// therefore requires an identity scheme other than CertificateScheme.  Adding, removing or
+// changing the observers among the members requires a restart, and such a reload fails.
+// Connections already established are unaffected.  It may be called from any goroutine
+// once the node is running, and returns ErrStopped once the node is stopped.
+func (self *Node) Reload(tlsCert *tls.Certificate, members IdentityMap) error {
+	member, ok := members[self.Id()]
+	if !ok {
+		return fmt.Errorf("%s is no longer a member", self.Id())
+	}
+
+	if err := checkKeyPair(member.Cert, tlsCert.PrivateKey); err != nil {
+		return err
+	}
+
+	req := &reloadRequest{key: tlsCert.PrivateKey, members: members, result: make(chan error, 1)}
+	select {
+	case self.controller.reloads <- req:
+	case <-self.done:
+		return ErrStopped
+	}
+
+	select {
+	case err := <-req.result:
+		if err != nil {
+			return err
+		}
+	case <-self.done:
+		return ErrStopped
+	}
+
+	self.connMgr.reload(tlsCert, members)
+	return nil
+}
+
+func checkKeyPair(cert *x509.Certificate, key crypto.PrivateKey) error {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("private key of type %T is not supported", key)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(der, cert.RawSubjectPublicKeyInfo) {
+		return fmt.Errorf("private key does not match the certificate for %s", cert.Subject.CommonName)
+	}
+
+	return nil
+}
+
+// reload adopts new certificates and election settings for the existing members, and a new
+// key for ourselves
+func (self *Controller) reload(key crypto.PrivateKey, members IdentityMap) error {
+	for id := range members {
+		if _, ok := self.peers[id]; !ok {
+			return fmt.Errorf("membership changes require a restart: %s is not a member", id)
+		}
+	}
+
+	updated := IdentityMap{}
+
+	for id, current := range self.peers {
+		member, ok := members[id]
+		if !ok {
+			return fmt.Errorf("membership changes require a restart: %s is missing", id)
+		}
+
+		// Observers don't count toward quorum, so they are part of the membership
+		if member.Observer != current.Observer {
+			return fmt.Errorf("membership changes require a restart: %s changes whether it observes", id)
+		}
+
+		identity := current.withCert(member.Cert)
+		identity.Priority = member.Priority
+		identity.NeverLeader = member.NeverLeader
+
+		updated[id] = identity
+	}
+
+	if self.signer != nil {
+		signer, err := newSigner(self.myId, key, updated)
+		if err != nil {
+			return err
+		}
+		self.signer = signer
+	}
+
+	// New settings apply from the next election, and any leader that is now outranked will
+	// hand off as usual
+	for id, member := range updated {
+		self.electionManager.SetPriority(id, member.Priority)
+		self.electionManager.SetEligible(id, !member.NeverLeader && !member.Observer)
+	}
+
+	self.peers = updated
+	fmt.Printf("reloaded certificates and settings for %d members\n", len(updated))
+
+	return nil
+}
+
+// memberFiles are the files that define this member and the cluster it belongs to
+type memberFiles struct {
+	index          int // our certificate's position in the membership file
+	keyPath        string
+	passphrase     Passphrase
+	passphraseFile string // that the passphrase is read from, if any
+	certsPath      string
+	ca             string
+	configPath     string
+	denylist       string
+	crl            string
+	crlIssuer      string
+	scheme         IdentityScheme
+}
+
+func (self *memberFiles) load() (*Identity, *tls.Certificate, IdentityMap, error) {
+	issuers, err := self.loadIssuers()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	certs, err := ParseCertificatesIssuedBy(self.certsPath, issuers)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if self.index >= len(certs) {
+		return nil, nil, nil, fmt.Errorf("invalid index %d into %d certificates", self.index, len(certs))
+	}
+
+	members := IdentityMap{}
+
+	for _, cert := range certs {
+		member := NewIdentityWithScheme(cert, self.scheme)
+		if _, ok := members[member.Id]; ok {
+			return nil, nil, nil, fmt.Errorf("%s appears more than once", member.Id)
+		}
+		members[member.Id] = member
+	}
+
+	if self.configPath != "" {
+		config, err := LoadConfig(self.configPath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if err := config.Apply(members); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	member := members[NewIdentityWithScheme(certs[self.index], self.scheme).Id]
+
+	tlsCert, err := CreateTlsIdentity(member.Cert, self.keyPath, self.passphrase)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return member, tlsCert, members, nil
+}
+
+// loadIssuers returns the CAs trusted to issue member certificates, or nil if there are none
+func (self *memberFiles) loadIssuers() ([]*x509.Certificate, error) {
+	if self.ca == "" {
+		return nil, nil
+	}
+
+	issuers, err := ParseCertificates(self.ca)
+	if err != nil {
+		return nil, err
+	}
+	if len(issuers) == 0 {
+		return nil, fmt.Errorf("no CA certificates found in \"%s\"", self.ca)
+	}
+
+	return issuers, nil
+}
+
+// loadRevocations returns nil if neither a denylist nor a CRL is configured
+func (self *memberFiles) loadRevocations() (*Revocations, error) {
+	if self.denylist == "" && self.crl == "" {
+		return nil, nil
+	}
+
+	revocations := NewRevocations()
+
+	if self.denylist != "" {
+		var err error
+		if revocations, err = LoadDenylist(self.denylist); err != nil {
+			return nil, err
+		}
+	}
+
+	if self.crl != "" {
+		if err := revocations.LoadCRL(self.crl, self.crlIssuer); err != nil {
+			return nil, err
+		}
+	}
+
+	return revocations, nil
+}
+
+// loadTLSPolicy returns the default policy unless the config has a tls block
+func (self *memberFiles) loadTLSPolicy() (*TLSPolicy, error) {
+	if self.configPath == "" {
+		return DefaultTLSPolicy(), nil
+	}
+
+	config, err := LoadConfig(self.configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return config.TLS.Policy()
+}
+
+// stamp summarizes the state of the files, so that we can tell when any of them changes
+func (self *memberFiles) stamp() string {
+	var stamp string
+
+	for _, path := range []string{self.keyPath, self.passphraseFile, self.certsPath, self.ca, self.configPath, self.denylist, self.crl, self.crlIssuer} {
+		if info, err := os.Stat(path); err == nil {
+			stamp += fmt.Sprintf("%s:%d:%d;", path, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+
+	return stamp
+}
+
+// watch reloads the node, including its CA, revocations and TLS policy, whenever we receive SIGHUP, and also
+// when the files change if an interval to check them at is given
+func (self *memberFiles) watch(node *Node, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+
+	stamp := self.stamp()
+
+	for {
+		select {
+		case <-hup:
+			fmt.Printf("reloading on SIGHUP\n")
+		case <-tick:
+			if latest := self.stamp(); latest != stamp {
+				fmt.Printf("reloading changed files\n")
+			} else {
+				continue
+			}
+		}
+
+		stamp = self.stamp()
+
+		_, tlsCert, members, err := self.load()
+		if err == nil {
+			err = node.Reload(tlsCert, members)
+		}
+		if err != nil {
+			log.Printf("Reload failed: %s", err.Error())
+		}
+
+		if issuers, err := self.loadIssuers(); err != nil {
+			log.Printf("Reloading the CA failed: %s", err.Error())
+		} else {
+			node.SetIssuers(issuers)
+		}
+
+		revocations, err := self.loadRevocations()
+		if err != nil {
+			log.Printf("Reloading revocations failed: %s", err.Error())
+		} else {
+			// Revocations no longer configured are lifted
+			if revocations == nil {
+				revocations = NewRevocations()
+			}
+			node.SetRevocations(revocations)
+		}
+
+		policy, err := self.loadTLSPolicy()
+		if err != nil {
+			log.Printf("Reloading the TLS policy failed: %s", err.Error())
+		} else {
+			node.SetTLSPolicy(policy)
+		}
+	}
+}
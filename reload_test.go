@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/ghaskins/go-cluster/pb"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestIdentitySchemes(t *testing.T) {
+	key := newTestKey(t)
+	original, _ := newTestCertificateWithKey(t, "localhost:2001", &key.PublicKey, key)
+	renewed, _ := newTestCertificateWithKey(t, "localhost:2001", &key.PublicKey, key)
+
+	rotatedKey := newTestKey(t)
+	rotated, _ := newTestCertificateWithKey(t, "localhost:2001", &rotatedKey.PublicKey, rotatedKey)
+
+	cases := []struct {
+		scheme  IdentityScheme
+		renewed bool // whether renewing the certificate keeps the identity
+		rotated bool // whether rotating the key keeps the identity
+	}{
+		{CertificateScheme, false, false},
+		{PublicKeyScheme, true, false},
+		{NameScheme, true, true},
+	}
+
+	for _, c := range cases {
+		parsed, err := ParseIdentityScheme(c.scheme.String())
+		assert.Nil(t, err)
+		assert.Equal(t, c.scheme, parsed)
+
+		id := NewIdentityWithScheme(original, c.scheme).Id
+		assert.Equal(t, c.renewed, id == NewIdentityWithScheme(renewed, c.scheme).Id, "%s", c.scheme)
+		assert.Equal(t, c.rotated, id == NewIdentityWithScheme(rotated, c.scheme).Id, "%s", c.scheme)
+	}
+
+	_, err := ParseIdentityScheme("fingerprint")
+	assert.NotNil(t, err)
+
+	// Sharing a name is not enough to authenticate as a member
+	member := NewIdentityWithScheme(original, NameScheme)
+	assert.True(t, member.Authenticates(renewed))
+	assert.False(t, member.Authenticates(rotated))
+}
+
+func TestControllerReload(t *testing.T) {
+	controllers := newTestSignedControllers(t, "A", "B", "C")
+	a, b := controllers["A"], controllers["B"]
+
+	// B rotates its key, and everyone reloads
+	key := newTestKey(t)
+	cert, _ := newTestCertificateWithKey(t, "B", &key.PublicKey, key)
+
+	members := IdentityMap{}
+	for id, member := range a.peers {
+		members[id] = member.withCert(member.Cert)
+	}
+	members["B"] = members["B"].withCert(cert)
+
+	assert.Nil(t, b.reload(key, members))
+	assert.Nil(t, a.reload(a.signer.key, members))
+
+	voter, err := a.signer.verifyVote(b.newVote("B", 0))
+	assert.Nil(t, err)
+	assert.Equal(t, "B", voter)
+
+	// Votes signed with the old key are no longer accepted
+	old := newTestSignedControllers(t, "A", "B", "C")["B"]
+	_, err = a.signer.verifyVote(old.newVote("B", 0))
+	assert.NotNil(t, err)
+
+	// Members can't come or go
+	delete(members, "C")
+	assert.NotNil(t, a.reload(a.signer.key, members))
+
+	members["C"] = a.peers["C"]
+	members["D"] = a.peers["C"].withCert(cert)
+	assert.NotNil(t, a.reload(a.signer.key, members))
+
+	// Nor can they start or stop observing
+	members["C"] = a.peers["C"].withCert(a.peers["C"].Cert)
+	delete(members, "D")
+	members["C"].Observer = true
+	assert.NotNil(t, a.reload(a.signer.key, members))
+
+	// But their election settings apply straight away
+	members["C"].Observer = false
+	members["C"].Priority = 5
+	members["B"].NeverLeader = true
+	assert.Nil(t, a.reload(a.signer.key, members))
+	assert.Equal(t, 5, a.electionManager.Priority("C"))
+	assert.False(t, a.electionManager.Eligible("B"))
+	assert.Equal(t, 5, a.peers["C"].Priority)
+
+	// Our key must match our certificate
+	assert.NotNil(t, checkKeyPair(a.peers["A"].Cert, key))
+	assert.Nil(t, checkKeyPair(cert, key))
+}
+
+func writeTestPem(t *testing.T, path, kind string, ders ...[]byte) {
+	var data []byte
+	for _, der := range ders {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})...)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemberFilesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := &memberFiles{
+		index:          0,
+		keyPath:        filepath.Join(dir, "key.pem"),
+		passphraseFile: filepath.Join(dir, "passphrase"),
+		certsPath:      filepath.Join(dir, "certs.conf"),
+		scheme:         NameScheme,
+	}
+
+	write := func(key *ecdsa.PrivateKey) {
+		cert, _ := newTestCertificateWithKey(t, "localhost:2001", &key.PublicKey, key)
+		other, _ := newTestCertificate(t, "localhost:2002")
+		writeTestPem(t, files.certsPath, "CERTIFICATE", cert.Raw, other.Raw)
+
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestPem(t, files.keyPath, "EC PRIVATE KEY", der)
+	}
+
+	write(newTestKey(t))
+	self, _, members, err := files.load()
+	assert.Nil(t, err)
+	assert.Equal(t, "localhost:2001", self.Id)
+	assert.Len(t, members, 2)
+
+	stamp := files.stamp()
+
+	// Rotating our key keeps our identity
+	key := newTestKey(t)
+	write(key)
+	assert.NotEqual(t, stamp, files.stamp())
+
+	rotated, tlsCert, _, err := files.load()
+	assert.Nil(t, err)
+	assert.Equal(t, self.Id, rotated.Id)
+	assert.Equal(t, key, tlsCert.PrivateKey)
+	assert.NotEqual(t, self.Cert.Raw, rotated.Cert.Raw)
+
+	// Changing the passphrase file alone is noticed too
+	stamp = files.stamp()
+	if err := ioutil.WriteFile(files.passphraseFile, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, stamp, files.stamp())
+}
+
+func TestReloadAfterStop(t *testing.T) {
+	cert, tlsCert := newTestCertificate(t, "localhost:0")
+	self := NewIdentity(cert)
+	members := IdentityMap{self.Id: self}
+
+	// The controller never runs, so only the node being stopped can end the reload
+	node := NewNode(self, tlsCert, members)
+	node.Stop()
+
+	assert.Equal(t, ErrStopped, node.Reload(tlsCert, members))
+}
+
+func TestReloadedSignerSignsWithNewKey(t *testing.T) {
+	controllers := newTestSignedControllers(t, "A", "B")
+	a := controllers["A"]
+
+	key := newTestKey(t)
+	cert, _ := newTestCertificateWithKey(t, "A", &key.PublicKey, key)
+	members := IdentityMap{"A": a.peers["A"].withCert(cert), "B": a.peers["B"]}
+	assert.Nil(t, a.reload(key, members))
+
+	msg := &pb.Heartbeat{ViewId: proto.Int64(0), Seq: proto.Uint64(1)}
+	assert.Nil(t, a.signer.signHeartbeat(msg))
+
+	leader, err := a.signer.verifyHeartbeat(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, "A", leader)
+}
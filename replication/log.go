@@ -0,0 +1,250 @@
+package replication
+
+import (
+	"errors"
+	"github.com/ghaskins/go-cluster/pb"
+)
+
+var ErrSnapshotMismatch = errors.New("snapshot does not match the log")
+
+// Log is a replicated log.  Entries are numbered from 1.  Everything up to and including
+// the snapshot index has been compacted away and is represented only by the snapshot
+// itself.
+type Log struct {
+	snapshotIndex uint64
+	snapshotView  int64
+	snapshot      []byte
+	entries       []*pb.Entry // entries[0] has index snapshotIndex+1
+	bytes         uint64      // the payload size of entries
+	store         *store      // nil if the log is held in memory only
+}
+
+// NewLog returns an empty log that is held in memory only
+func NewLog() *Log {
+	return &Log{}
+}
+
+func (self *Log) LastIndex() uint64 {
+	return self.snapshotIndex + uint64(len(self.entries))
+}
+
+func (self *Log) LastView() int64 {
+	if len(self.entries) == 0 {
+		return self.snapshotView
+	}
+
+	return self.entries[len(self.entries)-1].GetViewId()
+}
+
+func (self *Log) SnapshotIndex() uint64 {
+	return self.snapshotIndex
+}
+
+// Snapshot returns the most recent snapshot along with the index and view of the last
+// entry it contains
+func (self *Log) Snapshot() (uint64, int64, []byte) {
+	return self.snapshotIndex, self.snapshotView, self.snapshot
+}
+
+// Len reports the number of entries that have not been compacted, and their size
+func (self *Log) Len() (int, uint64) {
+	return len(self.entries), self.bytes
+}
+
+// ViewAt returns the view of the entry at index.  The entry at the snapshot index is
+// still known even though it has been compacted.
+func (self *Log) ViewAt(index uint64) (int64, bool) {
+	switch {
+	case index == self.snapshotIndex:
+		return self.snapshotView, true
+	case index < self.snapshotIndex || index > self.LastIndex():
+		return 0, false
+	default:
+		return self.entries[index-self.snapshotIndex-1].GetViewId(), true
+	}
+}
+
+// Get returns the entry at index, which must not have been compacted
+func (self *Log) Get(index uint64) (*pb.Entry, bool) {
+	if index <= self.snapshotIndex || index > self.LastIndex() {
+		return nil, false
+	}
+
+	return self.entries[index-self.snapshotIndex-1], true
+}
+
+// Entries returns up to maxBytes worth of entries starting at index, but always at least
+// one entry if any are available.  The returned slice is a copy and remains valid after
+// the log is modified.
+func (self *Log) Entries(index uint64, maxBytes uint64) []*pb.Entry {
+	if index <= self.snapshotIndex || index > self.LastIndex() {
+		return nil
+	}
+
+	var size uint64
+	start := index - self.snapshotIndex - 1
+	end := start
+
+	for end < uint64(len(self.entries)) {
+		size += uint64(len(self.entries[end].GetData()))
+		if size > maxBytes && end > start {
+			break
+		}
+		end++
+	}
+
+	return append([]*pb.Entry(nil), self.entries[start:end]...)
+}
+
+// Slice returns a copy of the entries from first through last inclusive, all of which
+// must be present in the log
+func (self *Log) Slice(first, last uint64) []*pb.Entry {
+	if first <= self.snapshotIndex || last > self.LastIndex() {
+		panic("log slice out of range")
+	}
+
+	if first > last {
+		return nil
+	}
+
+	return append([]*pb.Entry(nil), self.entries[first-self.snapshotIndex-1:last-self.snapshotIndex]...)
+}
+
+// Matches reports whether our log contains an entry at index from the given view, which
+// by induction means that the logs are identical up to that point
+func (self *Log) Matches(index uint64, view int64) bool {
+	actual, ok := self.ViewAt(index)
+
+	return ok && actual == view
+}
+
+// Append adds entries to the end of the log
+func (self *Log) Append(entries ...*pb.Entry) {
+	self.append(entries...)
+	self.persist(entries)
+}
+
+func (self *Log) append(entries ...*pb.Entry) {
+	for _, entry := range entries {
+		if entry.GetIndex() != self.LastIndex()+1 {
+			panic("log entries must be appended in order")
+		}
+
+		self.entries = append(self.entries, entry)
+		self.bytes += uint64(len(entry.GetData()))
+	}
+}
+
+// Merge appends entries received from a leader, discarding any conflicting entries we
+// already hold.  Entries that we already have are skipped.
+func (self *Log) Merge(entries []*pb.Entry) {
+	var appended []*pb.Entry
+	truncated := false
+
+	for _, entry := range entries {
+		index := entry.GetIndex()
+
+		if index <= self.snapshotIndex {
+			continue
+		}
+
+		if view, ok := self.ViewAt(index); ok {
+			if view == entry.GetViewId() {
+				continue
+			}
+			self.truncate(index - 1)
+			truncated = true
+		}
+
+		self.append(entry)
+		appended = append(appended, entry)
+	}
+
+	// Entries can only be removed from disk by rewriting the log
+	if truncated {
+		self.checkpoint()
+	} else {
+		self.persist(appended)
+	}
+}
+
+// truncate discards every entry after index
+func (self *Log) truncate(index uint64) {
+	if index < self.snapshotIndex {
+		panic("cannot truncate compacted entries")
+	}
+
+	for _, entry := range self.entries[index-self.snapshotIndex:] {
+		self.bytes -= uint64(len(entry.GetData()))
+	}
+
+	self.entries = self.entries[:index-self.snapshotIndex]
+}
+
+// Compact replaces every entry up to and including index with a snapshot of the state
+// they produced.  ErrSnapshotMismatch is returned, and the log left as it was, if the
+// snapshot was taken from entries that the log no longer holds.
+func (self *Log) Compact(index uint64, view int64, snapshot []byte) error {
+	if index <= self.snapshotIndex {
+		return nil
+	}
+
+	if !self.Matches(index, view) {
+		return ErrSnapshotMismatch
+	}
+
+	self.compact(index, view, snapshot)
+	self.checkpoint()
+
+	return nil
+}
+
+func (self *Log) compact(index uint64, view int64, snapshot []byte) {
+	for _, entry := range self.entries[:index-self.snapshotIndex] {
+		self.bytes -= uint64(len(entry.GetData()))
+	}
+
+	remaining := self.entries[index-self.snapshotIndex:]
+	self.entries = append([]*pb.Entry(nil), remaining...)
+	self.snapshotIndex = index
+	self.snapshotView = view
+	self.snapshot = snapshot
+}
+
+// Install replaces our log with a snapshot received from another member.  Any entries
+// that follow the snapshot are retained if they agree with it.
+func (self *Log) Install(index uint64, view int64, snapshot []byte) {
+	if self.Matches(index, view) && index >= self.snapshotIndex {
+		self.compact(index, view, snapshot)
+	} else {
+		self.entries = nil
+		self.bytes = 0
+		self.snapshotIndex = index
+		self.snapshotView = view
+		self.snapshot = snapshot
+	}
+
+	self.checkpoint()
+}
+
+// persist writes newly appended entries to disk, if the log is kept there
+func (self *Log) persist(entries []*pb.Entry) {
+	if self.store == nil || len(entries) == 0 {
+		return
+	}
+
+	if err := self.store.append(entries); err != nil {
+		panic(err)
+	}
+}
+
+// checkpoint rewrites the log on disk, if it is kept there
+func (self *Log) checkpoint() {
+	if self.store == nil {
+		return
+	}
+
+	if err := self.store.checkpoint(self); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,159 @@
+package replication
+
+import (
+	"github.com/ghaskins/go-cluster/pb"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func entry(index uint64, view int64, data string) *pb.Entry {
+	return &pb.Entry{
+		Index:  proto.Uint64(index),
+		ViewId: proto.Int64(view),
+		Data:   []byte(data),
+	}
+}
+
+func TestLogAppend(t *testing.T) {
+	log := NewLog()
+	assert.Equal(t, uint64(0), log.LastIndex())
+	assert.True(t, log.Matches(0, 0))
+
+	log.Append(entry(1, 1, "a"), entry(2, 1, "bb"), entry(3, 2, "ccc"))
+	assert.Equal(t, uint64(3), log.LastIndex())
+	assert.Equal(t, int64(2), log.LastView())
+	assert.True(t, log.Matches(2, 1))
+	assert.False(t, log.Matches(2, 2))
+	assert.False(t, log.Matches(4, 2))
+
+	count, size := log.Len()
+	assert.Equal(t, 3, count)
+	assert.Equal(t, uint64(6), size)
+
+	// At least one entry is always returned regardless of the size limit
+	assert.Len(t, log.Entries(1, 0), 1)
+	assert.Len(t, log.Entries(1, 3), 2)
+	assert.Len(t, log.Entries(2, 100), 2)
+	assert.Nil(t, log.Entries(4, 100))
+
+	assert.Panics(t, func() { log.Append(entry(5, 2, "e")) })
+}
+
+func TestLogMergeConflict(t *testing.T) {
+	log := NewLog()
+	log.Append(entry(1, 1, "a"), entry(2, 1, "b"), entry(3, 1, "c"))
+
+	// Entries we already hold are skipped, and a conflict discards everything after it
+	log.Merge([]*pb.Entry{entry(2, 1, "b"), entry(3, 2, "x")})
+	assert.Equal(t, uint64(3), log.LastIndex())
+	e, ok := log.Get(3)
+	assert.True(t, ok)
+	assert.Equal(t, "x", string(e.GetData()))
+
+	_, size := log.Len()
+	assert.Equal(t, uint64(3), size)
+}
+
+func TestLogCompact(t *testing.T) {
+	log := NewLog()
+	log.Append(entry(1, 1, "a"), entry(2, 1, "b"), entry(3, 2, "c"))
+
+	assert.Nil(t, log.Compact(2, 1, []byte("snap")))
+	assert.Equal(t, uint64(2), log.SnapshotIndex())
+	assert.Equal(t, uint64(3), log.LastIndex())
+	assert.True(t, log.Matches(2, 1))
+
+	_, ok := log.Get(2)
+	assert.False(t, ok)
+	assert.Nil(t, log.Entries(2, 100))
+	assert.Len(t, log.Slice(3, 3), 1)
+
+	count, size := log.Len()
+	assert.Equal(t, 1, count)
+	assert.Equal(t, uint64(1), size)
+
+	assert.Equal(t, ErrSnapshotMismatch, log.Compact(3, 1, nil))
+	assert.Equal(t, uint64(2), log.SnapshotIndex())
+}
+
+func TestLogInstall(t *testing.T) {
+	log := NewLog()
+	log.Append(entry(1, 1, "a"), entry(2, 1, "b"), entry(3, 1, "c"))
+
+	// A snapshot that agrees with our log keeps the entries that follow it
+	log.Install(2, 1, []byte("snap"))
+	assert.Equal(t, uint64(3), log.LastIndex())
+
+	// One that doesn't replaces the log entirely
+	log.Install(5, 3, []byte("other"))
+	assert.Equal(t, uint64(5), log.LastIndex())
+	assert.Equal(t, int64(3), log.LastView())
+
+	count, _ := log.Len()
+	assert.Equal(t, 0, count)
+
+	_, _, data := log.Snapshot()
+	assert.Equal(t, "other", string(data))
+}
+
+func TestLogPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	reopen := func() *Log {
+		log, err := OpenLog(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return log
+	}
+
+	log := reopen()
+	log.Append(entry(1, 1, "a"), entry(2, 1, "b"), entry(3, 1, "c"))
+	log.Merge([]*pb.Entry{entry(3, 2, "x"), entry(4, 2, "y")})
+	assert.Nil(t, log.Compact(2, 1, []byte("snap")))
+	log.Append(entry(5, 2, "z"))
+
+	// Everything survives, compaction and truncation included
+	log = reopen()
+	assert.Equal(t, uint64(2), log.SnapshotIndex())
+	assert.Equal(t, uint64(5), log.LastIndex())
+	e, ok := log.Get(3)
+	assert.True(t, ok)
+	assert.Equal(t, "x", string(e.GetData()))
+	_, _, data := log.Snapshot()
+	assert.Equal(t, "snap", string(data))
+
+	count, size := log.Len()
+	assert.Equal(t, 3, count)
+	assert.Equal(t, uint64(3), size)
+
+	// A record torn by a crash is discarded, and appending carries on after the last good one
+	file, err := os.OpenFile(log.store.appendedPath(log.store.generation), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{0, 0, 1, 0, 1, 2})
+	file.Close()
+
+	log = reopen()
+	assert.Equal(t, uint64(5), log.LastIndex())
+	log.Append(entry(6, 2, "w"))
+
+	log = reopen()
+	assert.Equal(t, uint64(6), log.LastIndex())
+
+	// As does a snapshot installed from another member
+	log.Install(9, 3, []byte("other"))
+	log = reopen()
+	assert.Equal(t, uint64(9), log.LastIndex())
+	assert.Equal(t, int64(3), log.LastView())
+	count, _ = log.Len()
+	assert.Equal(t, 0, count)
+}
@@ -0,0 +1,316 @@
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ghaskins/go-cluster/pb"
+	"github.com/golang/protobuf/proto"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var errCorruptRecord = errors.New("corrupt log record")
+
+const checkpointName = "checkpoint"
+
+// The checkpoint begins with a header, followed by the snapshot and then the entry records
+type checkpointHeader struct {
+	Generation uint64
+	Index      uint64
+	View       int64
+	Length     uint64 // of the snapshot
+}
+
+// store keeps a Log on disk.  A checkpoint holds the snapshot along with the entries that
+// followed it when the checkpoint was written, and each checkpoint begins a new generation
+// of the file that entries appended since are written to.  Replacing the checkpoint
+// therefore replaces the whole log at once, which is how entries are truncated or
+// compacted away.
+type store struct {
+	dir        string
+	generation uint64
+	appended   *os.File
+}
+
+// OpenLog returns the log persisted in dir by a previous run, or an empty log if there is
+// none, and persists every change made to it from now on.  Entries and snapshots are
+// synced to disk before the call that adds them returns.  Should that fail, the log
+// panics, as carrying on could lose entries that we have acknowledged.
+func OpenLog(dir string) (*Log, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	log := NewLog()
+	store := &store{dir: dir}
+
+	if err := store.loadCheckpoint(log); err != nil {
+		return nil, err
+	}
+
+	if err := store.loadAppended(log); err != nil {
+		return nil, err
+	}
+
+	if err := store.removeStale(); err != nil {
+		return nil, err
+	}
+
+	log.store = store
+	return log, nil
+}
+
+func (self *store) appendedPath(generation uint64) string {
+	return filepath.Join(self.dir, fmt.Sprintf("entries.%d", generation))
+}
+
+func (self *store) loadCheckpoint(log *Log) error {
+	data, err := ioutil.ReadFile(filepath.Join(self.dir, checkpointName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	reader := bytes.NewReader(data)
+
+	var header checkpointHeader
+	if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+		return fmt.Errorf("corrupt checkpoint: %s", err.Error())
+	}
+	if header.Length > uint64(reader.Len()) {
+		return errors.New("corrupt checkpoint: snapshot truncated")
+	}
+
+	snapshot := make([]byte, header.Length)
+	reader.Read(snapshot)
+
+	self.generation = header.Generation
+	log.snapshotIndex = header.Index
+	log.snapshotView = header.View
+	log.snapshot = snapshot
+
+	// The checkpoint was written whole, so any damage to it is not a torn write
+	for {
+		entry, _, err := readRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("corrupt checkpoint: %s", err.Error())
+		}
+		if entry.GetIndex() != log.LastIndex()+1 {
+			return errors.New("corrupt checkpoint: entries out of order")
+		}
+		log.append(entry)
+	}
+}
+
+// loadAppended replays the entries appended since the checkpoint.  A record that is cut
+// short or fails its checksum was being written when we stopped, and is discarded along
+// with anything after it.
+func (self *store) loadAppended(log *Log) error {
+	file, err := os.OpenFile(self.appendedPath(self.generation), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	var valid int64
+
+	for {
+		entry, size, err := readRecord(reader)
+		if err != nil || entry.GetIndex() != log.LastIndex()+1 {
+			break
+		}
+		log.append(entry)
+		valid += size
+	}
+
+	if err := file.Truncate(valid); err != nil {
+		file.Close()
+		return err
+	}
+
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+
+	self.appended = file
+	return nil
+}
+
+// removeStale removes the entries of earlier generations, left behind if we stopped just
+// after replacing the checkpoint
+func (self *store) removeStale() error {
+	names, err := ioutil.ReadDir(self.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range names {
+		suffix := strings.TrimPrefix(info.Name(), "entries.")
+		if suffix == info.Name() {
+			continue
+		}
+
+		if generation, err := strconv.ParseUint(suffix, 10, 64); err == nil && generation != self.generation {
+			if err := os.Remove(filepath.Join(self.dir, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// append writes entries to the end of the current generation
+func (self *store) append(entries []*pb.Entry) error {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		if err := writeRecord(&buf, entry); err != nil {
+			return err
+		}
+	}
+
+	if _, err := self.appended.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	return self.appended.Sync()
+}
+
+// checkpoint replaces everything on disk with the log as it stands
+func (self *store) checkpoint(log *Log) error {
+	generation := self.generation + 1
+
+	// The new generation starts out empty, and must exist before the checkpoint names it
+	appended, err := os.OpenFile(self.appendedPath(generation), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	header := checkpointHeader{
+		Generation: generation,
+		Index:      log.snapshotIndex,
+		View:       log.snapshotView,
+		Length:     uint64(len(log.snapshot)),
+	}
+	binary.Write(&buf, binary.BigEndian, &header)
+	buf.Write(log.snapshot)
+	for _, entry := range log.entries {
+		if err := writeRecord(&buf, entry); err != nil {
+			appended.Close()
+			return err
+		}
+	}
+
+	if err := writeFileSync(filepath.Join(self.dir, checkpointName), buf.Bytes()); err != nil {
+		appended.Close()
+		return err
+	}
+
+	self.appended.Close()
+	os.Remove(self.appendedPath(self.generation))
+
+	self.generation = generation
+	self.appended = appended
+
+	return nil
+}
+
+// A record is an entry preceded by its length and checksum
+func writeRecord(w io.Writer, entry *pb.Entry) error {
+	data, err := proto.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(data))
+
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// readRecord returns the entry along with the size of its record.  io.EOF is returned only
+// if there are no more records at all.
+func readRecord(r io.Reader) (*pb.Entry, int64, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errCorruptRecord
+		}
+		return nil, 0, err
+	}
+
+	// A torn length could be anything, so the record is only allocated as it is read
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(binary.BigEndian.Uint32(header[0:4]))); err != nil {
+		return nil, 0, errCorruptRecord
+	}
+	data := buf.Bytes()
+
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errCorruptRecord
+	}
+
+	entry := &pb.Entry{}
+	if err := proto.Unmarshal(data, entry); err != nil {
+		return nil, 0, errCorruptRecord
+	}
+
+	return entry, int64(len(header) + len(data)), nil
+}
+
+// writeFileSync replaces the file at path with data, such that either the old or the new
+// contents survive a crash
+func writeFileSync(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
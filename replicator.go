@@ -0,0 +1,779 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ghaskins/go-cluster/pb"
+	"github.com/ghaskins/go-cluster/replication"
+	"github.com/golang/protobuf/proto"
+	"sort"
+	"time"
+)
+
+const (
+	replicateMethod = "cluster.replicate"
+
+	maxAppendBytes    = 1024 * 1024
+	snapshotChunkSize = 256 * 1024
+
+	// How long we wait for a response before re-sending to a peer
+	replicationRetry = time.Second
+	// How long a new leader waits on its sync source before starting over
+	syncTimeout = 5 * time.Second
+)
+
+type replicationRole int
+
+const (
+	roleNone replicationRole = iota
+	roleFollower
+	roleLeader
+)
+
+// progress tracks what we have sent to a single peer.  Transfers are stop-and-wait so
+// that a slow peer can never cause us to block on its transmit queue.
+type progress struct {
+	nextIndex      uint64
+	matchIndex     uint64
+	inflight       bool
+	sentAt         time.Time
+	snapshotOffset uint64
+}
+
+type incomingSnapshot struct {
+	index uint64
+	view  int64
+	data  []byte
+}
+
+type appendRequest struct {
+	command []byte
+	result  chan appendResult
+}
+
+type appendResult struct {
+	index  uint64
+	waiter chan applyResult
+	err    error
+}
+
+// Replicator maintains the replicated log on top of the leader elected by the
+// controller.  It is driven entirely from the controller's goroutine.
+//
+// Because the election does not consider the state of each member's log, a new leader
+// begins each view by collecting the log positions of a quorum and, if any of them is
+// ahead of its own, catching up from that member before it accepts new entries.  This
+// is the view change from Viewstamped Replication.  Once synchronized, replication
+// proceeds as in Raft.
+type Replicator struct {
+	myId            string
+	members         []string
+	observers       map[string]bool // members who receive the log but don't count toward quorum
+	quorumThreshold int             // the number of voters required in addition to ourselves
+	send            func(to string, msg proto.Message) bool
+	log             *replication.Log
+	applier         *applier
+	role            replicationRole
+	view            int64
+	leader          string
+	ready           bool
+	logStates       map[string]*pb.LogState
+	syncSource      string
+	syncTarget      *pb.LogState
+	syncProgress    time.Time
+	progress        map[string]*progress
+	commitIndex     uint64
+	dispatchedIndex uint64
+	incoming        *incomingSnapshot
+	needSnapshot    bool // our snapshot could not be restored, so we need a fresh one
+}
+
+func NewReplicator(myId string, members []string, observers map[string]bool, quorumThreshold int, send func(to string, msg proto.Message) bool) *Replicator {
+	return &Replicator{
+		myId:            myId,
+		members:         members,
+		observers:       observers,
+		quorumThreshold: quorumThreshold,
+		send:            send,
+		log:             replication.NewLog(),
+		applier:         newApplier(),
+		progress:        make(map[string]*progress),
+	}
+}
+
+//---------------------------------------------------------
+// role changes
+//---------------------------------------------------------
+
+func (self *Replicator) follow(leader string, view int64) {
+	self.reset(roleFollower, view)
+	self.leader = leader
+}
+
+func (self *Replicator) lead(view int64) {
+	self.reset(roleLeader, view)
+	self.leader = self.myId
+	self.startSync()
+}
+
+func (self *Replicator) stepDown() {
+	self.reset(roleNone, self.view)
+}
+
+func (self *Replicator) reset(role replicationRole, view int64) {
+	self.role = role
+	self.view = view
+	self.leader = ""
+	self.ready = false
+	self.logStates = nil
+	self.syncSource = ""
+	self.syncTarget = nil
+	self.progress = make(map[string]*progress)
+	self.incoming = nil
+}
+
+//---------------------------------------------------------
+// view synchronization
+//---------------------------------------------------------
+
+func (self *Replicator) startSync() {
+	self.logStates = make(map[string]*pb.LogState)
+	self.syncSource = ""
+	self.syncTarget = nil
+	self.progress = make(map[string]*progress)
+
+	if self.quorumThreshold == 0 {
+		self.becomeReady()
+		return
+	}
+
+	self.queryLogStates()
+}
+
+func (self *Replicator) queryLogStates() {
+	for _, member := range self.members {
+		if _, ok := self.logStates[member]; !ok && !self.observers[member] {
+			self.send(member, &pb.LogQuery{ViewId: proto.Int64(self.view)})
+		}
+	}
+}
+
+func isNewer(lastView int64, lastIndex uint64, thanView int64, thanIndex uint64) bool {
+	return lastView > thanView || (lastView == thanView && lastIndex > thanIndex)
+}
+
+func (self *Replicator) onLogQuery(from string, msg *pb.LogQuery) {
+	if self.role != roleFollower || from != self.leader || msg.GetViewId() != self.view {
+		return
+	}
+
+	self.send(from, &pb.LogState{
+		ViewId:     proto.Int64(self.view),
+		LastIndex:  proto.Uint64(self.log.LastIndex()),
+		LastViewId: proto.Int64(self.log.LastView()),
+	})
+}
+
+func (self *Replicator) onLogState(from string, msg *pb.LogState) {
+	if self.role != roleLeader || self.ready || self.syncSource != "" || msg.GetViewId() != self.view || self.observers[from] {
+		return
+	}
+
+	self.logStates[from] = msg
+	if len(self.logStates) < self.quorumThreshold {
+		return
+	}
+
+	// Find the most up-to-date log among the quorum.  Any entry that was committed in a
+	// prior view is guaranteed to be present in it.
+	var members []string
+	for member := range self.logStates {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+
+	lastView, lastIndex := self.log.LastView(), self.log.LastIndex()
+
+	for _, member := range members {
+		state := self.logStates[member]
+		if isNewer(state.GetLastViewId(), state.GetLastIndex(), lastView, lastIndex) {
+			self.syncSource = member
+			self.syncTarget = state
+			lastView, lastIndex = state.GetLastViewId(), state.GetLastIndex()
+		}
+	}
+
+	if self.syncSource == "" {
+		self.becomeReady()
+		return
+	}
+
+	fmt.Printf("REPLICATOR: catching up from %s to %d:%d\n", self.syncSource, lastView, lastIndex)
+
+	// Everything we have committed is common to both logs
+	self.syncProgress = time.Now()
+	self.send(self.syncSource, &pb.LogFetch{
+		ViewId:    proto.Int64(self.view),
+		FromIndex: proto.Uint64(self.commitIndex + 1),
+	})
+}
+
+// onLogFetch makes us the source of a catch-up transfer for a newly elected leader
+func (self *Replicator) onLogFetch(from string, msg *pb.LogFetch) {
+	if self.role != roleFollower || from != self.leader || msg.GetViewId() != self.view {
+		return
+	}
+
+	self.progress[from] = &progress{nextIndex: msg.GetFromIndex()}
+	self.sendAppend(from)
+}
+
+func (self *Replicator) checkSynced() {
+	if self.role != roleLeader || self.ready || self.syncTarget == nil {
+		return
+	}
+
+	self.syncProgress = time.Now()
+
+	if self.log.LastIndex() == self.syncTarget.GetLastIndex() && self.log.LastView() == self.syncTarget.GetLastViewId() {
+		self.becomeReady()
+	}
+}
+
+func (self *Replicator) becomeReady() {
+	fmt.Printf("REPLICATOR: VIEW %d: ready at index %d\n", self.view, self.log.LastIndex())
+
+	self.ready = true
+	self.logStates = nil
+	self.syncSource = ""
+	self.syncTarget = nil
+	self.progress = make(map[string]*progress)
+
+	for _, member := range self.members {
+		self.progress[member] = &progress{nextIndex: self.log.LastIndex() + 1}
+	}
+
+	// Entries from prior views can only be committed indirectly, so begin the view with
+	// an entry of our own
+	self.appendEntry(&pb.Entry{Noop: proto.Bool(true)})
+}
+
+//---------------------------------------------------------
+// leader
+//---------------------------------------------------------
+
+func (self *Replicator) propose(command []byte) appendResult {
+	if self.role != roleLeader || !self.ready {
+		return appendResult{err: ErrNotLeader}
+	}
+
+	index, waiter := self.appendEntry(&pb.Entry{Data: command})
+
+	return appendResult{index: index, waiter: waiter}
+}
+
+func (self *Replicator) appendEntry(entry *pb.Entry) (uint64, chan applyResult) {
+	index := self.log.LastIndex() + 1
+
+	entry.Index = proto.Uint64(index)
+	entry.ViewId = proto.Int64(self.view)
+	self.log.Append(entry)
+
+	// Register before the entry can possibly be applied
+	waiter := self.applier.wait(index, self.view)
+
+	self.advanceCommit()
+	for _, member := range self.members {
+		self.sendAppend(member)
+	}
+
+	return index, waiter
+}
+
+func (self *Replicator) tick() {
+	if self.role != roleLeader {
+		return
+	}
+
+	if !self.ready {
+		switch {
+		case self.syncSource == "":
+			self.queryLogStates()
+		case time.Since(self.syncProgress) > syncTimeout:
+			fmt.Printf("REPLICATOR: sync from %s stalled, restarting\n", self.syncSource)
+			self.startSync()
+		}
+		return
+	}
+
+	// Empty appends double as a keepalive that carries the commit index
+	for _, member := range self.members {
+		self.sendAppend(member)
+	}
+}
+
+func (self *Replicator) peerLost(peerId string) {
+	if self.role == roleLeader && !self.ready && peerId == self.syncSource {
+		self.startSync()
+	}
+}
+
+func (self *Replicator) sendAppend(to string) {
+	p, ok := self.progress[to]
+	if !ok {
+		return
+	}
+
+	if p.inflight && time.Since(p.sentAt) < replicationRetry {
+		return
+	}
+
+	var msg proto.Message
+
+	if p.nextIndex <= self.log.SnapshotIndex() {
+		msg = self.nextSnapshotChunk(p)
+	} else {
+		prevIndex := p.nextIndex - 1
+		prevView, _ := self.log.ViewAt(prevIndex)
+
+		msg = &pb.AppendEntries{
+			ViewId:      proto.Int64(self.view),
+			PrevIndex:   proto.Uint64(prevIndex),
+			PrevViewId:  proto.Int64(prevView),
+			Entries:     self.log.Entries(p.nextIndex, maxAppendBytes),
+			CommitIndex: proto.Uint64(self.commitIndex),
+		}
+	}
+
+	if self.send(to, msg) {
+		p.inflight = true
+		p.sentAt = time.Now()
+	}
+}
+
+func (self *Replicator) nextSnapshotChunk(p *progress) *pb.InstallSnapshot {
+	index, view, data := self.log.Snapshot()
+
+	if p.snapshotOffset > uint64(len(data)) {
+		p.snapshotOffset = 0
+	}
+
+	end := p.snapshotOffset + snapshotChunkSize
+	if end > uint64(len(data)) {
+		end = uint64(len(data))
+	}
+
+	return &pb.InstallSnapshot{
+		ViewId:     proto.Int64(self.view),
+		LastIndex:  proto.Uint64(index),
+		LastViewId: proto.Int64(view),
+		Offset:     proto.Uint64(p.snapshotOffset),
+		Data:       data[p.snapshotOffset:end],
+		Done:       proto.Bool(end == uint64(len(data))),
+	}
+}
+
+// acknowledged is invoked whenever a peer confirms that its log matches ours up to index
+func (self *Replicator) acknowledged(from string, p *progress, index uint64) {
+	if index > p.matchIndex {
+		p.matchIndex = index
+	}
+	p.nextIndex = index + 1
+
+	if self.role == roleLeader {
+		self.advanceCommit()
+	}
+
+	if p.nextIndex <= self.log.LastIndex() {
+		self.sendAppend(from)
+	} else if self.role == roleFollower {
+		// We were only the source of a catch-up transfer, which is now complete
+		delete(self.progress, from)
+	}
+}
+
+func (self *Replicator) onAppendResponse(from string, msg *pb.AppendResponse) {
+	p, ok := self.progress[from]
+	if !ok || msg.GetViewId() != self.view {
+		return
+	}
+
+	p.inflight = false
+
+	if msg.GetSuccess() {
+		self.acknowledged(from, p, msg.GetLastIndex())
+		return
+	}
+
+	// Back up and try again, using the peer's hint to skip entries it cannot have
+	if msg.GetLastIndex()+1 < p.nextIndex {
+		p.nextIndex = msg.GetLastIndex() + 1
+	} else if p.nextIndex > 1 {
+		p.nextIndex--
+	}
+
+	self.sendAppend(from)
+}
+
+func (self *Replicator) onSnapshotAck(from string, msg *pb.SnapshotAck) {
+	p, ok := self.progress[from]
+	if !ok || msg.GetViewId() != self.view {
+		return
+	}
+
+	p.inflight = false
+
+	index, _, data := self.log.Snapshot()
+	if msg.GetLastIndex() != index {
+		// We compacted again mid-transfer, so start over with the newer snapshot
+		p.snapshotOffset = 0
+		self.sendAppend(from)
+		return
+	}
+
+	if msg.GetOffset() >= uint64(len(data)) {
+		p.snapshotOffset = 0
+		self.acknowledged(from, p, index)
+		return
+	}
+
+	p.snapshotOffset = msg.GetOffset()
+	self.sendAppend(from)
+}
+
+func (self *Replicator) advanceCommit() {
+	for index := self.log.LastIndex(); index > self.commitIndex; index-- {
+		view, _ := self.log.ViewAt(index)
+		if view != self.view {
+			// Entries from prior views are only committed by committing one of our own
+			break
+		}
+
+		count := 0
+		for member, p := range self.progress {
+			if p.matchIndex >= index && !self.observers[member] {
+				count++
+			}
+		}
+
+		if count >= self.quorumThreshold {
+			self.commitIndex = index
+			self.dispatch()
+			break
+		}
+	}
+}
+
+// readIndex returns our commit index, and whether it is known to include every entry
+// committed by a previous leader
+func (self *Replicator) readIndex() (uint64, bool) {
+	if self.role != roleLeader || !self.ready {
+		return 0, false
+	}
+
+	view, _ := self.log.ViewAt(self.commitIndex)
+	return self.commitIndex, view == self.view
+}
+
+//---------------------------------------------------------
+// follower
+//---------------------------------------------------------
+
+// accepts reports whether we take log updates from a peer: our leader while following,
+// or the member we are catching up from while becoming leader
+func (self *Replicator) accepts(from string, view int64) bool {
+	if view != self.view {
+		return false
+	}
+
+	switch self.role {
+	case roleFollower:
+		return from == self.leader
+	case roleLeader:
+		return !self.ready && from == self.syncSource
+	default:
+		return false
+	}
+}
+
+func (self *Replicator) onAppendEntries(from string, msg *pb.AppendEntries) {
+	if !self.accepts(from, msg.GetViewId()) {
+		return
+	}
+
+	if self.needSnapshot {
+		self.requestSnapshot(from, msg)
+		return
+	}
+
+	prevIndex := msg.GetPrevIndex()
+	entries := msg.GetEntries()
+
+	if prevIndex < self.log.SnapshotIndex() {
+		// Everything we compacted was committed and therefore matches
+		skip := self.log.SnapshotIndex() - prevIndex
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		prevIndex += skip
+		entries = entries[skip:]
+	} else if !self.log.Matches(prevIndex, msg.GetPrevViewId()) {
+		hint := self.log.LastIndex()
+		if prevIndex > 0 && prevIndex-1 < hint {
+			hint = prevIndex - 1
+		}
+
+		self.send(from, &pb.AppendResponse{
+			ViewId:    proto.Int64(self.view),
+			Success:   proto.Bool(false),
+			LastIndex: proto.Uint64(hint),
+		})
+		return
+	}
+
+	self.log.Merge(entries)
+
+	last := prevIndex + uint64(len(entries))
+	if last < self.log.SnapshotIndex() {
+		last = self.log.SnapshotIndex()
+	}
+
+	if msg.GetCommitIndex() > self.commitIndex {
+		commit := msg.GetCommitIndex()
+		if commit > last {
+			commit = last
+		}
+		if commit > self.commitIndex {
+			self.commitIndex = commit
+			self.dispatch()
+		}
+	}
+
+	self.send(from, &pb.AppendResponse{
+		ViewId:    proto.Int64(self.view),
+		Success:   proto.Bool(true),
+		LastIndex: proto.Uint64(last),
+	})
+
+	self.checkSynced()
+}
+
+func (self *Replicator) onInstallSnapshot(from string, msg *pb.InstallSnapshot) {
+	if !self.accepts(from, msg.GetViewId()) {
+		return
+	}
+
+	index := msg.GetLastIndex()
+
+	if msg.GetOffset() == 0 || self.incoming == nil || self.incoming.index != index {
+		self.incoming = &incomingSnapshot{index: index, view: msg.GetLastViewId()}
+	}
+
+	if msg.GetOffset() == uint64(len(self.incoming.data)) {
+		self.incoming.data = append(self.incoming.data, msg.GetData()...)
+
+		if msg.GetDone() {
+			self.installSnapshot(self.incoming)
+			self.incoming = nil
+
+			self.send(from, &pb.SnapshotAck{
+				ViewId:    proto.Int64(self.view),
+				LastIndex: proto.Uint64(index),
+				Offset:    proto.Uint64(msg.GetOffset() + uint64(len(msg.GetData()))),
+			})
+
+			self.checkSynced()
+			return
+		}
+	}
+
+	// Either acknowledge the chunk or ask for the one we are missing
+	self.send(from, &pb.SnapshotAck{
+		ViewId:    proto.Int64(self.view),
+		LastIndex: proto.Uint64(index),
+		Offset:    proto.Uint64(uint64(len(self.incoming.data))),
+	})
+}
+
+func (self *Replicator) installSnapshot(snapshot *incomingSnapshot) {
+	if snapshot.index <= self.log.SnapshotIndex() && !self.needSnapshot {
+		return
+	}
+
+	fmt.Printf("REPLICATOR: installing snapshot at index %d\n", snapshot.index)
+
+	self.log.Install(snapshot.index, snapshot.view, snapshot.data)
+
+	if self.commitIndex < snapshot.index || self.commitIndex > self.log.LastIndex() {
+		self.commitIndex = snapshot.index
+	}
+
+	if self.dispatchedIndex < snapshot.index || self.needSnapshot {
+		self.applier.enqueue(&applyOp{
+			restore:  true,
+			snapshot: snapshot.data,
+			index:    snapshot.index,
+			view:     snapshot.view,
+		})
+
+		// The applier discarded whatever followed the snapshot that failed to restore
+		self.dispatchedIndex = snapshot.index
+		self.needSnapshot = false
+		self.dispatch()
+	}
+}
+
+// onRestoreFailed is invoked when the state machine could not restore the snapshot at
+// index.  We hold on to our log, whose entries may have counted toward a commit, but ask
+// the leader for its snapshot again before we accept anything more.
+func (self *Replicator) onRestoreFailed(index uint64) {
+	if index < self.log.SnapshotIndex() {
+		// A newer snapshot has been installed since, and is queued to be restored
+		return
+	}
+
+	fmt.Printf("REPLICATOR: snapshot at index %d could not be restored, fetching it again\n", index)
+
+	self.needSnapshot = true
+	self.incoming = nil
+}
+
+// requestSnapshot rejects entries from a leader while we wait for a snapshot, with a hint
+// that leads it to send its latest one
+func (self *Replicator) requestSnapshot(from string, msg *pb.AppendEntries) {
+	if msg.GetPrevIndex() == 0 {
+		// The leader has nothing to send but its whole log, which we cannot apply either.
+		// Staying silent has it retry, by which time it may have compacted.
+		return
+	}
+
+	self.send(from, &pb.AppendResponse{
+		ViewId:    proto.Int64(self.view),
+		Success:   proto.Bool(false),
+		LastIndex: proto.Uint64(0),
+	})
+}
+
+//---------------------------------------------------------
+// common
+//---------------------------------------------------------
+
+// dispatch hands newly committed entries to the applier
+func (self *Replicator) dispatch() {
+	if self.dispatchedIndex >= self.commitIndex {
+		return
+	}
+
+	self.applier.enqueue(&applyOp{entries: self.log.Slice(self.dispatchedIndex+1, self.commitIndex)})
+	self.dispatchedIndex = self.commitIndex
+}
+
+// restoreLog resumes from the log persisted in dir by a previous run, and persists the
+// log there from now on.  The snapshot is restored into the state machine; the entries
+// that follow it are applied once the leader tells us they are committed.
+func (self *Replicator) restoreLog(dir string) error {
+	log, err := replication.OpenLog(dir)
+	if err != nil {
+		return err
+	}
+
+	self.log = log
+
+	index, view, data := log.Snapshot()
+	if index > 0 {
+		self.commitIndex = index
+		self.dispatchedIndex = index
+		self.applier.enqueue(&applyOp{restore: true, snapshot: data, index: index, view: view})
+	}
+
+	if log.LastIndex() > 0 {
+		fmt.Printf("REPLICATOR: resuming with log through index %d\n", log.LastIndex())
+	}
+
+	return nil
+}
+
+func (self *Replicator) onSnapshotTaken(snapshot *snapshotTaken) {
+	fmt.Printf("REPLICATOR: compacting log through index %d\n", snapshot.index)
+
+	if err := self.log.Compact(snapshot.index, snapshot.view, snapshot.data); err != nil {
+		// The log was replaced by an installed snapshot while this one was being taken
+		fmt.Printf("REPLICATOR: discarding snapshot at index %d: %s\n", snapshot.index, err.Error())
+	}
+}
+
+// handle processes a replication message, returning false if it was not one
+func (self *Replicator) handle(from string, msg proto.Message) bool {
+	switch msg := msg.(type) {
+	case *pb.AppendEntries:
+		self.onAppendEntries(from, msg)
+	case *pb.AppendResponse:
+		self.onAppendResponse(from, msg)
+	case *pb.InstallSnapshot:
+		self.onInstallSnapshot(from, msg)
+	case *pb.SnapshotAck:
+		self.onSnapshotAck(from, msg)
+	case *pb.LogQuery:
+		self.onLogQuery(from, msg)
+	case *pb.LogState:
+		self.onLogState(from, msg)
+	case *pb.LogFetch:
+		self.onLogFetch(from, msg)
+	default:
+		return false
+	}
+
+	return true
+}
+
+//---------------------------------------------------------
+// node API
+//---------------------------------------------------------
+
+// SetStateMachine installs the application state machine driven by the replicated log.
+// It must be called before Run.
+func (self *Node) SetStateMachine(sm StateMachine) {
+	self.controller.replicator.applier.sm = sm
+}
+
+// SetSnapshotPolicy configures when the replicated log is compacted.  It must be called
+// before Run.
+func (self *Node) SetSnapshotPolicy(policy SnapshotPolicy) {
+	self.controller.replicator.applier.policy = policy
+}
+
+// Replicate appends a command to the replicated log via the current leader and returns
+// the result of applying it.  If ErrNotLeader is returned after the command reached the
+// leader, the command may or may not eventually be applied.
+func (self *Node) Replicate(ctx context.Context, command []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultProposalTimeout)
+		defer cancel()
+	}
+
+	return self.CallLeader(ctx, replicateMethod, command)
+}
+
+func (self *Node) serveReplicate(ctx context.Context, from string, command []byte) ([]byte, error) {
+	req := &appendRequest{command: command, result: make(chan appendResult, 1)}
+
+	select {
+	case self.controller.appends <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	result := <-req.result
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	select {
+	case applied := <-result.waiter:
+		return applied.result, applied.err
+	case <-ctx.Done():
+		self.controller.replicator.applier.cancelWait(result.index)
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/ghaskins/go-cluster/pb"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testStateMachine struct {
+	mutex        sync.Mutex
+	commands     []string
+	failRestores int // the number of restores that fail before one succeeds
+}
+
+func (self *testStateMachine) Apply(command []byte) []byte {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.commands = append(self.commands, string(command))
+	return []byte(strings.ToUpper(string(command)))
+}
+
+func (self *testStateMachine) Snapshot() (io.ReadCloser, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return ioutil.NopCloser(strings.NewReader(strings.Join(self.commands, ","))), nil
+}
+
+func (self *testStateMachine) Restore(snapshot io.Reader) error {
+	data, err := ioutil.ReadAll(snapshot)
+	if err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.failRestores > 0 {
+		self.failRestores--
+		self.commands = []string{"corrupt"}
+		return errors.New("corrupt snapshot")
+	}
+
+	self.commands = nil
+	if len(data) > 0 {
+		self.commands = strings.Split(string(bytes.TrimSpace(data)), ",")
+	}
+	return nil
+}
+
+func (self *testStateMachine) get() string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return strings.Join(self.commands, ",")
+}
+
+type testMessage struct {
+	from string
+	to   string
+	msg  proto.Message
+}
+
+// testNetwork connects replicators directly, delivering messages from the test goroutine
+type testNetwork struct {
+	replicators map[string]*Replicator
+	machines    map[string]*testStateMachine
+	down        map[string]bool
+	queue       []testMessage
+}
+
+func newTestNetwork(policy SnapshotPolicy, members ...string) *testNetwork {
+	net := &testNetwork{
+		replicators: make(map[string]*Replicator),
+		machines:    make(map[string]*testStateMachine),
+		down:        make(map[string]bool),
+	}
+
+	for _, id := range members {
+		var others []string
+		for _, member := range members {
+			if member != id {
+				others = append(others, member)
+			}
+		}
+
+		from := id
+		r := NewReplicator(id, others, nil, len(members)/2, func(to string, msg proto.Message) bool {
+			if net.down[from] || net.down[to] {
+				return false
+			}
+			net.queue = append(net.queue, testMessage{from: from, to: to, msg: msg})
+			return true
+		})
+
+		sm := &testStateMachine{}
+		r.applier.sm = sm
+		r.applier.policy = policy
+		go r.applier.run()
+
+		net.replicators[id] = r
+		net.machines[id] = sm
+	}
+
+	return net
+}
+
+func (self *testNetwork) close() {
+	for _, r := range self.replicators {
+		r.applier.close()
+	}
+}
+
+// pump delivers every queued message, along with any snapshots the appliers have taken
+func (self *testNetwork) pump() {
+	for {
+		for _, r := range self.replicators {
+			select {
+			case s := <-r.applier.snapshots:
+				r.onSnapshotTaken(s)
+			case index := <-r.applier.failures:
+				r.onRestoreFailed(index)
+			default:
+			}
+		}
+
+		if len(self.queue) == 0 {
+			return
+		}
+
+		m := self.queue[0]
+		self.queue = self.queue[1:]
+		if !self.down[m.to] {
+			self.replicators[m.to].handle(m.from, m.msg)
+		}
+	}
+}
+
+func (self *testNetwork) elect(leader string, view int64) {
+	for id, r := range self.replicators {
+		if self.down[id] {
+			continue
+		}
+		r.stepDown()
+		if id == leader {
+			r.lead(view)
+		} else {
+			r.follow(leader, view)
+		}
+	}
+	self.pump()
+}
+
+func (self *testNetwork) converged(t *testing.T, expected string, members ...string) {
+	assert.Eventually(t, func() bool {
+		self.pump()
+		for _, id := range members {
+			if self.machines[id].get() != expected {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestReplicatorCommit(t *testing.T) {
+	net := newTestNetwork(SnapshotPolicy{}, "A", "B", "C")
+	defer net.close()
+
+	net.elect("A", 1)
+	assert.True(t, net.replicators["A"].ready)
+
+	// Followers cannot accept proposals
+	assert.Equal(t, ErrNotLeader, net.replicators["B"].propose([]byte("x")).err)
+
+	result := net.replicators["A"].propose([]byte("x"))
+	assert.Nil(t, result.err)
+	net.replicators["A"].propose([]byte("y"))
+	net.pump()
+
+	applied := <-result.waiter
+	assert.Nil(t, applied.err)
+	assert.Equal(t, "X", string(applied.result))
+
+	// Followers learn of the commit on the next append
+	net.replicators["A"].tick()
+	net.converged(t, "x,y", "A", "B", "C")
+}
+
+func TestReplicatorViewChangeRecoversCommittedEntries(t *testing.T) {
+	net := newTestNetwork(SnapshotPolicy{}, "A", "B", "C")
+	defer net.close()
+
+	net.elect("A", 1)
+
+	// Only B sees these, which is still a quorum
+	net.down["C"] = true
+	net.replicators["A"].propose([]byte("x"))
+	net.replicators["A"].propose([]byte("y"))
+	net.pump()
+	net.converged(t, "x,y", "A")
+
+	// C is elected without the entries and must fetch them from B before proceeding
+	net.down["A"] = true
+	net.down["C"] = false
+	net.elect("C", 2)
+	assert.True(t, net.replicators["C"].ready)
+	assert.Equal(t, uint64(4), net.replicators["C"].log.LastIndex())
+
+	net.replicators["C"].propose([]byte("z"))
+	net.pump()
+	net.replicators["C"].tick()
+	net.converged(t, "x,y,z", "B", "C")
+}
+
+func TestReplicatorSnapshotCatchup(t *testing.T) {
+	net := newTestNetwork(SnapshotPolicy{Entries: 2}, "A", "B", "C")
+	defer net.close()
+
+	net.elect("A", 1)
+
+	net.down["C"] = true
+	for _, cmd := range []string{"a", "b", "c", "d", "e"} {
+		net.replicators["A"].propose([]byte(cmd))
+		net.pump()
+	}
+	net.replicators["A"].tick()
+	net.converged(t, "a,b,c,d,e", "A", "B")
+
+	// Wait until the leader has compacted past everything C has seen
+	assert.Eventually(t, func() bool {
+		net.pump()
+		return net.replicators["A"].log.SnapshotIndex() > net.replicators["C"].log.LastIndex()
+	}, 5*time.Second, time.Millisecond)
+
+	net.down["C"] = false
+	net.replicators["A"].tick()
+	net.converged(t, "a,b,c,d,e", "C")
+
+	net.replicators["A"].propose([]byte("f"))
+	net.pump()
+	net.replicators["A"].tick()
+	net.converged(t, "a,b,c,d,e,f", "A", "B", "C")
+}
+
+func TestReplicatorSnapshotRestoreFailure(t *testing.T) {
+	net := newTestNetwork(SnapshotPolicy{Entries: 2}, "A", "B", "C")
+	defer net.close()
+
+	net.elect("A", 1)
+
+	net.down["C"] = true
+	for _, cmd := range []string{"a", "b", "c", "d", "e"} {
+		net.replicators["A"].propose([]byte(cmd))
+		net.pump()
+	}
+
+	assert.Eventually(t, func() bool {
+		net.pump()
+		return net.replicators["A"].log.SnapshotIndex() > net.replicators["C"].log.LastIndex()
+	}, 5*time.Second, time.Millisecond)
+
+	// C fails to restore the first snapshot it is sent, and fetches it again
+	net.machines["C"].failRestores = 1
+	net.down["C"] = false
+
+	assert.Eventually(t, func() bool {
+		net.replicators["A"].tick()
+		net.pump()
+		return net.machines["C"].get() == "a,b,c,d,e"
+	}, 5*time.Second, time.Millisecond)
+	assert.False(t, net.replicators["C"].needSnapshot)
+
+	net.replicators["A"].propose([]byte("f"))
+	net.pump()
+	net.replicators["A"].tick()
+	net.converged(t, "a,b,c,d,e,f", "A", "B", "C")
+}
+
+// With their logs persisted, members that all restart at once keep every committed entry
+func TestReplicatorRestartKeepsCommittedEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replicator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := func() *testNetwork {
+		net := newTestNetwork(SnapshotPolicy{Entries: 3}, "A", "B", "C")
+		for id, r := range net.replicators {
+			if err := r.restoreLog(filepath.Join(dir, id)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return net
+	}
+
+	net := start()
+	net.elect("A", 1)
+	for _, cmd := range []string{"a", "b", "c", "d", "e"} {
+		net.replicators["A"].propose([]byte(cmd))
+		net.pump()
+	}
+	net.replicators["A"].tick()
+	net.converged(t, "a,b,c,d,e", "A", "B", "C")
+	net.close()
+
+	// Some of the entries were compacted into snapshots, and the rest must be recommitted
+	net = start()
+	defer net.close()
+	assert.True(t, net.replicators["B"].log.SnapshotIndex() > 0)
+
+	net.elect("B", 2)
+	net.replicators["B"].tick()
+	net.converged(t, "a,b,c,d,e", "A", "B", "C")
+
+	net.replicators["B"].propose([]byte("f"))
+	net.pump()
+	net.replicators["B"].tick()
+	net.converged(t, "a,b,c,d,e,f", "A", "B", "C")
+}
+
+type blockedStateMachine struct {
+	testStateMachine
+	release chan struct{}
+}
+
+func (self *blockedStateMachine) Apply(command []byte) []byte {
+	<-self.release
+	return self.testStateMachine.Apply(command)
+}
+
+func TestApplierQueueDoesNotBlock(t *testing.T) {
+	a := newApplier()
+	sm := &blockedStateMachine{release: make(chan struct{})}
+	a.sm = sm
+	go a.run()
+	defer a.close()
+
+	// However far behind the state machine falls, handing over work returns at once
+	done := make(chan struct{})
+	go func() {
+		for i := uint64(1); i <= 5000; i++ {
+			a.enqueue(&applyOp{entries: []*pb.Entry{{Index: proto.Uint64(i), ViewId: proto.Int64(1), Data: []byte("x")}}})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("enqueue blocked on a slow state machine")
+	}
+
+	close(sm.release)
+	assert.Nil(t, a.waitApplied(context.Background(), 5000))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// Revocations records the members that may no longer take part in the cluster: those listed
+// in a local denylist by identity or certificate serial, and optionally those whose
+// certificates appear on a CRL published by the CA that issued them
+type Revocations struct {
+	ids     map[string]bool
+	serials map[string]bool
+	crl     *x509.RevocationList
+	issuer  *x509.Certificate
+}
+
+func NewRevocations() *Revocations {
+	return &Revocations{ids: make(map[string]bool), serials: make(map[string]bool)}
+}
+
+// LoadDenylist reads a denylist, which holds one entry per line: either a member identity
+// or "serial:" followed by a certificate serial number in decimal or 0x-prefixed hex.
+// Blank lines and lines starting with # are ignored.
+func LoadDenylist(path string) (*Revocations, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open denylist \"%s\": %s", path, err.Error())
+	}
+	defer file.Close()
+
+	revocations := NewRevocations()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "serial:") {
+			serial, ok := new(big.Int).SetString(strings.TrimPrefix(line, "serial:"), 0)
+			if !ok {
+				return nil, fmt.Errorf("invalid serial in denylist \"%s\": %s", path, line)
+			}
+			revocations.serials[serial.String()] = true
+		} else {
+			revocations.ids[line] = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return revocations, nil
+}
+
+// LoadCRL adds a CRL to the revocations.  The CRL must be signed by the issuer, and applies
+// only to certificates the issuer has issued.
+func (self *Revocations) LoadCRL(crlPath, issuerPath string) error {
+	issuers, err := ParseCertificates(issuerPath)
+	if err != nil {
+		return err
+	}
+	if len(issuers) != 1 {
+		return fmt.Errorf("expected a single CRL issuer in \"%s\", found %d", issuerPath, len(issuers))
+	}
+
+	buf, err := ioutil.ReadFile(crlPath)
+	if err != nil {
+		return fmt.Errorf("failed to open CRL \"%s\": %s", crlPath, err.Error())
+	}
+
+	// Accept both PEM and DER encodings
+	if block, _ := pem.Decode(buf); block != nil {
+		buf = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(buf)
+	if err != nil {
+		return fmt.Errorf("failed to parse CRL \"%s\": %s", crlPath, err.Error())
+	}
+
+	if err := crl.CheckSignatureFrom(issuers[0]); err != nil {
+		return fmt.Errorf("CRL \"%s\" is not signed by its issuer: %s", crlPath, err.Error())
+	}
+
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		fmt.Printf("CRL %s is out of date since %v\n", crlPath, crl.NextUpdate)
+	}
+
+	self.crl = crl
+	self.issuer = issuers[0]
+	return nil
+}
+
+// Revoked reports whether a member, as identified by the certificate it presents, has been
+// revoked
+func (self *Revocations) Revoked(member *Identity) bool {
+	if self == nil {
+		return false
+	}
+
+	if self.ids[member.Id] {
+		return true
+	}
+
+	if member.Cert == nil {
+		return false
+	}
+
+	if self.serials[member.Cert.SerialNumber.String()] {
+		return true
+	}
+
+	if self.crl != nil && bytes.Equal(member.Cert.RawIssuer, self.issuer.RawSubject) {
+		for _, entry := range self.crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(member.Cert.SerialNumber) == 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// onRevocations excludes revoked members from elections and disconnects them
+func (self *Controller) onRevocations(revocations *Revocations) {
+	for id, member := range self.peers {
+		if id == self.myId {
+			continue
+		}
+
+		revoked := revocations.Revoked(member)
+
+		// The certificate a peer presented may not be the one we were configured with
+		if peer, ok := self.activePeers[id]; ok && !revoked {
+			revoked = revocations.Revoked(peer.conn.Id)
+		}
+
+		if revoked != self.electionManager.Excluded(id) {
+			if revoked {
+				fmt.Printf("%s has been revoked\n", id)
+			} else {
+				fmt.Printf("%s is no longer revoked\n", id)
+			}
+		}
+
+		self.electionManager.SetExcluded(id, revoked)
+
+		if peer, ok := self.activePeers[id]; ok && revoked {
+			peer.Close()
+		}
+	}
+}
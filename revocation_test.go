@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDenylist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "denylist")
+	ioutil.WriteFile(path, []byte("# compromised\nB\n\nserial:42\nserial:0x2b\n"), 0600)
+
+	revocations, err := LoadDenylist(path)
+	assert.Nil(t, err)
+
+	cert, _ := newTestCertificate(t, "C")
+
+	cases := []struct {
+		id       string
+		serial   int64
+		expected bool
+	}{
+		{"A", 1, false},
+		{"B", 1, true},
+		{"C", 42, true},
+		{"C", 43, true},
+		{"C", 44, false},
+	}
+
+	for _, c := range cases {
+		member := &Identity{Id: c.id, Cert: &x509.Certificate{SerialNumber: big.NewInt(c.serial)}}
+		assert.Equal(t, c.expected, revocations.Revoked(member), "%s/%d", c.id, c.serial)
+	}
+
+	// Nothing is revoked without revocations
+	var none *Revocations
+	assert.False(t, none.Revoked(NewIdentity(cert)))
+
+	ioutil.WriteFile(path, []byte("serial:forty-two\n"), 0600)
+	_, err = LoadDenylist(path)
+	assert.NotNil(t, err)
+}
+
+func TestCRL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caKey := newTestKey(t)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.Nil(t, err)
+	ca, _ := x509.ParseCertificate(caDer)
+
+	issue := func(serial int64) *x509.Certificate {
+		key := newTestKey(t)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "member"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		assert.Nil(t, err)
+		cert, _ := x509.ParseCertificate(der)
+		return cert
+	}
+
+	crlDer, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: big.NewInt(7), RevocationTime: time.Now()}},
+	}, ca, caKey)
+	assert.Nil(t, err)
+
+	crlPath := filepath.Join(dir, "crl.pem")
+	issuerPath := filepath.Join(dir, "ca.pem")
+	writeTestPem(t, crlPath, "X509 CRL", crlDer)
+	writeTestPem(t, issuerPath, "CERTIFICATE", caDer)
+
+	revocations := NewRevocations()
+	assert.Nil(t, revocations.LoadCRL(crlPath, issuerPath))
+
+	assert.True(t, revocations.Revoked(NewIdentity(issue(7))))
+	assert.False(t, revocations.Revoked(NewIdentity(issue(8))))
+
+	// The CRL only speaks for certificates its issuer issued
+	other, _ := newTestCertificateWithKey(t, "other", &caKey.PublicKey, caKey)
+	other.SerialNumber = big.NewInt(7)
+	assert.False(t, revocations.Revoked(NewIdentity(other)))
+
+	// A CRL must be signed by the issuer it claims
+	impostor, _ := newTestCertificate(t, "ca")
+	writeTestPem(t, issuerPath, "CERTIFICATE", impostor.Raw)
+	assert.NotNil(t, NewRevocations().LoadCRL(crlPath, issuerPath))
+}
+
+func TestRevokedPeerRefused(t *testing.T) {
+	cert, clientCert := newTestCertificate(t, "client")
+	_, serverCert := newTestCertificate(t, "server")
+
+	revocations := NewRevocations()
+	revocations.ids[NewIdentity(cert).Id] = true
+
+	a, b := net.Pipe()
+	server := tls.Server(a, newConfig(serverCert, nil))
+	client := tls.Client(b, newConfig(clientCert, nil))
+
+	go verifyCrypto(client, &connectionPolicy{})
+
+	_, err := verifyCrypto(server, &connectionPolicy{revocations: revocations})
+	assert.NotNil(t, err)
+}
+
+func TestRevokedMemberExcluded(t *testing.T) {
+	c := newTestController("A", "B", "C", "D", "E")
+	for id := range c.peers {
+		c.peers[id].Cert = &x509.Certificate{SerialNumber: big.NewInt(1)}
+	}
+
+	c.onVote("B", "B", 0)
+	c.onVote("C", "B", 0)
+	assert.Equal(t, 2, c.electionManager.VoteCount())
+
+	revocations := NewRevocations()
+	revocations.ids["B"] = true
+	c.onRevocations(revocations)
+
+	// B's ballot, and those for it, no longer count
+	assert.Equal(t, 0, c.electionManager.VoteCount())
+	c.onVote("B", "C", 0)
+	assert.Equal(t, 0, c.electionManager.VoteCount())
+	c.onVote("C", "B", 0)
+	assert.Equal(t, 0, c.electionManager.VoteCount())
+
+	// Lifting the revocation restores B
+	c.onRevocations(NewRevocations())
+	c.onVote("B", "C", 0)
+	assert.Equal(t, 1, c.electionManager.VoteCount())
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ghaskins/go-cluster/pb"
+	"sync"
+)
+
+// Handler is invoked for every application message received on a topic.  Messages from
+// any one peer are delivered in order, one at a time.
+type Handler func(from string, payload []byte)
+
+// Router dispatches application traffic arriving on any peer to the registered handlers
+type Router struct {
+	mutex    sync.RWMutex
+	handlers map[string]Handler
+	methods  map[string]RpcHandler
+}
+
+func NewRouter() *Router {
+	return &Router{
+		handlers: make(map[string]Handler),
+		methods:  make(map[string]RpcHandler),
+	}
+}
+
+func (self *Router) Handle(topic string, handler Handler) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if handler == nil {
+		delete(self.handlers, topic)
+	} else {
+		self.handlers[topic] = handler
+	}
+}
+
+func (self *Router) dispatch(from string, msg *pb.Application) {
+	self.mutex.RLock()
+	handler, ok := self.handlers[msg.GetTopic()]
+	self.mutex.RUnlock()
+
+	if !ok {
+		fmt.Printf("Dropping message from %s for unhandled topic \"%s\"\n", from, msg.GetTopic())
+		return
+	}
+
+	handler(from, msg.GetPayload())
+}
+
+func (self *Router) HandleCall(method string, handler RpcHandler) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if handler == nil {
+		delete(self.methods, method)
+	} else {
+		self.methods[method] = handler
+	}
+}
+
+func (self *Router) call(ctx context.Context, from, method string, request []byte) ([]byte, error) {
+	self.mutex.RLock()
+	handler, ok := self.methods[method]
+	self.mutex.RUnlock()
+
+	if !ok {
+		return nil, &RpcError{Status: pb.Status_UNKNOWN_METHOD, Message: method}
+	}
+
+	return handler(ctx, from, request)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ghaskins/go-cluster/pb"
+	"github.com/golang/protobuf/proto"
+	"time"
+)
+
+// RpcHandler services a request/response call.  The context is cancelled if the caller
+// gives up, its deadline expires, or the connection to the caller is lost.
+type RpcHandler func(ctx context.Context, from string, request []byte) ([]byte, error)
+
+// RpcError carries a non-OK status back from the remote end of a call.  Handlers may also
+// return an *RpcError to control the status reported to the caller.
+type RpcError struct {
+	Status  pb.Status
+	Message string
+}
+
+func (self *RpcError) Error() string {
+	if self.Message == "" {
+		return fmt.Sprintf("rpc failed: %s", self.Status)
+	}
+	return fmt.Sprintf("rpc failed: %s: %s", self.Status, self.Message)
+}
+
+func errorStatus(ctx context.Context, err error) (pb.Status, string) {
+	switch {
+	case ctx.Err() == context.Canceled:
+		return pb.Status_CANCELLED, ""
+	case ctx.Err() == context.DeadlineExceeded:
+		return pb.Status_DEADLINE_EXCEEDED, ""
+	}
+
+	switch err {
+	case ErrNotLeader:
+		return pb.Status_NOT_LEADER, ""
+	case ErrNoQuorum:
+		return pb.Status_NO_QUORUM, ""
+	}
+
+	if rpcErr, ok := err.(*RpcError); ok {
+		return rpcErr.Status, rpcErr.Message
+	}
+
+	return pb.Status_ERROR, err.Error()
+}
+
+// Call issues a request to the peer and waits for the response.  Any deadline on ctx is
+// propagated to the remote handler, and cancelling ctx cancels the remote handler.
+func (self *Peer) Call(ctx context.Context, method string, request []byte) ([]byte, error) {
+	result := make(chan *pb.Response, 1)
+
+	self.rpcLock.Lock()
+	self.nextCallId++
+	id := self.nextCallId
+	self.pendingCalls[id] = result
+	self.rpcLock.Unlock()
+
+	defer func() {
+		self.rpcLock.Lock()
+		delete(self.pendingCalls, id)
+		self.rpcLock.Unlock()
+	}()
+
+	msg := &pb.Request{
+		Id:      proto.Uint64(id),
+		Method:  proto.String(method),
+		Payload: request,
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline) / time.Millisecond
+		if remaining <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		msg.Timeout = proto.Int64(int64(remaining))
+	}
+
+	if err := self.Send(msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case resp := <-result:
+		switch resp.GetStatus() {
+		case pb.Status_OK:
+			return resp.GetPayload(), nil
+		case pb.Status_DEADLINE_EXCEEDED:
+			// The remote clock may expire our deadline a hair before we do
+			return nil, context.DeadlineExceeded
+		case pb.Status_CANCELLED:
+			return nil, context.Canceled
+		case pb.Status_NOT_LEADER:
+			return nil, ErrNotLeader
+		case pb.Status_NO_QUORUM:
+			return nil, ErrNoQuorum
+		default:
+			return nil, &RpcError{Status: resp.GetStatus(), Message: resp.GetError()}
+		}
+	case <-ctx.Done():
+		// Let the remote side know that nobody is waiting for the result any longer
+		self.Send(&pb.Cancel{Id: proto.Uint64(id)})
+		return nil, ctx.Err()
+	case <-self.ctx.Done():
+		return nil, ErrPeerClosed
+	}
+}
+
+func (self *Peer) serveCall(req *pb.Request) {
+	// Handlers run under the lifetime of the peer so that a disconnect cancels them
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	if req.GetTimeout() > 0 {
+		ctx, cancel = context.WithTimeout(self.ctx, time.Duration(req.GetTimeout())*time.Millisecond)
+	} else {
+		ctx, cancel = context.WithCancel(self.ctx)
+	}
+
+	id := req.GetId()
+
+	self.rpcLock.Lock()
+	self.inflightCalls[id] = cancel
+	self.rpcLock.Unlock()
+
+	go func() {
+		defer func() {
+			self.rpcLock.Lock()
+			delete(self.inflightCalls, id)
+			self.rpcLock.Unlock()
+			cancel()
+		}()
+
+		payload, err := self.router.call(ctx, self.Id(), req.GetMethod(), req.GetPayload())
+
+		resp := &pb.Response{Id: proto.Uint64(id)}
+		if err != nil {
+			status, message := errorStatus(ctx, err)
+			resp.Status = status.Enum()
+			if message != "" {
+				resp.Error = proto.String(message)
+			}
+		} else {
+			resp.Status = pb.Status_OK.Enum()
+			resp.Payload = payload
+		}
+
+		self.Send(resp)
+	}()
+}
+
+func (self *Peer) completeCall(resp *pb.Response) {
+	self.rpcLock.Lock()
+	result, ok := self.pendingCalls[resp.GetId()]
+	self.rpcLock.Unlock()
+
+	if ok {
+		// The channel is buffered and only ever receives one response
+		select {
+		case result <- resp:
+		default:
+		}
+	}
+}
+
+func (self *Peer) cancelCall(msg *pb.Cancel) {
+	self.rpcLock.Lock()
+	cancel, ok := self.inflightCalls[msg.GetId()]
+	self.rpcLock.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/ghaskins/go-cluster/pb"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestRpcPair(t *testing.T, router *Router) (*Peer, *Peer) {
+	a, b := newTestConnectionPair(t)
+
+	client, _, _ := newTestPeer(a)
+	server, _, _ := newTestPeerWithRouter(b, router)
+	client.Run()
+	server.Run()
+
+	return client, server
+}
+
+func TestRpcCall(t *testing.T) {
+	router := NewRouter()
+	router.HandleCall("echo", func(ctx context.Context, from string, request []byte) ([]byte, error) {
+		return append([]byte("echo: "), request...), nil
+	})
+	router.HandleCall("fail", func(ctx context.Context, from string, request []byte) ([]byte, error) {
+		return nil, errors.New("boom")
+	})
+
+	client, server := newTestRpcPair(t, router)
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.Call(ctx, "echo", []byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, "echo: hello", string(resp))
+
+	_, err = client.Call(ctx, "fail", nil)
+	rpcErr, ok := err.(*RpcError)
+	assert.True(t, ok)
+	assert.Equal(t, pb.Status_ERROR, rpcErr.Status)
+	assert.Equal(t, "boom", rpcErr.Message)
+
+	_, err = client.Call(ctx, "missing", nil)
+	rpcErr, ok = err.(*RpcError)
+	assert.True(t, ok)
+	assert.Equal(t, pb.Status_UNKNOWN_METHOD, rpcErr.Status)
+}
+
+func TestRpcDeadlinePropagation(t *testing.T) {
+	deadlines := make(chan bool, 1)
+
+	router := NewRouter()
+	router.HandleCall("slow", func(ctx context.Context, from string, request []byte) ([]byte, error) {
+		_, ok := ctx.Deadline()
+		deadlines <- ok
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	client, server := newTestRpcPair(t, router)
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	_, err := client.Call(ctx, "slow", nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, <-deadlines)
+}
+
+func TestRpcCancelPropagation(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	router := NewRouter()
+	router.HandleCall("block", func(ctx context.Context, from string, request []byte) ([]byte, error) {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return nil, ctx.Err()
+	})
+
+	client, server := newTestRpcPair(t, router)
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.Call(ctx, "block", nil)
+		errs <- err
+	}()
+
+	<-started
+	cancel()
+
+	assert.Equal(t, context.Canceled, <-errs)
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote handler was not cancelled")
+	}
+}
+
+func TestRpcDisconnectFailsPendingCall(t *testing.T) {
+	started := make(chan struct{})
+
+	router := NewRouter()
+	router.HandleCall("block", func(ctx context.Context, from string, request []byte) ([]byte, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	client, server := newTestRpcPair(t, router)
+	defer client.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.Call(context.Background(), "block", nil)
+		errs <- err
+	}()
+
+	<-started
+	server.Close()
+
+	select {
+	case err := <-errs:
+		assert.Equal(t, ErrPeerClosed, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending call was not failed by the disconnect")
+	}
+}
+
+func TestRpcTypedErrors(t *testing.T) {
+	router := NewRouter()
+	router.HandleCall("deposed", func(ctx context.Context, from string, request []byte) ([]byte, error) {
+		return nil, ErrNotLeader
+	})
+	router.HandleCall("isolated", func(ctx context.Context, from string, request []byte) ([]byte, error) {
+		return nil, ErrNoQuorum
+	})
+
+	client, server := newTestRpcPair(t, router)
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.Call(ctx, "deposed", nil)
+	assert.Equal(t, ErrNotLeader, err)
+
+	_, err = client.Call(ctx, "isolated", nil)
+	assert.Equal(t, ErrNoQuorum, err)
+}
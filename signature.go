@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ghaskins/go-cluster/pb"
+)
+
+var (
+	ErrUnsigned     = errors.New("message is not signed")
+	ErrBadSignature = errors.New("message signature is invalid")
+)
+
+// signer signs the votes and heartbeats we originate with our certificate key, and
+// verifies those originated by other members against their certificates.  Because the
+// signature covers the originator, a signed vote may be relayed by any member and still be
+// attributed to the member that cast it.
+type signer struct {
+	myId    string
+	key     crypto.Signer
+	members IdentityMap
+}
+
+func newSigner(myId string, key crypto.PrivateKey, members IdentityMap) (*signer, error) {
+	s, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key of type %T cannot sign", key)
+	}
+
+	return &signer{myId: myId, key: s, members: members}, nil
+}
+
+func votePayload(voter, peerId string, viewId int64) []byte {
+	return signingPayload("vote", voter, peerId, viewId, 0)
+}
+
+// heartbeatMark is the position of a leader's heartbeat: its view and sequence number
+type heartbeatMark struct {
+	view int64
+	seq  uint64
+}
+
+func heartbeatPayload(leader string, viewId int64, seq uint64) []byte {
+	return signingPayload("heartbeat", leader, "", viewId, seq)
+}
+
+// signingPayload encodes the fields covered by a signature unambiguously.  The kind is
+// included so that a signature over one message type can never be replayed as another.
+func signingPayload(kind, origin, subject string, viewId int64, seq uint64) []byte {
+	buf := new(bytes.Buffer)
+
+	for _, field := range []string{"go-cluster", kind, origin, subject} {
+		binary.Write(buf, binary.BigEndian, uint32(len(field)))
+		buf.WriteString(field)
+	}
+
+	binary.Write(buf, binary.BigEndian, viewId)
+	binary.Write(buf, binary.BigEndian, seq)
+
+	return buf.Bytes()
+}
+
+func (self *signer) sign(payload []byte) ([]byte, error) {
+	if _, ok := self.key.Public().(ed25519.PublicKey); ok {
+		// Ed25519 signs the message itself rather than a digest
+		return self.key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+
+	digest := sha256.Sum256(payload)
+	return self.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+func (self *signer) verify(origin string, payload, signature []byte) error {
+	if len(signature) == 0 {
+		return ErrUnsigned
+	}
+
+	member, ok := self.members[origin]
+	if !ok {
+		return fmt.Errorf("%s is not a member", origin)
+	}
+
+	var algorithm x509.SignatureAlgorithm
+	switch member.Cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		algorithm = x509.SHA256WithRSA
+	case *ecdsa.PublicKey:
+		algorithm = x509.ECDSAWithSHA256
+	case ed25519.PublicKey:
+		algorithm = x509.PureEd25519
+	default:
+		return fmt.Errorf("%s has an unsupported key of type %T", origin, member.Cert.PublicKey)
+	}
+
+	if err := member.Cert.CheckSignature(algorithm, payload, signature); err != nil {
+		return ErrBadSignature
+	}
+
+	return nil
+}
+
+func (self *signer) signVote(msg *pb.Vote) error {
+	signature, err := self.sign(votePayload(self.myId, msg.GetPeerId(), msg.GetViewId()))
+	if err != nil {
+		return err
+	}
+
+	msg.Voter = &self.myId
+	msg.Signature = signature
+	return nil
+}
+
+// verifyVote returns the member that cast a vote once its signature has been checked
+func (self *signer) verifyVote(msg *pb.Vote) (string, error) {
+	voter := msg.GetVoter()
+	if err := self.verify(voter, votePayload(voter, msg.GetPeerId(), msg.GetViewId()), msg.GetSignature()); err != nil {
+		return "", err
+	}
+
+	return voter, nil
+}
+
+func (self *signer) signHeartbeat(msg *pb.Heartbeat) error {
+	signature, err := self.sign(heartbeatPayload(self.myId, msg.GetViewId(), msg.GetSeq()))
+	if err != nil {
+		return err
+	}
+
+	msg.Leader = &self.myId
+	msg.Signature = signature
+	return nil
+}
+
+// verifyHeartbeat returns the leader that sent a heartbeat once its signature has been checked
+func (self *signer) verifyHeartbeat(msg *pb.Heartbeat) (string, error) {
+	leader := msg.GetLeader()
+	if err := self.verify(leader, heartbeatPayload(leader, msg.GetViewId(), msg.GetSeq()), msg.GetSignature()); err != nil {
+		return "", err
+	}
+
+	return leader, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/ghaskins/go-cluster/pb"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newTestCertificateWithKey(t *testing.T, cn string, public, private interface{}) (*x509.Certificate, *tls.Certificate) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, public, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: private}
+}
+
+// newTestSigners returns a signer for each member, all sharing the same membership
+func newTestSigners(t *testing.T, ids ...string) map[string]*signer {
+	members := IdentityMap{}
+	keys := make(map[string]*tls.Certificate)
+
+	for i, id := range ids {
+		var cert *x509.Certificate
+		var tlsCert *tls.Certificate
+
+		// Exercise each of the key types we support
+		switch i % 3 {
+		case 0:
+			cert, tlsCert = newTestCertificate(t, id)
+		case 1:
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, tlsCert = newTestCertificateWithKey(t, id, &key.PublicKey, key)
+		case 2:
+			public, private, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, tlsCert = newTestCertificateWithKey(t, id, public, private)
+		}
+
+		members[id] = &Identity{Id: id, Cert: cert}
+		keys[id] = tlsCert
+	}
+
+	signers := make(map[string]*signer)
+	for _, id := range ids {
+		s, err := newSigner(id, keys[id].PrivateKey, members)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers[id] = s
+	}
+
+	return signers
+}
+
+func TestSignedVotes(t *testing.T) {
+	signers := newTestSigners(t, "A", "B", "C")
+
+	for _, id := range []string{"A", "B", "C"} {
+		msg := &pb.Vote{ViewId: proto.Int64(3), PeerId: proto.String("B")}
+		assert.Nil(t, signers[id].signVote(msg))
+
+		// Any member can verify the vote, however it arrived
+		for _, verifier := range signers {
+			voter, err := verifier.verifyVote(msg)
+			assert.Nil(t, err)
+			assert.Equal(t, id, voter)
+		}
+
+		// Changing any signed field invalidates the signature
+		forged := proto.Clone(msg).(*pb.Vote)
+		forged.PeerId = proto.String("C")
+		_, err := signers["A"].verifyVote(forged)
+		assert.Equal(t, ErrBadSignature, err)
+
+		forged = proto.Clone(msg).(*pb.Vote)
+		forged.ViewId = proto.Int64(4)
+		_, err = signers["A"].verifyVote(forged)
+		assert.Equal(t, ErrBadSignature, err)
+	}
+
+	// A vote cannot be attributed to another member
+	msg := &pb.Vote{ViewId: proto.Int64(3), PeerId: proto.String("B")}
+	signers["A"].signVote(msg)
+	msg.Voter = proto.String("C")
+	_, err := signers["B"].verifyVote(msg)
+	assert.Equal(t, ErrBadSignature, err)
+
+	_, err = signers["B"].verifyVote(&pb.Vote{ViewId: proto.Int64(3), PeerId: proto.String("B"), Voter: proto.String("A")})
+	assert.Equal(t, ErrUnsigned, err)
+}
+
+func TestSignedHeartbeats(t *testing.T) {
+	signers := newTestSigners(t, "A", "B")
+
+	msg := &pb.Heartbeat{ViewId: proto.Int64(1), Seq: proto.Uint64(7)}
+	assert.Nil(t, signers["A"].signHeartbeat(msg))
+
+	leader, err := signers["B"].verifyHeartbeat(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, "A", leader)
+
+	msg.Seq = proto.Uint64(8)
+	_, err = signers["B"].verifyHeartbeat(msg)
+	assert.Equal(t, ErrBadSignature, err)
+
+	// A heartbeat signature is not a valid vote signature, even over the same fields
+	vote := &pb.Vote{ViewId: proto.Int64(1), PeerId: proto.String(""), Voter: proto.String("A"), Signature: msg.Signature}
+	_, err = signers["B"].verifyVote(vote)
+	assert.Equal(t, ErrBadSignature, err)
+}
+
+func TestRelayedVotes(t *testing.T) {
+	signers := newTestSigners(t, "A", "B", "C")
+	c := newTestController("A", "B", "C")
+
+	msg := &pb.Vote{ViewId: proto.Int64(0), PeerId: proto.String("C")}
+	signers["C"].signVote(msg)
+
+	// Without signatures, a vote is attributed to the member that sent it
+	voter, ok := c.voteOrigin("B", msg)
+	assert.True(t, ok)
+	assert.Equal(t, "B", voter)
+
+	// With them, a vote relayed by B is attributed to C, which cast it
+	c.signer = signers["A"]
+	voter, ok = c.voteOrigin("B", msg)
+	assert.True(t, ok)
+	assert.Equal(t, "C", voter)
+
+	// Once signatures are enabled, unsigned votes are refused
+	_, ok = c.voteOrigin("B", &pb.Vote{ViewId: proto.Int64(0), PeerId: proto.String("C")})
+	assert.False(t, ok)
+
+	// Our own votes are signed
+	voter, err := signers["B"].verifyVote(c.newVote("B", 0))
+	assert.Nil(t, err)
+	assert.Equal(t, "A", voter)
+}
+
+func TestReplayedHeartbeats(t *testing.T) {
+	controllers := newTestSignedControllers(t, "A", "B")
+	a, b := controllers["A"], controllers["B"]
+
+	first := a.newHeartbeat(nil)
+	second := a.newHeartbeat(nil)
+	assert.True(t, second.GetSeq() > first.GetSeq())
+
+	leader, ok := b.heartbeatOrigin("A", first)
+	assert.True(t, ok)
+	assert.Equal(t, "A", leader)
+
+	// A heartbeat is only good once, even relayed by someone else
+	_, ok = b.heartbeatOrigin("A", first)
+	assert.False(t, ok)
+	_, ok = b.heartbeatOrigin("C", first)
+	assert.False(t, ok)
+
+	_, ok = b.heartbeatOrigin("A", second)
+	assert.True(t, ok)
+	_, ok = b.heartbeatOrigin("A", first)
+	assert.False(t, ok)
+
+	// A leader that restarts numbers its heartbeats afresh, but only ever in a later view
+	a.heartbeatSeq = 0
+	a.electionManager.Restore(a.electionManager.View() + 1)
+	_, ok = b.heartbeatOrigin("A", a.newHeartbeat(nil))
+	assert.True(t, ok)
+}
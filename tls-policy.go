@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// TLSConfig is the "tls" block of the cluster config, which restricts the TLS connections
+// between members beyond Go's defaults
+type TLSConfig struct {
+	MinVersion     string   `json:"minVersion,omitempty"`     // "1.2" or "1.3", the default
+	Curves         []string `json:"curves,omitempty"`         // from X25519, P256, P384 and P521
+	CipherSuites   []string `json:"cipherSuites,omitempty"`   // by their standard names
+	SessionTickets bool     `json:"sessionTickets,omitempty"` // disabled by default
+	PinnedKeys     []string `json:"pinnedKeys,omitempty"`     // hex SHA-256 of each allowed public key
+}
+
+// TLSPolicy is the parsed form of a TLSConfig
+type TLSPolicy struct {
+	MinVersion     uint16
+	Curves         []tls.CurveID   // in order of preference; empty allows Go's defaults
+	CipherSuites   map[uint16]bool // empty allows Go's defaults
+	SessionTickets bool
+	PinnedKeys     map[string]bool // empty allows any key
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+func DefaultTLSPolicy() *TLSPolicy {
+	return &TLSPolicy{MinVersion: tls.VersionTLS13}
+}
+
+// Policy checks the settings, returning the default policy if there are none
+func (self *TLSConfig) Policy() (*TLSPolicy, error) {
+	policy := DefaultTLSPolicy()
+	if self == nil {
+		return policy, nil
+	}
+
+	if self.MinVersion != "" {
+		version, ok := tlsVersions[self.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported minimum TLS version \"%s\"", self.MinVersion)
+		}
+		policy.MinVersion = version
+	}
+
+	for _, name := range self.Curves {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve \"%s\"", name)
+		}
+		policy.Curves = append(policy.Curves, curve)
+	}
+
+	if len(self.CipherSuites) > 0 {
+		// Insecure suites are deliberately absent
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+
+		policy.CipherSuites = make(map[uint16]bool)
+		for _, name := range self.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite \"%s\"", name)
+			}
+			policy.CipherSuites[id] = true
+		}
+	}
+
+	policy.SessionTickets = self.SessionTickets
+
+	if len(self.PinnedKeys) > 0 {
+		policy.PinnedKeys = make(map[string]bool)
+		for _, pin := range self.PinnedKeys {
+			pin = strings.ToLower(pin)
+			if raw, err := hex.DecodeString(pin); err != nil || len(raw) != 32 {
+				return nil, fmt.Errorf("pinned key \"%s\" is not a hex SHA-256 hash", pin)
+			}
+			policy.PinnedKeys[pin] = true
+		}
+	}
+
+	return policy, nil
+}
+
+// verifyConnection enforces what the TLS configuration alone cannot: the pinned keys, and
+// the cipher suites allowed under TLS 1.3, which Go does not let us configure
+func (self *TLSPolicy) verifyConnection(state tls.ConnectionState) error {
+	if len(self.CipherSuites) > 0 && !self.CipherSuites[state.CipherSuite] {
+		return fmt.Errorf("cipher suite %s is not allowed", tls.CipherSuiteName(state.CipherSuite))
+	}
+
+	if len(self.PinnedKeys) > 0 {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("peer presented no certificate")
+		}
+
+		cert := state.PeerCertificates[0]
+		if !self.PinnedKeys[hashId(cert.RawSubjectPublicKeyInfo)] {
+			return fmt.Errorf("key of %s is not pinned", cert.Subject.CommonName)
+		}
+	}
+
+	return nil
+}
+
+// TLSParameters are those negotiated for a connection
+type TLSParameters struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipherSuite"`
+	Resumed     bool   `json:"resumed"`
+}
+
+func newTLSParameters(state tls.ConnectionState) *TLSParameters {
+	return &TLSParameters{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		Resumed:     state.DidResume,
+	}
+}
+
+func (self *TLSParameters) String() string {
+	description := fmt.Sprintf("%s with %s", self.Version, self.CipherSuite)
+	if self.Resumed {
+		description += ", resumed"
+	}
+
+	return description
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// handshake connects a client to a server under the policy given, returning the server's
+// end of the connection
+func handshake(t *testing.T, policy *TLSPolicy, client *tls.Config) (*Connection, error) {
+	_, serverCert := newTestCertificate(t, "server")
+
+	a, b := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		conn := tls.Client(b, client)
+		if conn.Handshake() == nil {
+			// Keep reading so that the server can deliver any alert
+			io.Copy(ioutil.Discard, conn)
+		}
+		conn.Close()
+		close(done)
+	}()
+
+	conn, err := verifyCrypto(tls.Server(a, newConfig(serverCert, policy)), &connectionPolicy{tls: policy})
+	if err == nil {
+		conn.Close()
+	} else {
+		a.Close()
+	}
+	<-done
+
+	return conn, err
+}
+
+func TestTLSConfigPolicy(t *testing.T) {
+	policy, err := (*TLSConfig)(nil).Policy()
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultTLSPolicy(), policy)
+	assert.Equal(t, uint16(tls.VersionTLS13), policy.MinVersion)
+
+	policy, err = (&TLSConfig{
+		MinVersion:   "1.2",
+		Curves:       []string{"X25519", "P384"},
+		CipherSuites: []string{"TLS_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		PinnedKeys:   []string{"3713D6C42276D17B355E952C1369CD2D0E9B3538661B738BD82CF1064A083E29"},
+	}).Policy()
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), policy.MinVersion)
+	assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP384}, policy.Curves)
+	assert.Equal(t, 2, len(policy.CipherSuites))
+	assert.True(t, policy.PinnedKeys["3713d6c42276d17b355e952c1369cd2d0e9b3538661b738bd82cf1064a083e29"])
+
+	for _, config := range []*TLSConfig{
+		{MinVersion: "1.0"},
+		{Curves: []string{"P192"}},
+		{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{PinnedKeys: []string{"abcd"}},
+	} {
+		_, err := config.Policy()
+		assert.NotNil(t, err)
+	}
+}
+
+func TestTLSPolicyEnforced(t *testing.T) {
+	_, clientCert := newTestCertificate(t, "client")
+
+	conn, err := handshake(t, nil, newConfig(clientCert, nil))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "TLS 1.3", conn.TLS.Version)
+	}
+
+	// A client limited to TLS 1.2 falls short of the default minimum
+	legacy := newConfig(clientCert, &TLSPolicy{MinVersion: tls.VersionTLS12})
+	legacy.MaxVersion = tls.VersionTLS12
+
+	_, err = handshake(t, nil, legacy)
+	assert.NotNil(t, err)
+
+	conn, err = handshake(t, &TLSPolicy{MinVersion: tls.VersionTLS12}, legacy)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "TLS 1.2", conn.TLS.Version)
+	}
+
+	// Restricting the cipher suites applies under TLS 1.3 too
+	restricted := DefaultTLSPolicy()
+	restricted.CipherSuites = map[uint16]bool{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: true}
+	_, err = handshake(t, restricted, newConfig(clientCert, nil))
+	assert.NotNil(t, err)
+
+	restricted.CipherSuites = map[uint16]bool{
+		tls.TLS_AES_128_GCM_SHA256:       true,
+		tls.TLS_AES_256_GCM_SHA384:       true,
+		tls.TLS_CHACHA20_POLY1305_SHA256: true,
+	}
+	_, err = handshake(t, restricted, newConfig(clientCert, nil))
+	assert.Nil(t, err)
+}
+
+func TestPinnedKeys(t *testing.T) {
+	pinnedCert, pinned := newTestCertificate(t, "pinned")
+	_, other := newTestCertificate(t, "other")
+
+	policy := DefaultTLSPolicy()
+	policy.PinnedKeys = map[string]bool{hashId(pinnedCert.RawSubjectPublicKeyInfo): true}
+
+	conn, err := handshake(t, policy, newConfig(pinned, nil))
+	if assert.Nil(t, err) {
+		assert.Equal(t, pinnedCert.Subject.CommonName, conn.Id.Cert.Subject.CommonName)
+	}
+
+	_, err = handshake(t, policy, newConfig(other, nil))
+	assert.NotNil(t, err)
+}
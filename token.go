@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrStaleToken = errors.New("fencing token has been superseded")
+
+// LeadershipToken returns a fencing token for this node's current term as leader, or
+// ErrNotLeader.  The token is that of the term's view, so every change of leadership
+// produces a greater token than the last, and locks granted during the term carry greater
+// tokens still.  Stamping external writes with it allows the recipient to reject writes
+// from a leader that has since been deposed.  Tokens only increase across restarts if the
+// cluster persists its views; see SetStateDir.
+func (self *Node) LeadershipToken() (FencingToken, error) {
+	leadership := self.controller.Leader()
+	if leadership.Leader != self.Id() {
+		return FencingToken{}, ErrNotLeader
+	}
+
+	return FencingToken{View: leadership.View}, nil
+}
+
+// TokenValidator is a helper for the recipients of stamped writes.  It remembers the
+// newest token it has seen and rejects any that are older.
+type TokenValidator struct {
+	mutex   sync.Mutex
+	valid   bool
+	highest FencingToken
+}
+
+// Validate returns ErrStaleToken if a newer token has already been presented, otherwise
+// it records token as the newest
+func (self *TokenValidator) Validate(token FencingToken) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.valid && self.highest.Supersedes(token) {
+		return ErrStaleToken
+	}
+
+	self.highest = token
+	self.valid = true
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestLeadershipToken(t *testing.T) {
+	node := newTestLeader(t, "A", "B", "C")
+
+	token, err := node.LeadershipToken()
+	assert.Nil(t, err)
+
+	setLeadership(node, "B", 2)
+	_, err = node.LeadershipToken()
+	assert.Equal(t, ErrNotLeader, err)
+
+	setLeadership(node, "A", 3)
+	next, err := node.LeadershipToken()
+	assert.Nil(t, err)
+	assert.True(t, next.Supersedes(token))
+}
+
+func TestTokenValidator(t *testing.T) {
+	var validator TokenValidator
+
+	cases := []struct {
+		token FencingToken
+		err   error
+	}{
+		{FencingToken{View: 0}, nil},
+		{FencingToken{View: 0}, nil}, // the current leader may keep writing
+		{FencingToken{View: 2}, nil},
+		{FencingToken{View: 1}, ErrStaleToken},    // a deposed leader may not
+		{FencingToken{View: 2, Sequence: 1}, nil}, // locks granted in its term supersede it
+		{FencingToken{View: 2}, ErrStaleToken},
+		{FencingToken{View: 5}, nil},
+		{FencingToken{View: 4, Sequence: 9}, ErrStaleToken},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.err, validator.Validate(c.token), "token %s", c.token)
+	}
+}
+
+func TestViewsSurviveRestart(t *testing.T) {
+	views := newViewStore(filepath.Join(t.TempDir(), "view"))
+
+	c := newTestController("A", "B", "C")
+	assert.Nil(t, c.restoreView(views))
+	assert.Equal(t, int64(0), c.electionManager.View())
+
+	// Even view 0 must be recorded once it is used
+	c.castPreferredBallot()
+	view, ok, err := views.load()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(0), view)
+
+	// After a restart we won't take part in that view again
+	c = newTestController("A", "B", "C")
+	assert.Nil(t, c.restoreView(views))
+	assert.Equal(t, int64(1), c.electionManager.View())
+}
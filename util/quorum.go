@@ -1,9 +1,23 @@
 package util
 
-import (
-	"math"
-)
-
+// ComputeQuorumThreshold returns the quorum for members that fail only by crashing: a simple
+// majority
 func ComputeQuorumThreshold(memberCount int) int {
-	return int(math.Ceil(float64(memberCount) * .5000000001)) // something *just* north of 50%
+	return ComputeFaultTolerantQuorum(memberCount, 0)
+}
+
+// ComputeFaultTolerantQuorum returns the smallest quorum for which any two quorums share at
+// least faults+1 members, so that they always have a correct member in common even when
+// that many members are byzantine.  With 3f+1 members and f faults this is 2f+1.
+func ComputeFaultTolerantQuorum(memberCount, faults int) int {
+	return (memberCount + faults + 2) / 2 // ceil((memberCount+faults+1)/2)
+}
+
+// MaxByzantineFaults returns the number of byzantine members that a group of memberCount
+// members can tolerate
+func MaxByzantineFaults(memberCount int) int {
+	if memberCount < 1 {
+		return 0
+	}
+	return (memberCount - 1) / 3
 }
@@ -0,0 +1,33 @@
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestQuorum(t *testing.T) {
+	cases := []struct {
+		members   int
+		crash     int
+		faults    int
+		byzantine int
+	}{
+		{1, 1, 0, 1},
+		{3, 2, 0, 2},
+		{4, 3, 1, 3},
+		{5, 3, 1, 4},
+		{7, 4, 2, 5},
+		{10, 6, 3, 7},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.crash, ComputeQuorumThreshold(c.members), "%d members", c.members)
+		assert.Equal(t, c.faults, MaxByzantineFaults(c.members), "%d members", c.members)
+		assert.Equal(t, c.byzantine, ComputeFaultTolerantQuorum(c.members, c.faults), "%d members", c.members)
+
+		// Any two quorums overlap in more members than may be faulty
+		q := ComputeFaultTolerantQuorum(c.members, c.faults)
+		assert.True(t, 2*q-c.members > c.faults)
+		assert.True(t, q <= c.members-c.faults)
+	}
+}
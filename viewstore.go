@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// viewStore durably records the latest view this member has voted or been elected in, so
+// that a restarted member never takes part in an election for a view that was already
+// used.  Views therefore increase monotonically across restarts, provided a quorum of
+// members keeps its store.
+type viewStore struct {
+	path string
+}
+
+func newViewStore(path string) *viewStore {
+	return &viewStore{path: path}
+}
+
+// load returns the recorded view, and false if nothing has been recorded yet
+func (self *viewStore) load() (int64, bool, error) {
+	data, err := ioutil.ReadFile(self.path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	view, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return view, true, nil
+}
+
+func (self *viewStore) save(view int64) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(self.path), ".view")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(strconv.FormatInt(view, 10) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	// The view must be on disk before we act on it
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), self.path); err != nil {
+		return err
+	}
+
+	// As must the rename, which is recorded in the directory
+	dir, err := os.Open(filepath.Dir(self.path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}